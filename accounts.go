@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/dvcrn/pocketsmith-go"
+	"github.com/dvcrn/pocketsmith-ininal/ininal"
+	"github.com/dvcrn/pocketsmith-ininal/psapi"
+	"github.com/dvcrn/pocketsmith-ininal/state"
+	"gopkg.in/yaml.v3"
+)
+
+const DEFAULT_NAME_TEMPLATE = "Ininal {{.AccountName}}"
+
+// AccountMapping pins an Ininal account to a Pocketsmith account
+type AccountMapping struct {
+	// AccountNumber or Iban identify the Ininal account
+	AccountNumber string `yaml:"account_number,omitempty"`
+	Iban          string `yaml:"iban,omitempty"`
+
+	// PocketsmithAccountID or TransactionAccountID select an existing
+	// Pocketsmith account. When both are empty the account is looked up by
+	// name and created if it doesn't exist.
+	PocketsmithAccountID int `yaml:"pocketsmith_account_id,omitempty"`
+	TransactionAccountID int `yaml:"transaction_account_id,omitempty"`
+
+	// NameTemplate, Institution and AccountType override the defaults of the
+	// mapping file for this account
+	NameTemplate string `yaml:"name_template,omitempty"`
+	Institution  string `yaml:"institution,omitempty"`
+	AccountType  string `yaml:"account_type,omitempty"`
+
+	// Ignore skips the account entirely
+	Ignore bool `yaml:"ignore,omitempty"`
+}
+
+// AccountMappings is the content of the account mapping file
+type AccountMappings struct {
+	// NameTemplate is a text/template executed with the ininal.AccountInfo
+	// to name accounts that are looked up or created by name
+	NameTemplate string           `yaml:"name_template,omitempty"`
+	Institution  string           `yaml:"institution,omitempty"`
+	AccountType  string           `yaml:"account_type,omitempty"`
+	Accounts     []AccountMapping `yaml:"accounts"`
+}
+
+// loadAccountMappings reads the mapping file at path. A missing file results
+// in an empty mapping.
+func loadAccountMappings(path string) (*AccountMappings, error) {
+	mappings := &AccountMappings{}
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return nil, fmt.Errorf("failed to read account mapping file: %v", err)
+			}
+		} else if err := yaml.Unmarshal(data, mappings); err != nil {
+			return nil, fmt.Errorf("failed to decode account mapping file: %v", err)
+		}
+	}
+
+	if err := mappings.validate(); err != nil {
+		return nil, err
+	}
+
+	return mappings, nil
+}
+
+func (m *AccountMappings) validate() error {
+	templates := []string{m.NameTemplate}
+	for i, mapping := range m.Accounts {
+		if mapping.AccountNumber == "" && mapping.Iban == "" {
+			return fmt.Errorf("account mapping %d needs an account_number or iban", i+1)
+		}
+		templates = append(templates, mapping.NameTemplate)
+	}
+
+	for _, t := range templates {
+		if t == "" {
+			continue
+		}
+		if _, err := template.New("name").Parse(t); err != nil {
+			return fmt.Errorf("invalid name template %q: %v", t, err)
+		}
+	}
+
+	return nil
+}
+
+func (m *AccountMappings) save(path string) error {
+	data, err := yaml.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to encode account mapping file: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write account mapping file: %v", err)
+	}
+	return nil
+}
+
+// find returns the mapping for account, matched by account number or IBAN
+func (m *AccountMappings) find(account ininal.AccountInfo) *AccountMapping {
+	iban := normalizeIban(account.Iban)
+	for i := range m.Accounts {
+		mapping := &m.Accounts[i]
+		if mapping.AccountNumber != "" && mapping.AccountNumber == account.AccountNumber {
+			return mapping
+		}
+		if iban != "" && normalizeIban(mapping.Iban) == iban {
+			return mapping
+		}
+	}
+	return nil
+}
+
+// normalizeIban drops the spaces IBANs are often grouped with and upper-cases
+// the country code and letters
+func normalizeIban(iban string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(iban), ""))
+}
+
+// settings merges the mapping of account with the defaults of the file
+func (m *AccountMappings) settings(account ininal.AccountInfo) AccountMapping {
+	settings := AccountMapping{
+		AccountNumber: account.AccountNumber,
+		NameTemplate:  m.NameTemplate,
+		Institution:   m.Institution,
+		AccountType:   m.AccountType,
+	}
+
+	if mapping := m.find(account); mapping != nil {
+		settings = *mapping
+		if settings.NameTemplate == "" {
+			settings.NameTemplate = m.NameTemplate
+		}
+		if settings.Institution == "" {
+			settings.Institution = m.Institution
+		}
+		if settings.AccountType == "" {
+			settings.AccountType = m.AccountType
+		}
+	}
+
+	if settings.NameTemplate == "" {
+		settings.NameTemplate = DEFAULT_NAME_TEMPLATE
+	}
+	if settings.Institution == "" {
+		settings.Institution = INSTITUION_NAME
+	}
+	if settings.AccountType == "" {
+		settings.AccountType = string(pocketsmith.AccountTypeCredits)
+	}
+
+	return settings
+}
+
+func accountName(nameTemplate string, account ininal.AccountInfo) (string, error) {
+	t, err := template.New("name").Parse(nameTemplate)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, account); err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(buf.String()), nil
+}
+
+func accountCurrency(account ininal.AccountInfo) string {
+	if account.Currency == "" {
+		return "try"
+	}
+	return strings.ToLower(account.Currency)
+}
+
+// target is the Pocketsmith account Ininal transactions are imported into
+type target struct {
+	// AccountID is 0 when the account was mapped by transaction account
+	AccountID            int
+	Title                string
+	TransactionAccountID int
+	InstitutionID        int
+}
+
+// findOrCreateAccount looks up the account by name, or by the name it gets
+// once archived, and creates it when neither exists
+func findOrCreateAccount(ps *pocketsmith.Client, userID int, name string, institutionName string, accountType string, currency string) (*pocketsmith.Account, error) {
+	start := time.Now()
+	account, err := ps.FindAccountByName(userID, name)
+	recordPocketsmith("GET /users/:id/accounts", start, err)
+	if err == pocketsmith.ErrNotFound {
+		start = time.Now()
+		account, err = ps.FindAccountByName(userID, name+CLOSED_SUFFIX)
+		recordPocketsmith("GET /users/:id/accounts", start, err)
+	}
+	if err != nil {
+		if err != pocketsmith.ErrNotFound {
+			return nil, err
+		}
+
+		start = time.Now()
+		institution, err := ps.FindInstitutionByName(userID, institutionName)
+		recordPocketsmith("GET /users/:id/institutions", start, err)
+		if err != nil {
+			if err != pocketsmith.ErrNotFound {
+				return nil, err
+			}
+
+			start = time.Now()
+			institution, err = ps.CreateInstitution(userID, institutionName, currency)
+			recordPocketsmith("POST /users/:id/institutions", start, err)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		start = time.Now()
+		account, err := ps.CreateAccount(userID, institution.ID, name, currency, pocketsmith.AccountType(accountType))
+		recordPocketsmith("POST /users/:id/accounts", start, err)
+		if err != nil {
+			return nil, err
+		}
+
+		return account, nil
+	}
+
+	return account, nil
+}
+
+// resolveAccount returns the Pocketsmith account for an Ininal account, or nil
+// when the account is ignored by the mapping. Without a mapping to an ID the
+// transaction account recorded by an earlier sync is used, so renaming the
+// Pocketsmith account doesn't create a new one.
+func resolveAccount(ps *pocketsmith.Client, api *psapi.Client, userID int, mappings *AccountMappings, account ininal.AccountInfo, known *state.Account) (*target, error) {
+	settings := mappings.settings(account)
+	if settings.Ignore {
+		return nil, nil
+	}
+
+	fromTransactionAccount := func(ta *psapi.TransactionAccount) (*target, error) {
+		if ta == nil || ta.Institution == nil {
+			return nil, fmt.Errorf("pocketsmith transaction account has no institution")
+		}
+		return &target{Title: ta.Name, TransactionAccountID: ta.ID, InstitutionID: ta.Institution.ID}, nil
+	}
+
+	if settings.TransactionAccountID != 0 {
+		ta, err := api.GetTransactionAccount(settings.TransactionAccountID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get mapped transaction account %d: %v", settings.TransactionAccountID, err)
+		}
+		t, err := fromTransactionAccount(ta)
+		if err != nil {
+			return nil, err
+		}
+		t.AccountID = settings.PocketsmithAccountID
+		return t, nil
+	}
+
+	if settings.PocketsmithAccountID != 0 {
+		acc, err := api.GetAccount(settings.PocketsmithAccountID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get mapped account %d: %v", settings.PocketsmithAccountID, err)
+		}
+		t, err := fromTransactionAccount(acc.PrimaryTransactionAccount)
+		if err != nil {
+			return nil, err
+		}
+		t.AccountID = acc.ID
+		return t, nil
+	}
+
+	if known != nil && known.TransactionAccountID != 0 {
+		ta, err := api.GetTransactionAccount(known.TransactionAccountID)
+		if err == nil {
+			return fromTransactionAccount(ta)
+		}
+		if !errors.Is(err, psapi.ErrNotFound) {
+			return nil, fmt.Errorf("failed to get transaction account %d: %v", known.TransactionAccountID, err)
+		}
+		fmt.Printf("Transaction account %d of account %s no longer exists, looking it up by name\n", known.TransactionAccountID, account.AccountNumber)
+	}
+
+	name, err := accountName(settings.NameTemplate, account)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render account name: %v", err)
+	}
+
+	psAcc, err := findOrCreateAccount(ps, userID, name, settings.Institution, settings.AccountType, accountCurrency(account))
+	if err != nil {
+		return nil, err
+	}
+
+	return &target{
+		AccountID:            psAcc.ID,
+		Title:                name,
+		TransactionAccountID: psAcc.PrimaryTransactionAccount.ID,
+		InstitutionID:        psAcc.PrimaryTransactionAccount.Institution.ID,
+	}, nil
+}
+
+// runLink interactively maps each Ininal account to a Pocketsmith account and
+// writes the result to the account mapping file
+func runLink(args []string) {
+	fs := flag.NewFlagSet("link", flag.ExitOnError)
+	config := registerConfigFlags(fs)
+	registerPocketsmithFlags(fs, config, true)
+	config.parse(fs, args)
+	config = config.singleIdentity()
+
+	if config.AccountMapping != nil {
+		fail(EXIT_USAGE, fmt.Errorf("the account mapping is defined in the config file %s, edit it there", config.ConfigFile))
+	}
+
+	mappings, err := loadAccountMappings(config.AccountsFile)
+	if err != nil {
+		fail(EXIT_ERROR, err)
+	}
+
+	ps := pocketsmith.NewClient(config.PocketsmithToken)
+	api := psapi.NewClient(config.PocketsmithToken)
+	start := time.Now()
+	res, err := ps.GetCurrentUser()
+	recordPocketsmith("GET /me", start, err)
+	if err != nil {
+		fail(EXIT_ERROR, err)
+	}
+
+	psAccounts, err := api.ListAccounts(res.ID)
+	if err != nil {
+		fail(EXIT_ERROR, err)
+	}
+
+	sess, err := login(config)
+	if err != nil {
+		fail(EXIT_ERROR, err)
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+
+	for _, account := range sess.cardAccount.AccountListResponse {
+		fmt.Printf("\nIninal account %s (%s, %s, IBAN %s, balance %.2f)\n", account.AccountNumber, account.AccountName, account.Currency, account.Iban, account.AccountBalance)
+		if mapping := mappings.find(account); mapping != nil {
+			switch {
+			case mapping.Ignore:
+				fmt.Println("Currently: ignored")
+			case mapping.TransactionAccountID != 0:
+				fmt.Println("Currently: transaction account", mapping.TransactionAccountID)
+			case mapping.PocketsmithAccountID != 0:
+				fmt.Println("Currently: Pocketsmith account", mapping.PocketsmithAccountID)
+			}
+		}
+
+		for i, psAcc := range psAccounts {
+			fmt.Printf("  %d) %s (%s, id %d)\n", i+1, psAcc.Title, psAcc.CurrencyCode, psAcc.ID)
+		}
+		fmt.Print("Link to [number], (n)ew account by name, (i)gnore, or press enter to keep the current setting: ")
+
+		input, _ := reader.ReadString('\n')
+		input = strings.TrimSpace(input)
+		if input == "" {
+			continue
+		}
+
+		mapping := mappings.find(account)
+		if mapping == nil {
+			mappings.Accounts = append(mappings.Accounts, AccountMapping{AccountNumber: account.AccountNumber, Iban: account.Iban})
+			mapping = &mappings.Accounts[len(mappings.Accounts)-1]
+		}
+
+		switch strings.ToLower(input) {
+		case "i":
+			mapping.Ignore = true
+			mapping.PocketsmithAccountID = 0
+			mapping.TransactionAccountID = 0
+		case "n":
+			mapping.Ignore = false
+			mapping.PocketsmithAccountID = 0
+			mapping.TransactionAccountID = 0
+		default:
+			n, err := strconv.Atoi(input)
+			if err != nil || n < 1 || n > len(psAccounts) {
+				fmt.Println("Invalid choice, keeping the current setting")
+				continue
+			}
+			mapping.Ignore = false
+			mapping.PocketsmithAccountID = psAccounts[n-1].ID
+			mapping.TransactionAccountID = 0
+			if psAccounts[n-1].PrimaryTransactionAccount != nil {
+				mapping.TransactionAccountID = psAccounts[n-1].PrimaryTransactionAccount.ID
+			}
+		}
+	}
+
+	if err := mappings.save(config.AccountsFile); err != nil {
+		fail(EXIT_ERROR, err)
+	}
+
+	fmt.Println("Wrote account mapping to", config.AccountsFile)
+}
+
+// CLOSED_SUFFIX is appended to the title of archived accounts. The lookup by
+// name also matches it, so a lost state or mapping file doesn't lead to a
+// duplicate account.
+const CLOSED_SUFFIX = " (closed)"
+
+// archiveAccount marks the Pocketsmith account of t as closed and removes it
+// from the net worth
+func archiveAccount(api *psapi.Client, userID int, t *target) error {
+	accountID := t.AccountID
+	if accountID == 0 {
+		accounts, err := api.ListAccounts(userID)
+		if err != nil {
+			return err
+		}
+		for _, acc := range accounts {
+			for _, ta := range acc.TransactionAccounts {
+				if ta.ID == t.TransactionAccountID {
+					accountID = acc.ID
+				}
+			}
+		}
+		if accountID == 0 {
+			return fmt.Errorf("no Pocketsmith account found for transaction account %d", t.TransactionAccountID)
+		}
+	}
+
+	acc, err := api.GetAccount(accountID)
+	if err != nil {
+		return err
+	}
+
+	title := acc.Title
+	if !strings.HasSuffix(title, CLOSED_SUFFIX) {
+		title += CLOSED_SUFFIX
+	}
+	isNetWorth := false
+
+	_, err = api.UpdateAccount(accountID, &psapi.UpdateAccount{Title: &title, IsNetWorth: &isNetWorth})
+	return err
+}
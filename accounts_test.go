@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/dvcrn/pocketsmith-ininal/ininal"
+)
+
+func TestAccountMappingsFind(t *testing.T) {
+	mappings := &AccountMappings{Accounts: []AccountMapping{
+		{AccountNumber: "1234", TransactionAccountID: 1},
+		{Iban: "TR12 0001 2345 6789 0123 4567 89", TransactionAccountID: 2},
+		{Iban: "tr980001234567890123456789", TransactionAccountID: 3},
+	}}
+
+	tests := []struct {
+		name     string
+		account  ininal.AccountInfo
+		expected int
+	}{
+		{"account number", ininal.AccountInfo{AccountNumber: "1234", Iban: "TR000000000000000000000000"}, 1},
+		{"IBAN with spaces in the mapping", ininal.AccountInfo{AccountNumber: "5678", Iban: "TR120001234567890123456789"}, 2},
+		{"IBAN with spaces from Ininal", ininal.AccountInfo{AccountNumber: "5678", Iban: "TR98 0001 2345 6789 0123 4567 89"}, 3},
+		{"padded IBAN", ininal.AccountInfo{AccountNumber: "5678", Iban: " TR120001234567890123456789 "}, 2},
+		{"no IBAN", ininal.AccountInfo{AccountNumber: "5678"}, 0},
+		{"unknown IBAN", ininal.AccountInfo{AccountNumber: "5678", Iban: "TR550001234567890123456789"}, 0},
+	}
+
+	for _, test := range tests {
+		got := 0
+		if mapping := mappings.find(test.account); mapping != nil {
+			got = mapping.TransactionAccountID
+		}
+		if got != test.expected {
+			t.Errorf("%s: expected mapping %d, got %d", test.name, test.expected, got)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dvcrn/pocketsmith-ininal/metrics"
+)
+
+// apiOTPs receives the OTPs posted to the API, it is only set while the API runs
+var apiOTPs *otpBroker
+
+// otpBroker hands the OTPs posted to the API to the logins waiting for them
+type otpBroker struct {
+	mu sync.Mutex
+	// pending is keyed by identity name, "" is the top-level login
+	pending map[string]chan string
+}
+
+func newOTPBroker() *otpBroker {
+	return &otpBroker{pending: map[string]chan string{}}
+}
+
+// wait blocks until the OTP of the login of config is posted
+func (b *otpBroker) wait(config *Config) (string, error) {
+	otps := make(chan string, 1)
+	b.mu.Lock()
+	b.pending[config.Identity] = otps
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		delete(b.pending, config.Identity)
+		b.mu.Unlock()
+	}()
+
+	if config.Identity != "" {
+		fmt.Printf("Waiting for the OTP of %s to be posted to /otp\n", config.Identity)
+	} else {
+		fmt.Println("Waiting for the OTP to be posted to /otp")
+	}
+
+	var timeout <-chan time.Time
+	if config.OTP.Timeout > 0 {
+		timeout = time.After(config.OTP.Timeout)
+	}
+
+	select {
+	case otp := <-otps:
+		return otp, nil
+	case <-timeout:
+		return "", fmt.Errorf("no OTP was posted within %s", config.OTP.Timeout)
+	}
+}
+
+// submit passes otp to the login of identity. It returns false when that login
+// is not waiting for an OTP.
+func (b *otpBroker) submit(identity, otp string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	otps, ok := b.pending[identity]
+	if !ok {
+		return false
+	}
+	delete(b.pending, identity)
+	otps <- otp
+	return true
+}
+
+// waiting returns the identities waiting for an OTP
+func (b *otpBroker) waiting() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	identities := []string{}
+	for identity := range b.pending {
+		identities = append(identities, identity)
+	}
+	sort.Strings(identities)
+	return identities
+}
+
+// apiStatus is the response of GET /status
+type apiStatus struct {
+	daemonStatus
+	// PendingOTP are the identities waiting for an OTP, "" is the top-level login
+	PendingOTP []string `json:"pendingOtp"`
+}
+
+// syncRequest is the optional body of POST /sync. Empty fields use the
+// configured values.
+type syncRequest struct {
+	// Account is the account number or IBAN of the only Ininal account to sync
+	Account string `json:"account"`
+	Since   string `json:"since"`
+	Until   string `json:"until"`
+}
+
+// otpRequest is the body of POST /otp
+type otpRequest struct {
+	// Identity can be left out when only one login waits for an OTP
+	Identity *string `json:"identity"`
+	OTP      string  `json:"otp"`
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// decodeBody decodes the JSON body of r into v, an empty body is allowed
+func decodeBody(r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid request body: %v", err)
+	}
+	return nil
+}
+
+// authorized requires the API token as bearer token
+func (d *daemon) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(d.config.API.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("missing or invalid bearer token"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (d *daemon) handleSync(w http.ResponseWriter, r *http.Request) {
+	var req syncRequest
+	if err := decodeBody(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	config := d.runConfig()
+	config.onlyAccount = req.Account
+	for _, date := range []struct {
+		value string
+		field *time.Time
+	}{{req.Since, &config.Since}, {req.Until, &config.Until}} {
+		if date.value == "" {
+			continue
+		}
+		t, err := time.Parse(DATE_FORMAT, date.value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid date %q, expected %s", date.value, DATE_FORMAT))
+			return
+		}
+		*date.field = t
+	}
+	if config.Since.After(config.Until) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("since must not be after until"))
+		return
+	}
+
+	if !d.trigger("requested", config) {
+		writeError(w, http.StatusConflict, fmt.Errorf("a sync is already running"))
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]bool{"started": true})
+}
+
+func (d *daemon) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, apiStatus{daemonStatus: d.currentStatus(), PendingOTP: apiOTPs.waiting()})
+}
+
+func (d *daemon) handleOTP(w http.ResponseWriter, r *http.Request) {
+	var req otpRequest
+	if err := decodeBody(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	otp := strings.TrimSpace(req.OTP)
+	if otp == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("otp is required"))
+		return
+	}
+
+	var identity string
+	if req.Identity != nil {
+		identity = *req.Identity
+	} else {
+		waiting := apiOTPs.waiting()
+		if len(waiting) > 1 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("several logins wait for an OTP, set identity to one of %s", strings.Join(waiting, ", ")))
+			return
+		}
+		if len(waiting) == 1 {
+			identity = waiting[0]
+		}
+	}
+
+	if !apiOTPs.submit(identity, otp) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no login is waiting for an OTP"))
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]bool{"accepted": true})
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.Default.Write(w)
+}
+
+func (d *daemon) handler() http.Handler {
+	mux := http.NewServeMux()
+	// healthz is left open for container health checks
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	mux.HandleFunc("GET /status", d.authorized(d.handleStatus))
+	mux.HandleFunc("GET /metrics", d.authorized(handleMetrics))
+	mux.HandleFunc("POST /sync", d.authorized(d.handleSync))
+	mux.HandleFunc("POST /otp", d.authorized(d.handleOTP))
+	return mux
+}
+
+// serveAPI starts the control API and stops it when ctx is done
+func (d *daemon) serveAPI(ctx context.Context) error {
+	listener, err := net.Listen("tcp", d.config.API.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to start the API: %v", err)
+	}
+
+	apiOTPs = newOTPBroker()
+	server := &http.Server{
+		Handler:           d.handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Printf("Error serving the API: %v\n", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	fmt.Println("API listening on", listener.Addr())
+	return nil
+}
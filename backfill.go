@@ -0,0 +1,171 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/dvcrn/pocketsmith-go"
+	"github.com/dvcrn/pocketsmith-ininal/psapi"
+	"github.com/dvcrn/pocketsmith-ininal/rules"
+	"github.com/dvcrn/pocketsmith-ininal/state"
+)
+
+// chunk is an inclusive date range imported in one request
+type chunk struct {
+	start time.Time
+	end   time.Time
+}
+
+// splitChunks splits the inclusive range [from, to] into ranges of at most days days
+func splitChunks(from, to time.Time, days int) []chunk {
+	var chunks []chunk
+	for start := from; !start.After(to); start = start.AddDate(0, 0, days) {
+		end := start.AddDate(0, 0, days-1)
+		if end.After(to) {
+			end = to
+		}
+		chunks = append(chunks, chunk{start: start, end: end})
+	}
+	return chunks
+}
+
+func runBackfill(args []string) {
+	fs := flag.NewFlagSet("backfill", flag.ExitOnError)
+	config := registerConfigFlags(fs)
+	registerPocketsmithFlags(fs, config, true)
+	registerWindowFlags(fs, config)
+	chunkDays := fs.Int("chunk-days", 30, "Number of days to request from Ininal at once")
+	onlyAccount := fs.String("account", "", "Only backfill the Ininal account with this account number")
+	restart := fs.Bool("restart", false, "Ignore previously saved progress and start from the beginning of the range")
+	config.parse(fs, args)
+	config = config.singleIdentity()
+
+	if *chunkDays < 1 {
+		fail(EXIT_USAGE, fmt.Errorf("-chunk-days must be at least 1"))
+	}
+	// -since and -until select the range, -limit applies to every chunk
+	from, to, resultLimit := config.Since, config.Until, config.ResultLimit
+
+	st, err := state.Load(config.StateFile)
+	if err != nil {
+		fail(EXIT_ERROR, err)
+	}
+
+	mappings, err := config.accountMappings()
+	if err != nil {
+		fail(EXIT_ERROR, err)
+	}
+	txRules, err := rules.Load(config.RulesFile)
+	if err != nil {
+		fail(EXIT_ERROR, err)
+	}
+	templates, err := config.Templates.parse()
+	if err != nil {
+		fail(EXIT_ERROR, err)
+	}
+
+	ps := pocketsmith.NewClient(config.PocketsmithToken)
+	api := psapi.NewClient(config.PocketsmithToken)
+	// a backfill always reconciles every chunk completely
+	im := &importer{
+		api:             api,
+		state:           st,
+		updatePolicy:    config.UpdatePolicy,
+		reversalAction:  config.ReversalAction,
+		reversalTypes:   config.ReversalTypes,
+		fxTypes:         config.FXTypes,
+		foreignCurrency: config.ForeignCurrency,
+		labels:          config.Labels,
+		templates:       templates,
+		rules:           txRules,
+	}
+
+	start := time.Now()
+	res, err := ps.GetCurrentUser()
+	recordPocketsmith("GET /me", start, err)
+	if err != nil {
+		fail(EXIT_ERROR, err)
+	}
+
+	fmt.Println("Pocketsmith user ID:", res.ID)
+
+	if err := resolveCategories(api, res.ID, txRules); err != nil {
+		fail(EXIT_ERROR, err)
+	}
+
+	sess, err := login(config)
+	if err != nil {
+		fail(EXIT_ERROR, err)
+	}
+
+	chunks := splitChunks(from, to, *chunkDays)
+
+	for _, account := range sess.cardAccount.AccountListResponse {
+		if *onlyAccount != "" && account.AccountNumber != *onlyAccount {
+			continue
+		}
+
+		psAcc, err := resolveAccount(ps, api, res.ID, mappings, account, st.Accounts[account.AccountNumber])
+		if err != nil {
+			fmt.Printf("Error creating/finding Pocketsmith account: %v\n", err)
+			continue
+		}
+		if psAcc == nil {
+			fmt.Println("Ignoring account", account.AccountNumber)
+			continue
+		}
+
+		progress := st.Backfills[account.AccountNumber]
+		if *restart || progress == nil || !progress.From.Equal(from) || !progress.To.Equal(to) || progress.ChunkDays != *chunkDays {
+			progress = &state.Backfill{From: from, To: to, ChunkDays: *chunkDays}
+			st.Backfills[account.AccountNumber] = progress
+		} else if !progress.Completed.IsZero() {
+			fmt.Printf("Resuming backfill of account %s after %s\n", account.AccountNumber, progress.Completed.Format(DATE_FORMAT))
+		}
+
+		totalCreated, totalUpdated, totalSkipped := 0, 0, 0
+		for i, c := range chunks {
+			if !progress.Completed.IsZero() && !c.end.After(progress.Completed) {
+				continue
+			}
+
+			fmt.Printf("[chunk %d/%d] Account %s: %s to %s\n", i+1, len(chunks), account.AccountNumber, c.start.Format(DATE_FORMAT), c.end.Format(DATE_FORMAT))
+
+			transactions, err := sess.transactions(account.AccountNumber, c.start, c.end, resultLimit)
+			if err != nil {
+				fmt.Printf("Error fetching transactions, stopping backfill for this account: %v\n", err)
+				break
+			}
+
+			complete := len(transactions) < resultLimit
+			if !complete {
+				fmt.Printf("Warning: chunk returned %d transactions which is the configured limit, use a smaller -chunk-days to avoid missing transactions\n", len(transactions))
+			}
+
+			result := im.syncTransactions(psAcc.TransactionAccountID, account, c.start, c.end, transactions, complete)
+			totalCreated += result.Created
+			totalUpdated += result.Updated
+			totalSkipped += result.Skipped
+
+			fmt.Printf("[chunk %d/%d] Account %s: %d fetched, %d created, %d updated, %d skipped, %d failed\n", i+1, len(chunks), account.AccountNumber, result.Fetched, result.Created, result.Updated, result.Skipped, result.Failed)
+			for _, tx := range result.Uncategorized {
+				fmt.Printf("[chunk %d/%d] Uncategorized: %s %s %.2f (%s)\n", i+1, len(chunks), tx.Date, tx.Payee, tx.Amount, tx.ReferenceNo)
+			}
+
+			if result.Failed > 0 {
+				// leave the chunk unfinished so the next run retries it
+				fmt.Println("Some transactions could not be imported, stopping backfill for this account")
+				break
+			}
+
+			progress.Completed = c.end
+			progress.UpdatedAt = time.Now()
+			if err := st.Save(); err != nil {
+				fmt.Printf("Error saving backfill progress: %v\n", err)
+			}
+		}
+
+		fmt.Printf("Backfill of account %s: %d created, %d updated, %d skipped\n", account.AccountNumber, totalCreated, totalUpdated, totalSkipped)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func day(s string) time.Time {
+	t, err := time.Parse(DATE_FORMAT, s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestSplitChunks(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to string
+		days     int
+		expected [][2]string
+	}{
+		{"single day", "2024-01-01", "2024-01-01", 30, [][2]string{{"2024-01-01", "2024-01-01"}}},
+		{"shorter than a chunk", "2024-01-01", "2024-01-10", 30, [][2]string{{"2024-01-01", "2024-01-10"}}},
+		{"exact chunk", "2024-01-01", "2024-01-30", 30, [][2]string{{"2024-01-01", "2024-01-30"}}},
+		{"one day over", "2024-01-01", "2024-01-31", 30, [][2]string{{"2024-01-01", "2024-01-30"}, {"2024-01-31", "2024-01-31"}}},
+		{"days of one", "2024-02-28", "2024-03-01", 1, [][2]string{{"2024-02-28", "2024-02-28"}, {"2024-02-29", "2024-02-29"}, {"2024-03-01", "2024-03-01"}}},
+		{"across a year", "2023-12-20", "2024-01-15", 14, [][2]string{{"2023-12-20", "2024-01-02"}, {"2024-01-03", "2024-01-15"}}},
+		{"empty range", "2024-01-02", "2024-01-01", 30, nil},
+	}
+
+	for _, test := range tests {
+		chunks := splitChunks(day(test.from), day(test.to), test.days)
+		if len(chunks) != len(test.expected) {
+			t.Errorf("%s: expected %d chunks, got %d", test.name, len(test.expected), len(chunks))
+			continue
+		}
+		for i, c := range chunks {
+			start, end := c.start.Format(DATE_FORMAT), c.end.Format(DATE_FORMAT)
+			if start != test.expected[i][0] || end != test.expected[i][1] {
+				t.Errorf("%s: expected chunk %d to be %s to %s, got %s to %s", test.name, i+1, test.expected[i][0], test.expected[i][1], start, end)
+			}
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/dvcrn/pocketsmith-ininal/ininal"
+	"github.com/dvcrn/pocketsmith-ininal/psapi"
+)
+
+// balanceCheck is the result of comparing a Pocketsmith account against Ininal
+type balanceCheck struct {
+	AccountNumber string `json:"accountNumber"`
+
+	IninalBalance      float64 `json:"ininalBalance"`
+	AvailableBalance   float64 `json:"availableBalance"`
+	PocketsmithBalance float64 `json:"pocketsmithBalance"`
+	// Difference is IninalBalance - PocketsmithBalance
+	Difference float64 `json:"difference"`
+
+	// Missing are Ininal transactions of the sync window that are not in Pocketsmith
+	Missing []ininal.Transaction `json:"missing,omitempty"`
+	// Duplicates are Pocketsmith transactions sharing an Ininal reference number
+	Duplicates []psapi.Transaction `json:"duplicates,omitempty"`
+	// GapMatches are Pocketsmith transactions whose amount matches the difference
+	GapMatches []psapi.Transaction `json:"gapMatches,omitempty"`
+}
+
+func (b *balanceCheck) exceeds(threshold float64) bool {
+	return math.Abs(b.Difference) > threshold
+}
+
+// checkBalance sums all transactions of the Pocketsmith transaction account,
+// starting from openingBalance, and compares the result with the Ininal
+// balance. fetched are the Ininal transactions of the current sync window.
+func (im *importer) checkBalance(transactionAccountID int, account ininal.AccountInfo, fetched []ininal.Transaction, openingBalance float64) (*balanceCheck, error) {
+	// the Pocketsmith balance of a manual account is whatever the importer set
+	// it to, so the running balance is computed from the transactions
+	transactions, err := im.api.ListTransactions(transactionAccountID, time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), time.Now().AddDate(0, 0, 1))
+	if err != nil {
+		return nil, err
+	}
+
+	check := &balanceCheck{
+		AccountNumber:      account.AccountNumber,
+		IninalBalance:      account.AccountBalance,
+		AvailableBalance:   account.AvailableBalance,
+		PocketsmithBalance: openingBalance,
+	}
+
+	// the memo and cheque number templates may not hold the reference number,
+	// the state knows it for the transactions created by the importer
+	refs := map[int]string{}
+	for ref, record := range im.state.Imports {
+		if record.TransactionAccountID == transactionAccountID {
+			refs[record.TransactionID] = ref
+		}
+	}
+
+	byRef := map[string][]psapi.Transaction{}
+	for _, tx := range transactions {
+		check.PocketsmithBalance += tx.Amount
+
+		ref := refs[tx.ID]
+		if ref == "" {
+			ref = strings.TrimSpace(tx.ChequeNumber)
+		}
+		if ref == "" {
+			ref = strings.TrimSpace(tx.Memo)
+		}
+		if ref != "" {
+			byRef[ref] = append(byRef[ref], tx)
+		}
+	}
+	check.PocketsmithBalance = math.Round(check.PocketsmithBalance*100) / 100
+	check.Difference = math.Round((check.IninalBalance-check.PocketsmithBalance)*100) / 100
+
+	for _, txs := range byRef {
+		if len(txs) > 1 {
+			check.Duplicates = append(check.Duplicates, txs...)
+		}
+	}
+
+	known := newKnownImports(transactions, im.state.Imports)
+	for _, transaction := range fetched {
+		if _, ok := known.find(transaction.ReferenceNo); ok {
+			continue
+		}
+		if handled := im.state.Reversals[transaction.ReferenceNo]; handled != nil && handled.Action == REVERSAL_DELETE {
+			continue
+		}
+		check.Missing = append(check.Missing, transaction)
+	}
+
+	if check.Difference != 0 {
+		for _, tx := range transactions {
+			if amountsEqual(math.Abs(tx.Amount), math.Abs(check.Difference)) {
+				check.GapMatches = append(check.GapMatches, tx)
+			}
+		}
+	}
+
+	return check, nil
+}
+
+func (b *balanceCheck) print(threshold float64) {
+	fmt.Printf("Balance check for account %s: Ininal %.2f (available %.2f), Pocketsmith %.2f, difference %.2f\n", b.AccountNumber, b.IninalBalance, b.AvailableBalance, b.PocketsmithBalance, b.Difference)
+
+	if pending := b.IninalBalance - b.AvailableBalance; !amountsEqual(pending, 0) {
+		fmt.Printf("  %.2f of the balance is not available yet (pending authorizations or blocked amounts)\n", pending)
+	}
+
+	if !b.exceeds(threshold) {
+		fmt.Println("  Balance matches")
+		return
+	}
+
+	for _, transaction := range b.Missing {
+		fmt.Printf("  Missing in Pocketsmith: %s %s %.2f (%s)\n", transaction.TransactionDate.Format(DATE_FORMAT), strings.TrimSpace(transaction.Description), transaction.Amount, transaction.ReferenceNo)
+	}
+	for _, tx := range b.Duplicates {
+		fmt.Printf("  Possible duplicate: %s %s %.2f (Pocketsmith transaction %d, ref %s)\n", tx.Date, tx.Payee, tx.Amount, tx.ID, tx.Memo)
+	}
+	for _, tx := range b.GapMatches {
+		fmt.Printf("  Amount matches the difference: %s %s %.2f (Pocketsmith transaction %d)\n", tx.Date, tx.Payee, tx.Amount, tx.ID)
+	}
+	if len(b.Missing) == 0 && len(b.Duplicates) == 0 && len(b.GapMatches) == 0 {
+		fmt.Println("  No candidate transactions found, the difference may come from transactions outside of the sync window or a wrong opening balance")
+	}
+}
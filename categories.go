@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dvcrn/pocketsmith-ininal/psapi"
+	"github.com/dvcrn/pocketsmith-ininal/rules"
+)
+
+// categoryIndex finds Pocketsmith categories by title or by "Parent/Child" path,
+// ignoring case
+type categoryIndex struct {
+	byTitle map[string][]string
+	byPath  map[string]int
+}
+
+func newCategoryIndex(categories []psapi.Category) *categoryIndex {
+	index := &categoryIndex{byTitle: map[string][]string{}, byPath: map[string]int{}}
+
+	var add func(categories []psapi.Category, parent string)
+	add = func(categories []psapi.Category, parent string) {
+		for _, category := range categories {
+			path := category.Title
+			if parent != "" {
+				path = parent + "/" + category.Title
+			}
+			key := strings.ToLower(category.Title)
+			index.byTitle[key] = append(index.byTitle[key], path)
+			index.byPath[strings.ToLower(path)] = category.ID
+			add(category.Children, path)
+		}
+	}
+	add(categories, "")
+
+	return index
+}
+
+func (index *categoryIndex) find(name string) (int, error) {
+	key := strings.ToLower(strings.TrimSpace(name))
+	if id, ok := index.byPath[key]; ok {
+		return id, nil
+	}
+
+	paths := index.byTitle[key]
+	switch len(paths) {
+	case 0:
+		return 0, fmt.Errorf("no Pocketsmith category %q", name)
+	case 1:
+		return index.byPath[strings.ToLower(paths[0])], nil
+	}
+	sort.Strings(paths)
+	return 0, fmt.Errorf("Pocketsmith category %q is ambiguous, use one of %s", name, strings.Join(paths, ", "))
+}
+
+// resolveCategories looks up the Pocketsmith categories the category rules,
+// fee rules and icon mappings name by title and sets their CategoryID. The categories are
+// only listed once, and only when a rule needs it.
+func resolveCategories(api *psapi.Client, userID int, txRules *rules.Rules) error {
+	var index *categoryIndex
+	var errs []string
+
+	resolve := func(name string, category string, categoryID *int) error {
+		if *categoryID != 0 || category == "" {
+			return nil
+		}
+
+		if index == nil {
+			categories, err := api.ListCategories(userID)
+			if err != nil {
+				return fmt.Errorf("failed to list Pocketsmith categories: %v", err)
+			}
+			index = newCategoryIndex(categories)
+		}
+
+		id, err := index.find(category)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+			return nil
+		}
+		*categoryID = id
+		return nil
+	}
+
+	for i, rule := range txRules.Categories {
+		if err := resolve(fmt.Sprintf("category rule %d", i+1), rule.Category, &rule.CategoryID); err != nil {
+			return err
+		}
+	}
+
+	for i, rule := range txRules.Fees {
+		if err := resolve(fmt.Sprintf("fee rule %d", i+1), rule.Category, &rule.CategoryID); err != nil {
+			return err
+		}
+	}
+
+	icons := make([]string, 0, len(txRules.Icons))
+	for icon := range txRules.Icons {
+		icons = append(icons, icon)
+	}
+	sort.Strings(icons)
+	for _, icon := range icons {
+		mapping := txRules.Icons[icon]
+		if err := resolve("icon "+icon, mapping.Category, &mapping.CategoryID); err != nil {
+			return err
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid category rules: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// categoryID returns the ID of the category of tx, 0 when it has none
+func categoryID(tx psapi.Transaction) int {
+	if tx.Category == nil {
+		return 0
+	}
+	return tx.Category.ID
+}
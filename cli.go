@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/dvcrn/pocketsmith-ininal/ininal"
+)
+
+// VERSION is set at build time with -ldflags "-X main.VERSION=..."
+var VERSION = "dev"
+
+// Exit codes shared by all commands
+const (
+	EXIT_OK = 0
+	// EXIT_ERROR is used when a command failed
+	EXIT_ERROR = 1
+	// EXIT_USAGE is used for unknown commands, invalid flags and invalid configuration
+	EXIT_USAGE = 2
+	// EXIT_BALANCE_MISMATCH is used when -fail-on-balance-mismatch is set and
+	// an account is out of balance
+	EXIT_BALANCE_MISMATCH = 3
+	// EXIT_PARTIAL is used when some accounts could not be synced
+	EXIT_PARTIAL = 4
+)
+
+// Output formats of the -o flag
+const (
+	OUTPUT_TABLE = "table"
+	OUTPUT_JSON  = "json"
+	OUTPUT_CSV   = "csv"
+)
+
+const USAGE = `Usage: ininal-importer <command> [flags]
+
+Commands:
+  sync          Sync all Ininal accounts into Pocketsmith (default)
+  backfill      Import a long date range in chunks, resuming where it stopped
+  link          Map Ininal accounts to Pocketsmith accounts interactively
+  login         Log into Ininal and cache the session
+  accounts      List the Ininal accounts and cards
+  transactions  List Ininal transactions
+  balance       Show the Ininal balances, optionally compared with Pocketsmith
+  profile       Show the Ininal user profile
+  export        Export Ininal transactions as CSV or JSON
+  rules         Show how the rules rewrite recent transactions: rules test
+  icons         List the Ininal icons seen and their category mapping
+  fx            Report the currency exchanges and the realized FX gain/loss
+  recurring     List recurring payments, optionally as Pocketsmith budget events
+  fees          Summarize the fees charged by Ininal per month
+  daemon        Keep running and sync on a schedule (alias: serve)
+  doctor        Check the configuration and connectivity
+  vault         Manage the encrypted credential vault: init, show, rekey or wipe
+  version       Print the version
+
+Run "ininal-importer <command> -h" for the flags of a command.
+`
+
+// fail prints err and exits with code
+func fail(code int, err error) {
+	fmt.Fprintln(os.Stderr, "Error:", err)
+	os.Exit(code)
+}
+
+// registerOutputFlag defines the -o flag on fs
+func registerOutputFlag(fs *flag.FlagSet, def string) *string {
+	return fs.String("o", def, "Output format: table, json or csv")
+}
+
+func checkOutput(format string) {
+	switch format {
+	case OUTPUT_TABLE, OUTPUT_JSON, OUTPUT_CSV:
+	default:
+		fail(EXIT_USAGE, fmt.Errorf("unknown output format %q, expected table, json or csv", format))
+	}
+}
+
+// table is the output of a command. The rows are rendered for the table and
+// csv formats, data for the json format.
+type table struct {
+	header []string
+	rows   [][]string
+	data   interface{}
+}
+
+func (t *table) add(row ...string) {
+	t.rows = append(t.rows, row)
+}
+
+func (t *table) write(w io.Writer, format string) error {
+	switch format {
+	case OUTPUT_JSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(t.data)
+	case OUTPUT_CSV:
+		cw := csv.NewWriter(w)
+		cw.Write(t.header)
+		cw.WriteAll(t.rows)
+		return cw.Error()
+	default:
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.Join(t.header, "\t"))
+		for _, row := range t.rows {
+			fmt.Fprintln(tw, strings.Join(row, "\t"))
+		}
+		return tw.Flush()
+	}
+}
+
+func formatAmount(amount float64) string {
+	return fmt.Sprintf("%.2f", amount)
+}
+
+func runVersion(args []string) {
+	fs := flag.NewFlagSet("version", flag.ExitOnError)
+	fs.Parse(args)
+
+	fmt.Printf("ininal-importer %s (%s, %s/%s)\n", VERSION, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
+
+func runLogin(args []string) {
+	fs := flag.NewFlagSet("login", flag.ExitOnError)
+	config := registerConfigFlags(fs)
+	logout := fs.Bool("logout", false, "Remove the cached session instead of logging in")
+	config.parse(fs, args)
+	config = config.singleIdentity()
+
+	if *logout {
+		if err := removeSession(config); err != nil {
+			fail(EXIT_ERROR, err)
+		}
+		fmt.Println("Removed the cached Ininal session")
+		return
+	}
+
+	if config.SessionFile == "" && config.vault == nil {
+		fmt.Fprintln(os.Stderr, "Warning: -session-file is empty, the session is not cached")
+	}
+
+	sess, err := newSession(config, ininal.NewClient())
+	if err != nil {
+		fail(EXIT_ERROR, fmt.Errorf("failed to log into Ininal: %v", err))
+	}
+
+	fmt.Printf("Logged into Ininal, %d accounts found\n", len(sess.cardAccount.AccountListResponse))
+	if config.vault != nil {
+		fmt.Println("Cached the session in the vault", config.VaultFile)
+	} else if config.SessionFile != "" {
+		fmt.Println("Cached the session in", config.SessionFile)
+	}
+}
@@ -0,0 +1,856 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dvcrn/pocketsmith-ininal/ininal"
+	"gopkg.in/yaml.v3"
+)
+
+const DATE_FORMAT = "2006-01-02"
+
+const DEFAULT_CONFIG_FILE = "ininal.yaml"
+
+// IninalConfig holds the Ininal credentials
+type IninalConfig struct {
+	DeviceID         string `yaml:"device_id"`
+	LoginToken       string `yaml:"login_token"`
+	UserToken        string `yaml:"user_token"`
+	LoginBearerToken string `yaml:"login_bearer_token"`
+
+	Password        string `yaml:"password"`
+	LoginCredential string `yaml:"login_credential"`
+	DeviceSignature string `yaml:"device_signature"`
+}
+
+// OTPConfig selects how the OTP is obtained when Ininal asks for one, see the
+// OTP_* constants
+type OTPConfig struct {
+	Provider string `yaml:"provider"`
+	// Command is run by the command provider, it prints the OTP
+	Command string `yaml:"command"`
+	// Path is watched by the file provider until the OTP is written to it
+	Path    string        `yaml:"path"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// ScheduleConfig controls when the daemon syncs. Exactly one of Cron and
+// Interval is set.
+type ScheduleConfig struct {
+	// Cron is a 5 field cron expression or a descriptor like @hourly
+	Cron     string        `yaml:"cron"`
+	Interval time.Duration `yaml:"interval"`
+	// Jitter is the largest random delay added to every scheduled run
+	Jitter     time.Duration `yaml:"jitter"`
+	RunOnStart bool          `yaml:"run_on_start"`
+	// KeepAlive is how often the cached Ininal sessions are used between
+	// syncs so they don't expire. 0 disables it.
+	KeepAlive time.Duration `yaml:"keep_alive"`
+	// StatusFile receives the status of the daemon and its last run
+	StatusFile string `yaml:"status_file"`
+}
+
+// APIConfig is the HTTP control API of the daemon, it is disabled when
+// Listen is empty
+type APIConfig struct {
+	Listen string `yaml:"listen"`
+	// Token must be sent as bearer token with every request
+	Token string `yaml:"token"`
+}
+
+type PocketsmithConfig struct {
+	PocketsmithToken string `yaml:"token"`
+}
+
+// SyncConfig controls which transactions are synced and how
+type SyncConfig struct {
+	Since       time.Time `yaml:"since"`
+	Until       time.Time `yaml:"until"`
+	ResultLimit int       `yaml:"limit"`
+
+	// StopAfterKnown stops the sync of an account after this many consecutive
+	// already imported transactions. 0 reconciles the whole window.
+	StopAfterKnown int `yaml:"stop_after_known"`
+	// UpdatePolicy controls how already imported transactions that changed in
+	// Ininal are updated, see the UPDATE_* constants
+	UpdatePolicy string `yaml:"update_policy"`
+	// ReversalAction is applied to reversed and disappeared transactions, see
+	// the REVERSAL_* constants
+	ReversalAction string `yaml:"reversal_action"`
+	// ReversalTypes are matched against the transaction type and description
+	// to recognize reversing transactions
+	ReversalTypes []string `yaml:"reversal_types"`
+	// FXTypes are matched against the transaction type and description to
+	// recognize currency exchanges between the Ininal accounts
+	FXTypes []string `yaml:"fx_types"`
+	// ForeignCurrency controls how transactions in another currency than their
+	// account are marked, see the FOREIGN_* constants
+	ForeignCurrency string `yaml:"foreign_currency"`
+	// Labels are added to imported transactions besides the ones of the rules
+	Labels LabelConfig `yaml:"labels"`
+
+	// LinkTransfers pairs the two legs of transfers between the synced Ininal
+	// accounts, and with TransferAccounts
+	LinkTransfers bool `yaml:"link_transfers"`
+	// TransferWindow is the number of days the legs of a transfer in the same
+	// currency may be apart
+	TransferWindow int `yaml:"transfer_window"`
+	// TransferAccounts are the IDs of other Pocketsmith transaction accounts,
+	// like the bank account topping up the card, searched for the other leg
+	TransferAccounts []int `yaml:"transfer_accounts"`
+
+	CheckBalance bool `yaml:"check_balance"`
+	// OpeningBalance is the balance of the accounts before their first transaction
+	OpeningBalance        float64 `yaml:"opening_balance"`
+	BalanceThreshold      float64 `yaml:"balance_threshold"`
+	FailOnBalanceMismatch bool    `yaml:"fail_on_balance_mismatch"`
+}
+
+type Config struct {
+	IninalConfig      `yaml:"ininal"`
+	PocketsmithConfig `yaml:"pocketsmith"`
+	SyncConfig        `yaml:"sync"`
+
+	StateFile    string `yaml:"state_file"`
+	AccountsFile string `yaml:"accounts_file"`
+	// RulesFile holds the rules rewriting the imported transactions, see the
+	// rules package
+	RulesFile string `yaml:"rules_file"`
+	// SessionFile caches the Ininal session between runs so the OTP is only
+	// needed once. Empty disables the cache.
+	SessionFile string `yaml:"session_file"`
+	// MetricsFile receives the Prometheus metrics after every sync, for the
+	// textfile collector of the node exporter
+	MetricsFile string `yaml:"metrics_file"`
+	// VaultFile is the encrypted vault holding credentials and sessions
+	VaultFile string `yaml:"vault_file"`
+	// AccountMapping replaces the account mapping file when set
+	AccountMapping *AccountMappings `yaml:"account_mapping"`
+	OTP            OTPConfig        `yaml:"otp"`
+	Schedule       ScheduleConfig   `yaml:"schedule"`
+	API            APIConfig        `yaml:"api"`
+	// Templates decide what lands in the payee, note, memo and cheque number
+	// of imported transactions
+	Templates TemplateConfig `yaml:"templates"`
+
+	// Identities are synced one after the other instead of the top-level
+	// Ininal login. Identity selects a single one of them.
+	Identities []Identity `yaml:"identities"`
+	Identity   string     `yaml:"-"`
+
+	// ConfigFile and Profile are the config file and profile the config was
+	// loaded from
+	ConfigFile string `yaml:"-"`
+	Profile    string `yaml:"-"`
+
+	// windowFlags, syncFlags and pocketsmithFlags are set when the respective
+	// flags were registered and need validation
+	windowFlags      bool
+	syncFlags        bool
+	pocketsmithFlags bool
+	scheduleFlags    bool
+
+	// onlyAccount limits a sync to the Ininal account with this account
+	// number or IBAN
+	onlyAccount string
+
+	// noVault skips opening the vault, for the vault commands
+	noVault bool
+	// noLogin skips validating the Ininal login, for the commands that only
+	// read local files
+	noLogin bool
+	// vault is the open vault, sessions are cached in it instead of the session file
+	vault *vault
+}
+
+// Identity is one of several Ininal logins synced in the same run. Empty
+// settings are taken from the top level of the config.
+type Identity struct {
+	Name              string `yaml:"name"`
+	IninalConfig      `yaml:"ininal"`
+	PocketsmithConfig `yaml:"pocketsmith"`
+	OTP               OTPConfig `yaml:"otp"`
+
+	// SessionFile defaults to ininal-session-<name>.json
+	SessionFile    string           `yaml:"session_file"`
+	AccountsFile   string           `yaml:"accounts_file"`
+	AccountMapping *AccountMappings `yaml:"account_mapping"`
+}
+
+// configFile is the layout of the YAML config file. The top-level settings
+// apply to all profiles, each profile can override any of them.
+type configFile struct {
+	Config         `yaml:",inline"`
+	DefaultProfile string               `yaml:"default_profile"`
+	Profiles       map[string]yaml.Node `yaml:"profiles"`
+}
+
+// ENV_VARS maps flag names to the environment variables that set them
+var ENV_VARS = map[string]string{
+	"device-id":                "ININAL_DEVICE_ID",
+	"login-token":              "ININAL_LOGIN_TOKEN",
+	"user-token":               "ININAL_USER_TOKEN",
+	"login-bearer-token":       "ININAL_LOGIN_BEARER_TOKEN",
+	"pocketsmith-token":        "POCKETSMITH_TOKEN",
+	"password":                 "ININAL_PASSWORD",
+	"login-credential":         "ININAL_LOGIN_CREDENTIAL",
+	"device-signature":         "ININAL_DEVICE_SIGNATURE",
+	"config":                   "ININAL_CONFIG",
+	"profile":                  "ININAL_PROFILE",
+	"state-file":               "ININAL_STATE_FILE",
+	"metrics-file":             "ININAL_METRICS_FILE",
+	"accounts-file":            "ININAL_ACCOUNTS_FILE",
+	"rules-file":               "ININAL_RULES_FILE",
+	"session-file":             "ININAL_SESSION_FILE",
+	"identity":                 "ININAL_IDENTITY",
+	"vault-file":               "ININAL_VAULT_FILE",
+	"cron":                     "ININAL_SCHEDULE_CRON",
+	"interval":                 "ININAL_SCHEDULE_INTERVAL",
+	"jitter":                   "ININAL_SCHEDULE_JITTER",
+	"run-on-start":             "ININAL_SCHEDULE_RUN_ON_START",
+	"keep-alive":               "ININAL_SCHEDULE_KEEP_ALIVE",
+	"status-file":              "ININAL_STATUS_FILE",
+	"api-listen":               "ININAL_API_LISTEN",
+	"api-token":                "ININAL_API_TOKEN",
+	"otp-provider":             "ININAL_OTP_PROVIDER",
+	"otp-command":              "ININAL_OTP_COMMAND",
+	"otp-path":                 "ININAL_OTP_PATH",
+	"update-policy":            "ININAL_UPDATE_POLICY",
+	"reversal-action":          "ININAL_REVERSAL_ACTION",
+	"reversal-types":           "ININAL_REVERSAL_TYPES",
+	"fx-types":                 "ININAL_FX_TYPES",
+	"foreign-currency":         "ININAL_FOREIGN_CURRENCY",
+	"payee-template":           "ININAL_PAYEE_TEMPLATE",
+	"note-template":            "ININAL_NOTE_TEMPLATE",
+	"memo-template":            "ININAL_MEMO_TEMPLATE",
+	"cheque-template":          "ININAL_CHEQUE_TEMPLATE",
+	"source-label":             "ININAL_SOURCE_LABEL",
+	"card-type-label":          "ININAL_CARD_TYPE_LABEL",
+	"fx-label":                 "ININAL_FX_LABEL",
+	"recurring-label":          "ININAL_RECURRING_LABEL",
+	"fee-label":                "ININAL_FEE_LABEL",
+	"updated-label":            "ININAL_UPDATED_LABEL",
+	"reversed-label":           "ININAL_REVERSED_LABEL",
+	"link-transfers":           "ININAL_LINK_TRANSFERS",
+	"transfer-window":          "ININAL_TRANSFER_WINDOW",
+	"transfer-accounts":        "ININAL_TRANSFER_ACCOUNTS",
+	"since":                    "ININAL_SINCE",
+	"until":                    "ININAL_UNTIL",
+	"limit":                    "ININAL_RESULT_LIMIT",
+	"stop-after-known":         "ININAL_STOP_AFTER_KNOWN",
+	"check-balance":            "ININAL_CHECK_BALANCE",
+	"opening-balance":          "ININAL_OPENING_BALANCE",
+	"balance-threshold":        "ININAL_BALANCE_THRESHOLD",
+	"fail-on-balance-mismatch": "ININAL_FAIL_ON_BALANCE_MISMATCH",
+}
+
+func today() time.Time {
+	return dateOf(time.Now())
+}
+
+// dateOf returns the calendar day of t in Ininal's time zone, as midnight UTC
+// like the dates parsed from flags
+func dateOf(t time.Time) time.Time {
+	t = t.In(ininal.Location)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func defaultConfig() Config {
+	return Config{
+		SyncConfig: SyncConfig{
+			Since:           today().AddDate(-2, 0, 0),
+			Until:           today(),
+			ResultLimit:     200,
+			UpdatePolicy:    UPDATE_PRESERVE_EDITS,
+			ReversalAction:  REVERSAL_NOTE,
+			ReversalTypes:   DEFAULT_REVERSAL_TYPES,
+			FXTypes:         DEFAULT_FX_TYPES,
+			ForeignCurrency: FOREIGN_NOTE,
+			Labels: LabelConfig{
+				Source:    SOURCE_LABEL,
+				FX:        FX_LABEL,
+				Recurring: RECURRING_LABEL,
+				Fee:       FEE_LABEL,
+				Updated:   UPDATED_LABEL,
+				Reversed:  REVERSED_LABEL,
+			},
+			LinkTransfers:    true,
+			TransferWindow:   3,
+			CheckBalance:     true,
+			BalanceThreshold: 0.01,
+		},
+		StateFile:    "ininal-state.json",
+		AccountsFile: "ininal-accounts.yaml",
+		RulesFile:    "ininal-rules.yaml",
+		SessionFile:  "ininal-session.json",
+		OTP: OTPConfig{
+			Provider: OTP_PROMPT,
+			Timeout:  5 * time.Minute,
+		},
+		Schedule: ScheduleConfig{
+			RunOnStart: true,
+			KeepAlive:  15 * time.Minute,
+			StatusFile: "ininal-status.json",
+		},
+		ConfigFile: DEFAULT_CONFIG_FILE,
+	}
+}
+
+// dateValue is a flag.Value for dates in DATE_FORMAT
+type dateValue struct {
+	t *time.Time
+}
+
+func (d dateValue) String() string {
+	if d.t == nil || d.t.IsZero() {
+		return ""
+	}
+	return d.t.Format(DATE_FORMAT)
+}
+
+func (d dateValue) Set(s string) error {
+	t, err := time.Parse(DATE_FORMAT, s)
+	if err != nil {
+		return fmt.Errorf("expected a date in YYYY-MM-DD format")
+	}
+	*d.t = t
+	return nil
+}
+
+// listValue is a flag.Value for comma separated lists
+type listValue struct {
+	list *[]string
+}
+
+func (l listValue) String() string {
+	if l.list == nil {
+		return ""
+	}
+	return strings.Join(*l.list, ",")
+}
+
+func (l listValue) Set(s string) error {
+	*l.list = splitList(s)
+	return nil
+}
+
+// intListValue is a flag.Value for comma separated lists of integers
+type intListValue struct {
+	list *[]int
+}
+
+func (l intListValue) String() string {
+	if l.list == nil {
+		return ""
+	}
+	items := make([]string, len(*l.list))
+	for i, item := range *l.list {
+		items[i] = strconv.Itoa(item)
+	}
+	return strings.Join(items, ",")
+}
+
+func (l intListValue) Set(s string) error {
+	var list []int
+	for _, item := range splitList(s) {
+		i, err := strconv.Atoi(item)
+		if err != nil {
+			return fmt.Errorf("expected a comma separated list of numbers")
+		}
+		list = append(list, i)
+	}
+	*l.list = list
+	return nil
+}
+
+// splitList splits a comma separated list, dropping empty entries
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// registerConfigFlags defines the flags shared by all commands on fs. The
+// returned config is populated by parse. Commands talking to Pocketsmith also
+// need registerPocketsmithFlags.
+func registerConfigFlags(fs *flag.FlagSet) *Config {
+	config := &Config{}
+	*config = defaultConfig()
+
+	// Define command-line flags
+	fs.StringVar(&config.ConfigFile, "config", config.ConfigFile, "Path of the YAML config file")
+	fs.StringVar(&config.Profile, "profile", "", "Name of the config file profile to use")
+
+	fs.StringVar(&config.DeviceID, "device-id", "", "Ininal device ID")
+	fs.StringVar(&config.LoginToken, "login-token", "", "Ininal login token")
+	fs.StringVar(&config.UserToken, "user-token", "", "Ininal user token")
+	fs.StringVar(&config.LoginBearerToken, "login-bearer-token", "", "Ininal login bearer token")
+
+	fs.StringVar(&config.Password, "password", "", "Ininal password (App PIN)")
+	fs.StringVar(&config.LoginCredential, "login-credential", "", "Ininal login credential (Phone Number)")
+	fs.StringVar(&config.DeviceSignature, "device-signature", "", "Ininal device signature")
+
+	fs.StringVar(&config.StateFile, "state-file", config.StateFile, "Path of the file used to persist sync state between runs")
+	fs.StringVar(&config.AccountsFile, "accounts-file", config.AccountsFile, "Path of the YAML file mapping Ininal accounts to Pocketsmith accounts")
+	fs.StringVar(&config.RulesFile, "rules-file", config.RulesFile, "Path of the YAML file with the rules rewriting imported transactions")
+	fs.StringVar(&config.SessionFile, "session-file", config.SessionFile, "Path of the file caching the Ininal session, empty to always log in")
+	fs.StringVar(&config.Identity, "identity", "", "Only use the identity with this name from the config file")
+	fs.StringVar(&config.VaultFile, "vault-file", "", "Path of the encrypted vault holding the credentials, the passphrase is read from ININAL_VAULT_PASSPHRASE or the terminal")
+
+	fs.StringVar(&config.OTP.Provider, "otp-provider", config.OTP.Provider, "How to obtain the OTP: prompt, command, file or api")
+	fs.StringVar(&config.OTP.Command, "otp-command", "", "Command printing the OTP, for the command OTP provider")
+	fs.StringVar(&config.OTP.Path, "otp-path", "", "File the OTP is written to, for the file OTP provider")
+
+	fs.StringVar(&config.UpdatePolicy, "update-policy", config.UpdatePolicy, "How to update imported transactions that changed in Ininal: overwrite, preserve-edits or never")
+	fs.StringVar(&config.ReversalAction, "reversal-action", config.ReversalAction, "What to do with reversed or disappeared transactions: delete, label, note or none")
+	fs.Var(listValue{&config.ReversalTypes}, "reversal-types", "Comma separated transaction types (or parts of them) that mark a reversal")
+	fs.Var(listValue{&config.FXTypes}, "fx-types", "Comma separated transaction types (or parts of them) that mark a currency exchange")
+	fs.StringVar(&config.ForeignCurrency, "foreign-currency", config.ForeignCurrency, "How to mark transactions in another currency than their account: note, label, both or none")
+	fs.StringVar(&config.Templates.Payee, "payee-template", config.Templates.Payee, "Template of the payee of imported transactions, default "+DEFAULT_PAYEE_TEMPLATE)
+	fs.StringVar(&config.Templates.Note, "note-template", config.Templates.Note, "Template of the note of imported transactions, default "+DEFAULT_NOTE_TEMPLATE)
+	fs.StringVar(&config.Templates.Memo, "memo-template", config.Templates.Memo, "Template of the memo of imported transactions, default "+DEFAULT_MEMO_TEMPLATE)
+	fs.StringVar(&config.Templates.ChequeNumber, "cheque-template", config.Templates.ChequeNumber, "Template of the cheque number of imported transactions, default "+DEFAULT_CHEQUE_TEMPLATE)
+	fs.StringVar(&config.Labels.Source, "source-label", config.Labels.Source, "Label added to every imported transaction, empty to disable")
+	fs.BoolVar(&config.Labels.CardType, "card-type-label", config.Labels.CardType, "Label imported transactions with the type of the account's card")
+	fs.StringVar(&config.Labels.FX, "fx-label", config.Labels.FX, "Label added to currency exchanges and transactions in a foreign currency, empty to disable")
+	fs.StringVar(&config.Labels.Recurring, "recurring-label", config.Labels.Recurring, "Label added to payments Ininal marks as recurring, empty to disable")
+	fs.StringVar(&config.Labels.Fee, "fee-label", config.Labels.Fee, "Label added to fees recognized by the fee rules, empty to disable")
+	fs.StringVar(&config.Labels.Updated, "updated-label", config.Labels.Updated, "Label added to transactions updated because they changed in Ininal, empty to disable")
+	fs.StringVar(&config.Labels.Reversed, "reversed-label", config.Labels.Reversed, "Label added to reversed transactions, empty to only add it with -reversal-action=label")
+
+	return config
+}
+
+// registerPocketsmithFlags defines the Pocketsmith flags on fs. The token is
+// only required when required is set.
+func registerPocketsmithFlags(fs *flag.FlagSet, config *Config, required bool) {
+	config.pocketsmithFlags = required
+
+	fs.StringVar(&config.PocketsmithToken, "pocketsmith-token", "", "Pocketsmith API token")
+}
+
+// registerWindowFlags defines the flags selecting the transactions fetched from Ininal on fs
+func registerWindowFlags(fs *flag.FlagSet, config *Config) {
+	config.windowFlags = true
+
+	fs.Var(dateValue{&config.Since}, "since", "Only fetch transactions on or after this date (YYYY-MM-DD, default two years ago)")
+	fs.Var(dateValue{&config.Until}, "until", "Only fetch transactions on or before this date (YYYY-MM-DD, default today)")
+	fs.IntVar(&config.ResultLimit, "limit", config.ResultLimit, "Maximum number of transactions to request from Ininal per account")
+}
+
+// registerSyncFlags defines the flags controlling the regular sync on fs
+func registerSyncFlags(fs *flag.FlagSet, config *Config) {
+	config.syncFlags = true
+	registerWindowFlags(fs, config)
+
+	fs.IntVar(&config.StopAfterKnown, "stop-after-known", config.StopAfterKnown, "Stop syncing an account after this many consecutive already imported transactions (newest first). 0 reconciles the whole window")
+
+	fs.BoolVar(&config.CheckBalance, "check-balance", config.CheckBalance, "Compare the sum of the Pocketsmith transactions with the Ininal balance after syncing")
+	fs.Float64Var(&config.OpeningBalance, "opening-balance", config.OpeningBalance, "Account balance before the first imported transaction, used by the balance check")
+	fs.Float64Var(&config.BalanceThreshold, "balance-threshold", config.BalanceThreshold, "Largest difference between the Pocketsmith and Ininal balance that is still accepted")
+	fs.BoolVar(&config.FailOnBalanceMismatch, "fail-on-balance-mismatch", config.FailOnBalanceMismatch, "Exit with code 3 when the balance difference of an account exceeds -balance-threshold")
+
+	fs.BoolVar(&config.LinkTransfers, "link-transfers", config.LinkTransfers, "Pair the two legs of transfers between the Ininal accounts and with -transfer-accounts")
+	fs.IntVar(&config.TransferWindow, "transfer-window", config.TransferWindow, "Number of days the two legs of a transfer may be apart")
+	fs.Var(intListValue{&config.TransferAccounts}, "transfer-accounts", "Comma separated IDs of other Pocketsmith transaction accounts searched for the other leg of transfers")
+
+	fs.StringVar(&config.MetricsFile, "metrics-file", "", "Write Prometheus metrics to this file after every sync, for the node exporter textfile collector (use a .prom extension)")
+}
+
+// registerScheduleFlags defines the flags of the daemon schedule on fs
+func registerScheduleFlags(fs *flag.FlagSet, config *Config) {
+	config.scheduleFlags = true
+
+	fs.StringVar(&config.Schedule.Cron, "cron", "", "Cron expression of the sync schedule, like \"0 */6 * * *\" or @hourly")
+	fs.DurationVar(&config.Schedule.Interval, "interval", 0, "Sync at this fixed interval instead of a cron expression, like 6h")
+	fs.DurationVar(&config.Schedule.Jitter, "jitter", 0, "Largest random delay added to every scheduled sync")
+	fs.BoolVar(&config.Schedule.RunOnStart, "run-on-start", config.Schedule.RunOnStart, "Sync once right after starting")
+	fs.DurationVar(&config.Schedule.KeepAlive, "keep-alive", config.Schedule.KeepAlive, "How often to refresh the cached Ininal sessions between syncs, 0 to disable")
+	fs.StringVar(&config.Schedule.StatusFile, "status-file", config.Schedule.StatusFile, "Path of the JSON file receiving the daemon status and last run, empty to disable")
+
+	fs.StringVar(&config.API.Listen, "api-listen", "", "Address the HTTP control API listens on, like 127.0.0.1:8080. Empty disables the API")
+	fs.StringVar(&config.API.Token, "api-token", "", "Bearer token required by the HTTP control API")
+}
+
+// parse parses args and builds the config from, in increasing order of
+// precedence, the defaults, the config file, the selected profile, the
+// environment and the flags. All problems are printed at once before exiting.
+func (config *Config) parse(fs *flag.FlagSet, args []string) {
+	fs.Parse(args)
+
+	if err := config.load(fs); err != nil {
+		failConfig(err)
+	}
+}
+
+// failConfig prints the configuration errors of err and exits
+func failConfig(err error) {
+	fmt.Fprintln(os.Stderr, "Error: invalid configuration:")
+	for _, line := range strings.Split(err.Error(), "\n") {
+		fmt.Fprintln(os.Stderr, "  -", line)
+	}
+	os.Exit(EXIT_USAGE)
+}
+
+func (config *Config) load(fs *flag.FlagSet) error {
+	// remember the flags given on the command line, they are applied last
+	flags := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		flags[f.Name] = f.Value.String()
+	})
+
+	lookup := func(name string) string {
+		if v, ok := flags[name]; ok {
+			return v
+		}
+		return os.Getenv(ENV_VARS[name])
+	}
+
+	registered := *config
+	*config = defaultConfig()
+	config.windowFlags, config.syncFlags, config.pocketsmithFlags, config.scheduleFlags = registered.windowFlags, registered.syncFlags, registered.pocketsmithFlags, registered.scheduleFlags
+	config.noVault = registered.noVault
+	config.noLogin = registered.noLogin
+
+	var errs []error
+
+	if path := lookup("config"); path != "" {
+		config.ConfigFile = path
+	}
+	if err := config.loadFile(config.ConfigFile, lookup("profile")); err != nil {
+		errs = append(errs, err)
+	}
+
+	// the vault overrides the credentials of the config file
+	if path := lookup("vault-file"); path != "" {
+		config.VaultFile = path
+	}
+	if config.VaultFile != "" && !config.noVault {
+		if err := config.loadVault(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// environment variables override the config file
+	for _, name := range sortedKeys(ENV_VARS) {
+		env := ENV_VARS[name]
+		v := os.Getenv(env)
+		if path := os.Getenv(env + "_FILE"); path != "" && SECRET_FLAGS[name] {
+			// Docker and Kubernetes secrets are mounted as files
+			if v != "" {
+				errs = append(errs, fmt.Errorf("only one of %s and %s_FILE may be set", env, env))
+				continue
+			}
+			secret, err := readSecretFile(path)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s_FILE: %v", env, err))
+				continue
+			}
+			v = secret
+		}
+		if v == "" || fs.Lookup(name) == nil || name == "config" || name == "profile" {
+			continue
+		}
+		if err := fs.Set(name, v); err != nil {
+			errs = append(errs, fmt.Errorf("invalid value %q for %s: %v", v, env, err))
+		}
+	}
+
+	// and flags override everything
+	for _, name := range sortedKeys(flags) {
+		v := flags[name]
+		if name == "config" || name == "profile" {
+			continue
+		}
+		if err := fs.Set(name, v); err != nil {
+			errs = append(errs, fmt.Errorf("invalid value %q for -%s: %v", v, name, err))
+		}
+	}
+
+	errs = append(errs, config.resolveSecrets()...)
+	errs = append(errs, config.validate()...)
+
+	return errors.Join(errs...)
+}
+
+// loadFile applies the config file at path and the given profile. A missing
+// file is only an error when it was asked for explicitly.
+func (config *Config) loadFile(path string, profile string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && path == DEFAULT_CONFIG_FILE && profile == "" {
+			return nil
+		}
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	file := configFile{Config: *config}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to decode config file %s: %v", path, err)
+	}
+
+	if profile == "" {
+		profile = file.DefaultProfile
+	}
+	if profile == "" && len(file.Profiles) == 1 {
+		for name := range file.Profiles {
+			profile = name
+		}
+	}
+
+	if profile == "" {
+		if len(file.Profiles) > 0 {
+			return fmt.Errorf("config file %s has multiple profiles (%s), select one with -profile or default_profile", path, strings.Join(profileNames(file.Profiles), ", "))
+		}
+	} else {
+		node, ok := file.Profiles[profile]
+		if !ok {
+			return fmt.Errorf("profile %q not found in config file %s", profile, path)
+		}
+		if err := node.Decode(&file.Config); err != nil {
+			return fmt.Errorf("failed to decode profile %q: %v", profile, err)
+		}
+	}
+
+	*config = file.Config
+	config.ConfigFile = path
+	config.Profile = profile
+
+	return nil
+}
+
+func profileNames(profiles map[string]yaml.Node) []string {
+	var names []string
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// validate returns all problems with the config
+func (config *Config) validate() []error {
+	var errs []error
+
+	if len(config.Identities) == 0 {
+		if !config.noLogin {
+			errs = append(errs, config.validateLogin("")...)
+		}
+	} else {
+		names := map[string]bool{}
+		for i, identity := range config.Identities {
+			if identity.Name == "" {
+				errs = append(errs, fmt.Errorf("identity %d needs a name", i+1))
+				continue
+			}
+			if names[identity.Name] {
+				errs = append(errs, fmt.Errorf("identity name %s is used more than once", identity.Name))
+			}
+			names[identity.Name] = true
+
+			if !config.noLogin {
+				errs = append(errs, config.forIdentity(identity).validateLogin(identity.Name)...)
+			}
+			if identity.AccountMapping != nil {
+				if err := identity.AccountMapping.validate(); err != nil {
+					errs = append(errs, fmt.Errorf("identity %s: %v", identity.Name, err))
+				}
+			}
+		}
+		if config.Identity != "" && !names[config.Identity] {
+			errs = append(errs, fmt.Errorf("identity %s not found in the config file", config.Identity))
+		}
+	}
+
+	switch config.UpdatePolicy {
+	case UPDATE_OVERWRITE, UPDATE_PRESERVE_EDITS, UPDATE_NEVER:
+	default:
+		errs = append(errs, fmt.Errorf("update policy must be one of overwrite, preserve-edits or never, got %q", config.UpdatePolicy))
+	}
+	switch config.ReversalAction {
+	case REVERSAL_DELETE, REVERSAL_LABEL, REVERSAL_NOTE, REVERSAL_NONE:
+	default:
+		errs = append(errs, fmt.Errorf("reversal action must be one of delete, label, note or none, got %q", config.ReversalAction))
+	}
+	switch config.ForeignCurrency {
+	case FOREIGN_NOTE, FOREIGN_LABEL, FOREIGN_BOTH, FOREIGN_NONE:
+	default:
+		errs = append(errs, fmt.Errorf("foreign currency must be one of note, label, both or none, got %q", config.ForeignCurrency))
+	}
+	if _, err := config.Templates.parse(); err != nil {
+		errs = append(errs, err)
+	}
+	for _, label := range []string{config.Labels.Source, config.Labels.FX, config.Labels.Recurring, config.Labels.Fee, config.Labels.Updated, config.Labels.Reversed} {
+		if strings.Contains(label, ",") {
+			errs = append(errs, fmt.Errorf("invalid label %q, labels must not contain commas", label))
+		}
+	}
+
+	if config.AccountMapping != nil {
+		if err := config.AccountMapping.validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if config.windowFlags {
+		if config.ResultLimit < 1 {
+			errs = append(errs, fmt.Errorf("limit must be at least 1"))
+		}
+		if config.Since.After(config.Until) {
+			errs = append(errs, fmt.Errorf("since must not be after until"))
+		}
+	}
+	if config.scheduleFlags {
+		if err := config.Schedule.validate(); err != nil {
+			errs = append(errs, err)
+		}
+		if config.API.Listen != "" && config.API.Token == "" {
+			errs = append(errs, fmt.Errorf("API token is required when the API is enabled. Set via -api-token flag, ININAL_API_TOKEN environment variable or api.token in the config file"))
+		}
+	}
+	if config.syncFlags {
+		if config.StopAfterKnown < 0 {
+			errs = append(errs, fmt.Errorf("stop after known must not be negative"))
+		}
+		if config.BalanceThreshold < 0 {
+			errs = append(errs, fmt.Errorf("balance threshold must not be negative"))
+		}
+		if config.TransferWindow < 0 {
+			errs = append(errs, fmt.Errorf("transfer window must not be negative"))
+		}
+	}
+
+	return errs
+}
+
+// validateLogin returns the problems with the Ininal login of config. identity
+// is the name of the identity the config belongs to, empty for the top level.
+func (config *Config) validateLogin(identity string) []error {
+	var errs []error
+
+	required := func(value, name, flag, key string) {
+		if value == "" && identity == "" {
+			errs = append(errs, fmt.Errorf("%s is required. Set via -%s flag, %s environment variable or %s in the config file", name, flag, ENV_VARS[flag], key))
+		} else if value == "" {
+			errs = append(errs, fmt.Errorf("identity %s: %s is required. Set %s of the identity in the config file", identity, name, key))
+		}
+	}
+
+	// Validate required fields
+	required(config.DeviceID, "Device ID", "device-id", "ininal.device_id")
+	required(config.LoginToken, "Login token", "login-token", "ininal.login_token")
+	required(config.UserToken, "User token", "user-token", "ininal.user_token")
+	required(config.LoginBearerToken, "Login bearer token", "login-bearer-token", "ininal.login_bearer_token")
+	required(config.Password, "Password", "password", "ininal.password")
+	required(config.LoginCredential, "Login credential", "login-credential", "ininal.login_credential")
+	required(config.DeviceSignature, "Device signature", "device-signature", "ininal.device_signature")
+	if config.pocketsmithFlags {
+		required(config.PocketsmithToken, "Pocketsmith token", "pocketsmith-token", "pocketsmith.token")
+	}
+
+	otpErr := config.OTP.validate()
+	if otpErr == nil && config.OTP.Provider == OTP_API && config.scheduleFlags && config.API.Listen == "" {
+		otpErr = fmt.Errorf("the api OTP provider needs the API, set api.listen")
+	}
+	if otpErr != nil {
+		if identity != "" {
+			otpErr = fmt.Errorf("identity %s: %v", identity, otpErr)
+		}
+		errs = append(errs, otpErr)
+	}
+
+	return errs
+}
+
+// forIdentity returns the config of identity, with the top-level settings
+// filling in what the identity leaves empty
+func (config *Config) forIdentity(identity Identity) *Config {
+	c := *config
+	c.Identities = nil
+	c.Identity = identity.Name
+	c.IninalConfig = identity.IninalConfig
+
+	if identity.PocketsmithToken != "" {
+		c.PocketsmithConfig = identity.PocketsmithConfig
+	}
+	if identity.OTP.Provider != "" {
+		c.OTP = identity.OTP
+		if c.OTP.Timeout == 0 {
+			c.OTP.Timeout = config.OTP.Timeout
+		}
+	}
+
+	// every identity needs its own session
+	if identity.SessionFile != "" {
+		c.SessionFile = identity.SessionFile
+	} else if config.SessionFile != "" {
+		ext := filepath.Ext(config.SessionFile)
+		c.SessionFile = strings.TrimSuffix(config.SessionFile, ext) + "-" + identity.Name + ext
+	}
+
+	if identity.AccountsFile != "" {
+		c.AccountsFile = identity.AccountsFile
+		c.AccountMapping = nil
+	}
+	if identity.AccountMapping != nil {
+		c.AccountMapping = identity.AccountMapping
+	}
+
+	return &c
+}
+
+// identities returns a config for every Ininal login to use: the identities
+// of the config file, or the top-level login when there are none
+func (config *Config) identities() []*Config {
+	if len(config.Identities) == 0 {
+		return []*Config{config}
+	}
+
+	var configs []*Config
+	for _, identity := range config.Identities {
+		if config.Identity == "" || config.Identity == identity.Name {
+			configs = append(configs, config.forIdentity(identity))
+		}
+	}
+	return configs
+}
+
+// singleIdentity returns the config of the only Ininal login in use. Commands
+// working with a single login exit when there are several.
+func (config *Config) singleIdentity() *Config {
+	configs := config.identities()
+	if len(configs) > 1 {
+		fail(EXIT_USAGE, fmt.Errorf("the config file has %d identities, select one with -identity", len(configs)))
+	}
+	return configs[0]
+}
+
+// accountMappings returns the account mapping of the config file, or reads
+// the account mapping file
+func (config *Config) accountMappings() (*AccountMappings, error) {
+	if config.AccountMapping != nil {
+		return config.AccountMapping, nil
+	}
+	return loadAccountMappings(config.AccountsFile)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDateOf(t *testing.T) {
+	tests := []struct {
+		name     string
+		t        time.Time
+		expected string
+	}{
+		{"just after midnight in Istanbul", time.Date(2024, 3, 1, 21, 30, 0, 0, time.UTC), "2024-03-02"},
+		{"just before midnight in Istanbul", time.Date(2024, 3, 1, 20, 59, 0, 0, time.UTC), "2024-03-01"},
+		{"another time zone", at("2024-03-02 00:30").In(time.FixedZone("EST", -5*60*60)), "2024-03-02"},
+		{"Istanbul", at("2024-03-02 00:30"), "2024-03-02"},
+	}
+
+	for _, test := range tests {
+		got := dateOf(test.t)
+		if !got.Equal(day(test.expected)) {
+			t.Errorf("%s: expected %s, got %v", test.name, test.expected, got)
+		}
+	}
+}
+
+func TestDefaultUntilAfterMidnight(t *testing.T) {
+	// a run at 00:30 in Istanbul fetches the transactions of that day
+	until := dateOf(at("2024-03-02 00:30"))
+	transaction := at("2024-03-02 00:10")
+	if !listedDay(transaction, until.AddDate(0, 0, -1), until) {
+		t.Errorf("expected a transaction at 00:10 to be within the default window of a run at 00:30")
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/dvcrn/pocketsmith-ininal/ininal"
+	"github.com/robfig/cron/v3"
+)
+
+func (s ScheduleConfig) validate() error {
+	switch {
+	case s.Cron == "" && s.Interval == 0:
+		return fmt.Errorf("the daemon needs a schedule, set -cron or -interval")
+	case s.Cron != "" && s.Interval != 0:
+		return fmt.Errorf("only one of cron and interval may be set")
+	case s.Interval != 0 && s.Interval < time.Minute:
+		return fmt.Errorf("interval must be at least 1m")
+	case s.Jitter < 0:
+		return fmt.Errorf("jitter must not be negative")
+	case s.KeepAlive < 0:
+		return fmt.Errorf("keep alive must not be negative")
+	}
+	if s.Cron != "" {
+		if _, err := cron.ParseStandard(s.Cron); err != nil {
+			return fmt.Errorf("invalid cron expression %q: %v", s.Cron, err)
+		}
+	}
+	return nil
+}
+
+func (s ScheduleConfig) schedule() cron.Schedule {
+	if s.Interval != 0 {
+		return cron.Every(s.Interval)
+	}
+	// validated before
+	schedule, _ := cron.ParseStandard(s.Cron)
+	return schedule
+}
+
+// daemonStatus is the state of the daemon, written to the status file
+type daemonStatus struct {
+	StartedAt time.Time `json:"startedAt"`
+	Running   bool      `json:"running"`
+	NextRunAt time.Time `json:"nextRunAt"`
+	Runs      int       `json:"runs"`
+	// LastSuccessAt is the end of the last run without failures
+	LastSuccessAt *time.Time `json:"lastSuccessAt,omitempty"`
+	LastRun       *runReport `json:"lastRun,omitempty"`
+}
+
+// daemon runs syncs on a schedule. Only one sync runs at a time.
+type daemon struct {
+	config *Config
+
+	// defaultSince and defaultUntil are set when the sync window was not
+	// configured, it then moves along with the current date
+	defaultSince bool
+	defaultUntil bool
+
+	// running is held while a sync runs
+	running sync.Mutex
+	wg      sync.WaitGroup
+
+	mu     sync.Mutex
+	status daemonStatus
+}
+
+func newDaemon(config *Config) *daemon {
+	defaults := defaultConfig()
+	return &daemon{
+		config:       config,
+		defaultSince: config.Since.Equal(defaults.Since),
+		defaultUntil: config.Until.Equal(defaults.Until),
+		status:       daemonStatus{StartedAt: time.Now()},
+	}
+}
+
+// runConfig returns the config of the next run
+func (d *daemon) runConfig() *Config {
+	config := *d.config
+	if d.defaultSince {
+		config.Since = today().AddDate(-2, 0, 0)
+	}
+	if d.defaultUntil {
+		config.Until = today()
+	}
+	return &config
+}
+
+// trigger starts a sync with config in the background. It returns false when
+// a sync is already running.
+func (d *daemon) trigger(reason string, config *Config) bool {
+	if !d.running.TryLock() {
+		fmt.Printf("Skipping %s sync, the previous sync is still running\n", reason)
+		return false
+	}
+
+	d.mu.Lock()
+	d.status.Running = true
+	d.mu.Unlock()
+	d.saveStatus()
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		defer d.running.Unlock()
+
+		fmt.Printf("Starting %s sync at %s\n", reason, time.Now().Format(time.RFC3339))
+		report := syncAll(config)
+		report.print()
+
+		d.mu.Lock()
+		d.status.Running = false
+		d.status.Runs++
+		d.status.LastRun = report
+		if !report.failed() {
+			d.status.LastSuccessAt = &report.FinishedAt
+		}
+		d.mu.Unlock()
+		d.saveStatus()
+	}()
+
+	return true
+}
+
+// keepAlive uses the cached Ininal sessions so they don't expire between syncs
+func (d *daemon) keepAlive() {
+	if !d.running.TryLock() {
+		// the sync uses the sessions anyway
+		return
+	}
+	defer d.running.Unlock()
+
+	for _, identityConfig := range d.config.identities() {
+		cached := loadSession(identityConfig)
+		if cached == nil {
+			continue
+		}
+
+		client := ininal.NewClient()
+		if _, err := client.GetUserCardAccount(identityConfig.DeviceID, cached.UserToken, cached.UserAuth); err != nil {
+			fmt.Printf("Ininal session of %s expired, the next sync logs in again: %v\n", identityName(identityConfig), err)
+		}
+	}
+}
+
+func identityName(config *Config) string {
+	if config.Identity == "" {
+		return "the top-level login"
+	}
+	return "identity " + config.Identity
+}
+
+// currentStatus returns a copy of the daemon status
+func (d *daemon) currentStatus() daemonStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.status
+}
+
+// saveStatus writes the status file, replacing it atomically
+func (d *daemon) saveStatus() {
+	path := d.config.Schedule.StatusFile
+	if path == "" {
+		return
+	}
+
+	data, err := json.MarshalIndent(d.currentStatus(), "", "  ")
+	if err != nil {
+		fmt.Printf("Error encoding status: %v\n", err)
+		return
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		fmt.Printf("Error writing status file: %v\n", err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		fmt.Printf("Error writing status file: %v\n", err)
+	}
+}
+
+// wait runs the scheduler until ctx is done
+func (d *daemon) wait(ctx context.Context) {
+	schedule := d.config.Schedule.schedule()
+
+	var keepAlive <-chan time.Time
+	if d.config.Schedule.KeepAlive > 0 {
+		ticker := time.NewTicker(d.config.Schedule.KeepAlive)
+		defer ticker.Stop()
+		keepAlive = ticker.C
+	}
+
+	if d.config.Schedule.RunOnStart {
+		d.trigger("initial", d.runConfig())
+	}
+
+	for {
+		next := schedule.Next(time.Now())
+		if jitter := d.config.Schedule.Jitter; jitter > 0 {
+			next = next.Add(time.Duration(rand.Int63n(int64(jitter))))
+		}
+
+		d.mu.Lock()
+		d.status.NextRunAt = next
+		d.mu.Unlock()
+		d.saveStatus()
+		fmt.Println("Next sync at", next.Format(time.RFC3339))
+
+		timer := time.NewTimer(time.Until(next))
+	waiting:
+		for {
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-keepAlive:
+				d.keepAlive()
+			case <-timer.C:
+				d.trigger("scheduled", d.runConfig())
+				break waiting
+			}
+		}
+	}
+}
+
+// runDaemon keeps running and syncs on the configured schedule
+func runDaemon(args []string) {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	config := registerConfigFlags(fs)
+	registerPocketsmithFlags(fs, config, true)
+	registerSyncFlags(fs, config)
+	registerScheduleFlags(fs, config)
+	config.parse(fs, args)
+
+	d := newDaemon(config)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if config.API.Listen != "" {
+		if err := d.serveAPI(ctx); err != nil {
+			fail(EXIT_ERROR, err)
+		}
+	}
+
+	d.wait(ctx)
+
+	fmt.Println("Stopping, waiting for the running sync to finish")
+	d.wg.Wait()
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dvcrn/pocketsmith-go"
+	"github.com/dvcrn/pocketsmith-ininal/rules"
+	"github.com/dvcrn/pocketsmith-ininal/state"
+)
+
+const (
+	CHECK_OK   = "ok"
+	CHECK_FAIL = "fail"
+	CHECK_SKIP = "skip"
+)
+
+// doctorCheck is the result of a single doctor check
+type doctorCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// checkWritable reports whether files can be created next to path
+func checkWritable(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	return os.Remove(tmp.Name())
+}
+
+// runDoctor checks the configuration, the local files and the connection to
+// Ininal and Pocketsmith without changing anything
+func runDoctor(args []string) {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	config := registerConfigFlags(fs)
+	registerPocketsmithFlags(fs, config, true)
+	offline := fs.Bool("offline", false, "Skip the checks that connect to Ininal and Pocketsmith")
+	output := registerOutputFlag(fs, OUTPUT_TABLE)
+	fs.Parse(args)
+	checkOutput(*output)
+
+	var checks []doctorCheck
+	add := func(name string, err error, detail string) {
+		check := doctorCheck{Name: name, Status: CHECK_OK, Detail: detail}
+		if err != nil {
+			check.Status = CHECK_FAIL
+			check.Detail = strings.ReplaceAll(err.Error(), "\n", "; ")
+		}
+		checks = append(checks, check)
+	}
+	skip := func(name, reason string) {
+		checks = append(checks, doctorCheck{Name: name, Status: CHECK_SKIP, Detail: reason})
+	}
+
+	// doctor reports configuration problems instead of exiting on them
+	configErr := config.load(fs)
+	detail := config.ConfigFile
+	if config.Profile != "" {
+		detail += ", profile " + config.Profile
+	}
+	add("configuration", configErr, detail)
+
+	if config.vault != nil {
+		add("vault", nil, fmt.Sprintf("%s, %d logins", config.VaultFile, len(config.vault.data.Logins)))
+	}
+
+	if _, err := state.Load(config.StateFile); err != nil {
+		add("state file", err, "")
+	} else {
+		add("state file", checkWritable(config.StateFile), config.StateFile)
+	}
+
+	if txRules, err := rules.Load(config.RulesFile); err != nil {
+		add("rules file", err, "")
+	} else {
+		add("rules file", nil, fmt.Sprintf("%s, %d payee, %d category, %d transfer, %d fee and %d label rules, %d icons", config.RulesFile, len(txRules.Payees), len(txRules.Categories), len(txRules.Transfers), len(txRules.Fees), len(txRules.Labels), len(txRules.Icons)))
+	}
+
+	for _, identityConfig := range config.identities() {
+		suffix := ""
+		if identityConfig.Identity != "" {
+			suffix = " (" + identityConfig.Identity + ")"
+		}
+
+		mappings, err := identityConfig.accountMappings()
+		if err == nil {
+			detail = fmt.Sprintf("%d accounts mapped", len(mappings.Accounts))
+		}
+		add("account mapping"+suffix, err, detail)
+
+		switch {
+		case *offline:
+			skip("pocketsmith"+suffix, "offline")
+		case identityConfig.PocketsmithToken == "":
+			skip("pocketsmith"+suffix, "no token configured")
+		default:
+			start := time.Now()
+			user, err := pocketsmith.NewClient(identityConfig.PocketsmithToken).GetCurrentUser()
+			recordPocketsmith("GET /me", start, err)
+			if err == nil {
+				detail = fmt.Sprintf("user %d", user.ID)
+			}
+			add("pocketsmith"+suffix, err, detail)
+		}
+
+		if identityConfig.vault != nil {
+			detail = "no session cached"
+			if cached := loadSession(identityConfig); cached != nil {
+				detail = "cached since " + cached.CreatedAt.Format(DATE_FORMAT)
+			}
+			add("session cache"+suffix, nil, "in the vault, "+detail)
+		} else if identityConfig.SessionFile == "" {
+			skip("session cache"+suffix, "disabled")
+		} else if cached := loadSession(identityConfig); cached != nil {
+			add("session cache"+suffix, checkWritable(identityConfig.SessionFile), fmt.Sprintf("%s, cached since %s", identityConfig.SessionFile, cached.CreatedAt.Format(DATE_FORMAT)))
+		} else {
+			add("session cache"+suffix, checkWritable(identityConfig.SessionFile), identityConfig.SessionFile+", no session cached")
+		}
+
+		switch {
+		case *offline:
+			skip("ininal"+suffix, "offline")
+		case configErr != nil:
+			skip("ininal"+suffix, "invalid configuration")
+		default:
+			sess, err := login(identityConfig)
+			if err == nil {
+				var accounts []string
+				for _, account := range sess.cardAccount.AccountListResponse {
+					accounts = append(accounts, account.AccountNumber)
+				}
+				detail = fmt.Sprintf("%d accounts: %s", len(accounts), strings.Join(accounts, ", "))
+			}
+			add("ininal"+suffix, err, detail)
+		}
+	}
+
+	t := &table{header: []string{"CHECK", "STATUS", "DETAIL"}, data: checks}
+	failed := false
+	for _, check := range checks {
+		t.add(check.Name, check.Status, check.Detail)
+		if check.Status == CHECK_FAIL {
+			failed = true
+		}
+	}
+
+	if err := t.write(os.Stdout, *output); err != nil {
+		fail(EXIT_ERROR, err)
+	}
+	if failed {
+		os.Exit(EXIT_ERROR)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/dvcrn/pocketsmith-ininal/ininal"
+	"github.com/dvcrn/pocketsmith-ininal/psapi"
+	"github.com/dvcrn/pocketsmith-ininal/rules"
+	"github.com/dvcrn/pocketsmith-ininal/state"
+)
+
+// FEE_SUFFIX is appended to the memo and cheque number of the transactions
+// fees are split off into, so they are not taken for the purchase
+const FEE_SUFFIX = "-fee"
+
+// feeRule returns the fee rule matching transaction, or nil
+func (im *importer) feeRule(transaction ininal.Transaction) *rules.FeeRule {
+	payee, _ := im.rules.Payee(transaction)
+	return im.rules.Fee(transaction, payee)
+}
+
+// standaloneFee returns the fee record of transaction when it is a fee of its
+// own, or nil
+func (im *importer) standaloneFee(transaction ininal.Transaction) *state.Fee {
+	rule := im.feeRule(transaction)
+	if rule == nil || rule.Bundled() {
+		return nil
+	}
+	return &state.Fee{Kind: rule.Kind, Amount: math.Abs(transaction.Amount)}
+}
+
+func withoutFee(amount, fee float64) float64 {
+	return math.Round((amount-math.Copysign(fee, amount))*100) / 100
+}
+
+// splitFee takes the fee bundled into transaction off createTx and returns the
+// transaction for the fee
+func (im *importer) splitFee(createTx *psapi.CreateTransaction, transaction ininal.Transaction, rule *rules.FeeRule, fee float64) *psapi.CreateTransaction {
+	createTx.Amount = withoutFee(transaction.Amount, fee)
+	createTx.Note = appendNote(createTx.Note, fmt.Sprintf("%s fee of %.2f split off", rule.Kind, fee))
+
+	feeTx := &psapi.CreateTransaction{
+		Payee:      createTx.Payee + " fee",
+		Amount:     math.Copysign(fee, transaction.Amount),
+		Date:       createTx.Date,
+		CategoryID: rule.CategoryID,
+		Note:       fmt.Sprintf("%s fee split off ref %s", rule.Kind, transaction.ReferenceNo),
+		Labels:     strings.Join(mergeLabels([]string{im.labels.Source, im.labels.Fee}), ","),
+	}
+	if createTx.Memo != "" {
+		feeTx.Memo = createTx.Memo + FEE_SUFFIX
+	}
+	if createTx.ChequeNumber != "" {
+		feeTx.ChequeNumber = createTx.ChequeNumber + FEE_SUFFIX
+	}
+	return feeTx
+}
+
+// addFee creates the transaction a fee was split off into after created was
+// created for transaction. When that fails the fee is put back into created
+// so the account still adds up, and the fee record is nil. When that fails too
+// the fee record is pending and an error is returned.
+func (im *importer) addFee(transactionAccountID int, transaction ininal.Transaction, created *psapi.Transaction, feeTx *psapi.CreateTransaction, kind string) (*state.Fee, *psapi.Transaction, error) {
+	fee, err := im.api.AddTransaction(transactionAccountID, feeTx)
+	if err == nil {
+		return &state.Fee{Kind: kind, Amount: math.Abs(feeTx.Amount), TransactionID: fee.ID}, created, nil
+	}
+
+	fmt.Printf("Error creating fee transaction, keeping the fee in the purchase: %v\n", err)
+	amount := transaction.Amount
+	updated, updateErr := im.api.UpdateTransaction(created.ID, &psapi.UpdateTransaction{Amount: &amount})
+	if updateErr != nil {
+		pending := &state.Fee{Kind: kind, Amount: math.Abs(feeTx.Amount), Pending: true}
+		return pending, created, fmt.Errorf("failed to put the fee back into transaction %d: %v", created.ID, updateErr)
+	}
+	return nil, updated, nil
+}
+
+// retryFee finishes the split of a pending fee of the imported transaction
+// existing: it creates the fee transaction, or else puts the fee back. When
+// the fee rule no longer splits the transaction the fee is put back as well.
+func (im *importer) retryFee(transactionAccountID int, account ininal.AccountInfo, transaction ininal.Transaction, record *state.Import, existing *psapi.Transaction) error {
+	_, feeTx, err := im.buildTransaction(transaction, account)
+	if err != nil {
+		return err
+	}
+
+	if feeTx == nil {
+		amount := transaction.Amount
+		updated, err := im.api.UpdateTransaction(existing.ID, &psapi.UpdateTransaction{Amount: &amount})
+		if err != nil {
+			return fmt.Errorf("failed to put the fee back into transaction %d: %v", existing.ID, err)
+		}
+		*existing = *updated
+		record.Amount = updated.Amount
+		record.Fee = im.standaloneFee(transaction)
+		return nil
+	}
+
+	fee, updated, err := im.addFee(transactionAccountID, transaction, existing, feeTx, im.feeRule(transaction).Kind)
+	if err != nil {
+		return err
+	}
+	*existing = *updated
+	record.Amount = updated.Amount
+	record.Fee = fee
+	return nil
+}
+
+// reconcileFee keeps the fee split of an imported transaction when it is
+// updated. Transactions imported without a split stay unsplit, and a split
+// fee follows the new amount.
+func (im *importer) reconcileFee(record *state.Import, transaction ininal.Transaction, desired, feeTx *psapi.CreateTransaction) error {
+	if record.Fee == nil || record.Fee.TransactionID == 0 {
+		if feeTx != nil {
+			desired.Amount = transaction.Amount
+		}
+		record.Fee = im.standaloneFee(transaction)
+		return nil
+	}
+
+	if feeTx == nil {
+		// the fee rule no longer matches, keep the recorded fee
+		desired.Amount = withoutFee(transaction.Amount, record.Fee.Amount)
+		return nil
+	}
+	if amountsEqual(math.Abs(feeTx.Amount), record.Fee.Amount) {
+		return nil
+	}
+	if _, err := im.api.UpdateTransaction(record.Fee.TransactionID, &psapi.UpdateTransaction{Amount: &feeTx.Amount}); err != nil {
+		return fmt.Errorf("failed to update fee transaction %d: %v", record.Fee.TransactionID, err)
+	}
+	record.Fee.Amount = math.Abs(feeTx.Amount)
+	return nil
+}
+
+// feeSummary is a row of fees
+type feeSummary struct {
+	Month string  `json:"month"`
+	Kind  string  `json:"kind"`
+	Count int     `json:"count"`
+	Total float64 `json:"total"`
+}
+
+// summarizeFees adds up the recorded fees dated within [since, until] by month
+// and kind
+func summarizeFees(imports map[string]*state.Import, since, until string) []feeSummary {
+	byKey := map[string]*feeSummary{}
+	for _, record := range imports {
+		date := record.Date.Format(DATE_FORMAT)
+		if record.Fee == nil || date < since || date > until {
+			continue
+		}
+		month := record.Date.Format("2006-01")
+		key := month + "\x00" + record.Fee.Kind
+		summary := byKey[key]
+		if summary == nil {
+			summary = &feeSummary{Month: month, Kind: record.Fee.Kind}
+			byKey[key] = summary
+		}
+		summary.Count++
+		summary.Total = math.Round((summary.Total+record.Fee.Amount)*100) / 100
+	}
+
+	summaries := []feeSummary{}
+	for _, summary := range byKey {
+		summaries = append(summaries, *summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].Month != summaries[j].Month {
+			return summaries[i].Month < summaries[j].Month
+		}
+		return summaries[i].Kind < summaries[j].Kind
+	})
+	return summaries
+}
+
+func runFees(args []string) {
+	fs := flag.NewFlagSet("fees", flag.ExitOnError)
+	config := registerConfigFlags(fs)
+	registerWindowFlags(fs, config)
+	output := registerOutputFlag(fs, OUTPUT_TABLE)
+	// the summary only reads the state file
+	config.noLogin, config.noVault = true, true
+	config.parse(fs, args)
+	config = config.singleIdentity()
+	checkOutput(*output)
+
+	st, err := state.Load(config.StateFile)
+	if err != nil {
+		fail(EXIT_ERROR, err)
+	}
+
+	summaries := summarizeFees(st.Imports, config.Since.Format(DATE_FORMAT), config.Until.Format(DATE_FORMAT))
+
+	t := &table{
+		header: []string{"MONTH", "KIND", "COUNT", "TOTAL"},
+		data:   summaries,
+	}
+	byKind := map[string]float64{}
+	total := 0.0
+	for _, s := range summaries {
+		t.add(s.Month, s.Kind, fmt.Sprint(s.Count), formatAmount(s.Total))
+		byKind[s.Kind] += s.Total
+		total += s.Total
+	}
+
+	if err := t.write(os.Stdout, *output); err != nil {
+		fail(EXIT_ERROR, err)
+	}
+
+	kinds := make([]string, 0, len(byKind))
+	for kind := range byKind {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fmt.Fprintf(os.Stderr, "%s fees: %s\n", kind, formatAmount(byKind[kind]))
+	}
+	fmt.Fprintf(os.Stderr, "Total fees: %s\n", formatAmount(total))
+}
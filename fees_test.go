@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/dvcrn/pocketsmith-ininal/psapi"
+	"github.com/dvcrn/pocketsmith-ininal/state"
+)
+
+func TestKnownImportsIgnoresFees(t *testing.T) {
+	transactions := []psapi.Transaction{
+		{ID: 1, Memo: "REF123" + FEE_SUFFIX, ChequeNumber: "REF123" + FEE_SUFFIX},
+		{ID: 2, Memo: "edited: REF456"},
+		{ID: 3, Memo: "REF789" + FEE_SUFFIX},
+		{ID: 4, Memo: "REF789"},
+	}
+	known := newKnownImports(transactions, map[string]*state.Import{})
+
+	if tx, ok := known.find("REF123"); ok {
+		t.Errorf("expected the fee transaction not to be taken for the purchase, got %d", tx.ID)
+	}
+	if tx, ok := known.find("REF456"); !ok || tx.ID != 2 {
+		t.Errorf("expected the edited memo to be found, got %d", tx.ID)
+	}
+	if tx, ok := known.find("REF789"); !ok || tx.ID != 4 {
+		t.Errorf("expected the purchase to be found, got %d", tx.ID)
+	}
+}
+
+func TestWithoutFee(t *testing.T) {
+	tests := []struct {
+		amount, fee, expected float64
+	}{
+		{-107.5, 7.5, -100},
+		{-100.1, 0.1, -100},
+		{50, 2.5, 47.5},
+	}
+
+	for _, test := range tests {
+		if got := withoutFee(test.amount, test.fee); got != test.expected {
+			t.Errorf("%.2f without a fee of %.2f: expected %.2f, got %.2f", test.amount, test.fee, test.expected, got)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dvcrn/pocketsmith-ininal/ininal"
+	"github.com/dvcrn/pocketsmith-ininal/state"
+)
+
+// How the original currency of transactions made in another currency than
+// their account is recorded
+const (
+	// FOREIGN_NOTE appends the original amount and the implied rate to the note
+	FOREIGN_NOTE = "note"
+	// FOREIGN_LABEL adds a label like foreign:usd
+	FOREIGN_LABEL = "label"
+	// FOREIGN_BOTH does both
+	FOREIGN_BOTH = "both"
+	// FOREIGN_NONE only keeps the original amount in the state file
+	FOREIGN_NONE = "none"
+)
+
+// FOREIGN_LABEL_PREFIX is followed by the lower case original currency
+const FOREIGN_LABEL_PREFIX = "foreign:"
+
+// foreignAmountPattern finds an amount next to a currency code in a
+// description, like "AMAZON.COM 12,99 USD" or "USD 1.234,56". The currency
+// code is filled in.
+const foreignAmountPattern = `(?i)(?:(\d[\d.,]*\d|\d)\s*%[1]s\b|\b%[1]s\s*(\d[\d.,]*\d|\d))`
+
+// parseDecimal parses amounts written with either decimal separator. The last
+// separator followed by one or two digits is the decimal separator.
+func parseDecimal(s string) (float64, error) {
+	decimal := strings.LastIndexAny(s, ".,")
+	if decimal >= 0 && len(s)-decimal-1 > 2 {
+		decimal = -1
+	}
+	var b strings.Builder
+	for i, r := range s {
+		switch {
+		case i == decimal:
+			b.WriteRune('.')
+		case r == '.' || r == ',':
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return strconv.ParseFloat(b.String(), 64)
+}
+
+// foreignAmount returns the original currency and amount of a transaction made
+// in another currency than its account, or nil. Ininal only gives the amount in
+// the account currency, the original amount is taken from the description and
+// is 0 when it isn't mentioned there. Exchanges between the accounts are not
+// foreign transactions.
+func foreignAmount(transaction ininal.Transaction, accountCurrency string, fxTypes []string) *state.Foreign {
+	currency := strings.ToUpper(strings.TrimSpace(transaction.Currency))
+	if currency == "" || accountCurrency == "" || strings.EqualFold(currency, accountCurrency) || isFXType(transaction, fxTypes) {
+		return nil
+	}
+
+	foreign := &state.Foreign{Currency: currency, AccountCurrency: strings.ToUpper(accountCurrency)}
+	re, err := regexp.Compile(fmt.Sprintf(foreignAmountPattern, regexp.QuoteMeta(currency)))
+	if err != nil {
+		return foreign
+	}
+	if m := re.FindStringSubmatch(transaction.Description); m != nil {
+		s := m[1]
+		if s == "" {
+			s = m[2]
+		}
+		if amount, err := parseDecimal(s); err == nil && amount > 0 {
+			foreign.Amount = math.Copysign(amount, transaction.Amount)
+		}
+	}
+	return foreign
+}
+
+// impliedRate is the price of one unit of the original currency in the
+// account currency, 0 when the original amount is unknown
+func impliedRate(foreign *state.Foreign, amount float64) float64 {
+	if foreign.Amount == 0 {
+		return 0
+	}
+	return math.Abs(amount / foreign.Amount)
+}
+
+// foreignNote describes the original amount, like
+// "Original 12.99 USD, 1 USD = 34.1234 TRY"
+func foreignNote(foreign *state.Foreign, amount float64) string {
+	if foreign.Amount == 0 {
+		return "Original currency " + foreign.Currency
+	}
+	return fmt.Sprintf("Original %.2f %s, 1 %s = %.4f %s", math.Abs(foreign.Amount), foreign.Currency, foreign.Currency, impliedRate(foreign, amount), foreign.AccountCurrency)
+}
+
+func foreignLabel(foreign *state.Foreign) string {
+	return FOREIGN_LABEL_PREFIX + strings.ToLower(foreign.Currency)
+}
+
+// FX_REFERENCE_DAYS is how far apart an exchange between the Ininal accounts
+// may be to serve as the reference rate of a foreign transaction
+const FX_REFERENCE_DAYS = 7
+
+// referenceRate returns the price of one unit of foreign.Currency in the
+// account currency from rates, which maps currencies to their price, or else
+// from the closest exchange between the Ininal accounts. It returns 0 when
+// there is no reference.
+func referenceRate(foreign *state.Foreign, date time.Time, rates map[string]float64, exchanges map[string]*state.Exchange) float64 {
+	if rate, ok := rates[foreign.Currency]; ok {
+		return rate
+	}
+
+	best, bestDistance := 0.0, time.Duration(FX_REFERENCE_DAYS*24)*time.Hour
+	for _, exchange := range exchanges {
+		var rate float64
+		switch {
+		case exchange.SoldCurrency == foreign.AccountCurrency && exchange.BoughtCurrency == foreign.Currency:
+			rate = exchange.SoldAmount / exchange.BoughtAmount
+		case exchange.SoldCurrency == foreign.Currency && exchange.BoughtCurrency == foreign.AccountCurrency:
+			rate = exchange.BoughtAmount / exchange.SoldAmount
+		default:
+			continue
+		}
+		if distance := absDuration(exchange.Date.Sub(date)); distance <= bestDistance {
+			best, bestDistance = rate, distance
+		}
+	}
+	return best
+}
+
+// parseRates parses rates like USD=34.10 into a map of currencies to prices
+func parseRates(list []string) (map[string]float64, error) {
+	rates := map[string]float64{}
+	for _, item := range list {
+		currency, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid rate %q, expected CURRENCY=RATE", item)
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("invalid rate %q, expected CURRENCY=RATE", item)
+		}
+		rates[strings.ToUpper(strings.TrimSpace(currency))] = rate
+	}
+	return rates, nil
+}
+
+// foreignResult is a row of fx -foreign
+type foreignResult struct {
+	Date            string  `json:"date"`
+	Ref             string  `json:"ref"`
+	Payee           string  `json:"payee"`
+	Amount          float64 `json:"amount"`
+	AccountCurrency string  `json:"accountCurrency"`
+	OriginalAmount  float64 `json:"originalAmount"`
+	Currency        string  `json:"currency"`
+	// Rate is the implied price of one unit of the original currency, 0 when
+	// the original amount is unknown
+	Rate      float64 `json:"rate"`
+	Reference float64 `json:"reference,omitempty"`
+	// Markup is how much more than the reference rate was paid, in percent
+	Markup *float64 `json:"markup,omitempty"`
+}
+
+// foreignTransactions lists the imported transactions in another currency than
+// their account within [since, until], oldest first
+func foreignTransactions(st *state.State, since, until time.Time, rates map[string]float64) []foreignResult {
+	results := []foreignResult{}
+	first, last := since.Format(DATE_FORMAT), until.Format(DATE_FORMAT)
+	for ref, record := range st.Imports {
+		date := record.Date.Format(DATE_FORMAT)
+		if record.Foreign == nil || date < first || date > last {
+			continue
+		}
+
+		result := foreignResult{
+			Date:            date,
+			Ref:             ref,
+			Payee:           record.Payee,
+			Amount:          record.Amount,
+			AccountCurrency: record.Foreign.AccountCurrency,
+			OriginalAmount:  record.Foreign.Amount,
+			Currency:        record.Foreign.Currency,
+			Rate:            impliedRate(record.Foreign, record.Amount),
+		}
+		if result.Rate > 0 {
+			result.Reference = referenceRate(record.Foreign, record.Date, rates, st.Exchanges)
+			if result.Reference > 0 {
+				markup := (result.Rate/result.Reference - 1) * 100
+				result.Markup = &markup
+			}
+		}
+		results = append(results, result)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Date != results[j].Date {
+			return results[i].Date < results[j].Date
+		}
+		return results[i].Ref < results[j].Ref
+	})
+	return results
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dvcrn/pocketsmith-ininal/ininal"
+	"github.com/dvcrn/pocketsmith-ininal/state"
+)
+
+func TestParseDecimal(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected float64
+	}{
+		{"12", 12},
+		{"12,99", 12.99},
+		{"12.99", 12.99},
+		{"1,5", 1.5},
+		{"0.5", 0.5},
+		// Turkish thousands and decimal separators
+		{"1.234,56", 1234.56},
+		{"1.234.567,8", 1234567.8},
+		// English ones
+		{"1,234.56", 1234.56},
+		{"1,234,567.8", 1234567.8},
+		// a separator followed by three digits groups thousands
+		{"1.234", 1234},
+		{"1,234", 1234},
+		{"1.234.567", 1234567},
+	}
+
+	for _, test := range tests {
+		got, err := parseDecimal(test.s)
+		if err != nil {
+			t.Errorf("%q: %v", test.s, err)
+			continue
+		}
+		if got != test.expected {
+			t.Errorf("%q: expected %v, got %v", test.s, test.expected, got)
+		}
+	}
+
+	if _, err := parseDecimal("1,2x"); err == nil {
+		t.Errorf("expected an error for an invalid number")
+	}
+}
+
+func TestForeignAmount(t *testing.T) {
+	tests := []struct {
+		name        string
+		description string
+		currency    string
+		txType      string
+		amount      float64
+		// foreign is false when the transaction is not a foreign transaction
+		foreign  bool
+		expected float64
+	}{
+		{"amount before the currency", "AMAZON.COM 12,99 USD", "USD", "Alışveriş", -450.12, true, -12.99},
+		{"amount after the currency", "NETFLIX.COM USD 15.49 AMSTERDAM", "usd", "Alışveriş", -530, true, -15.49},
+		{"Turkish separators", "HOTEL BERLIN 1.234,56 EUR", "EUR", "Alışveriş", -45000, true, -1234.56},
+		{"English separators", "HOTEL LONDON GBP 1,234.56", "GBP", "Alışveriş", -51000, true, -1234.56},
+		{"lower case currency in the description", "steam 4,99 usd", "USD", "Alışveriş", -170.5, true, -4.99},
+		{"refund", "AMAZON.COM 12,99 USD", "USD", "İade", 450.12, true, 12.99},
+		{"amount not mentioned", "SPOTIFY P1A2B3C4 STOCKHOLM SE", "USD", "Alışveriş", -340, true, 0},
+		{"amount of another currency", "AMAZON.DE 12,99 EUR", "USD", "Alışveriş", -450, true, 0},
+		{"currency as part of a word", "USDT 50 WALLET", "USD", "Alışveriş", -1700, true, 0},
+		{"account currency", "MIGROS 12,99 TRY", "TRY", "Alışveriş", -12.99, false, 0},
+		{"no currency", "MIGROS", "", "Alışveriş", -12.99, false, 0},
+		{"exchange between the accounts", "Döviz Alış 100 USD", "USD", "Döviz Alış", -3412.34, false, 0},
+	}
+
+	for _, test := range tests {
+		foreign := foreignAmount(ininal.Transaction{
+			Description:     test.description,
+			Currency:        test.currency,
+			TransactionType: test.txType,
+			Amount:          test.amount,
+		}, "TRY", DEFAULT_FX_TYPES)
+
+		if !test.foreign {
+			if foreign != nil {
+				t.Errorf("%s: expected no foreign amount, got %+v", test.name, *foreign)
+			}
+			continue
+		}
+		if foreign == nil {
+			t.Errorf("%s: expected a foreign amount", test.name)
+			continue
+		}
+		if foreign.Amount != test.expected || foreign.AccountCurrency != "TRY" || foreign.Currency != strings.ToUpper(test.currency) {
+			t.Errorf("%s: expected %.2f %s in TRY, got %+v", test.name, test.expected, test.currency, *foreign)
+		}
+	}
+}
+
+func TestImpliedRate(t *testing.T) {
+	foreign := foreignAmount(ininal.Transaction{Description: "AMAZON.COM 12,50 USD", Currency: "USD", Amount: -431.25}, "TRY", nil)
+	if rate := impliedRate(foreign, -431.25); !amountsEqual(rate, 34.5) {
+		t.Errorf("expected a rate of 34.5, got %v", rate)
+	}
+	if note := foreignNote(foreign, -431.25); note != "Original 12.50 USD, 1 USD = 34.5000 TRY" {
+		t.Errorf("unexpected note %q", note)
+	}
+}
+
+func TestForeignTransactionsDayBoundaries(t *testing.T) {
+	purchase := func(date string) *state.Import {
+		return &state.Import{
+			Payee:   "Amazon",
+			Amount:  -431.25,
+			Date:    at(date),
+			Foreign: &state.Foreign{Currency: "USD", Amount: -12.5, AccountCurrency: "TRY"},
+		}
+	}
+	st := &state.State{Imports: map[string]*state.Import{
+		// 01:00 in Istanbul is still the day before in UTC
+		"before": purchase("2024-02-29 23:30"),
+		"first":  purchase("2024-03-01 01:00"),
+		"last":   purchase("2024-03-31 23:30"),
+		"after":  purchase("2024-04-01 01:00"),
+		"local":  {Payee: "Migros", Amount: -100, Date: at("2024-03-10 10:00")},
+	}}
+
+	var refs []string
+	for _, result := range foreignTransactions(st, day("2024-03-01"), day("2024-03-31"), nil) {
+		refs = append(refs, result.Ref+" "+result.Date)
+	}
+	if got := strings.Join(refs, ","); got != "first 2024-03-01,last 2024-03-31" {
+		t.Errorf("expected first and last, got %s", got)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dvcrn/pocketsmith-ininal/ininal"
+	"github.com/dvcrn/pocketsmith-ininal/state"
+)
+
+// BASE_CURRENCY is the currency exchange rates are quoted in and FX gains are
+// realized in by default
+const BASE_CURRENCY = "TRY"
+
+// DEFAULT_FX_TYPES are the transaction types (or parts of them) used by Ininal
+// for exchanges between the currency accounts
+var DEFAULT_FX_TYPES = []string{"Döviz", "Doviz", "Exchange"}
+
+func isFXType(transaction ininal.Transaction, fxTypes []string) bool {
+	for _, t := range fxTypes {
+		if t != "" && (strings.Contains(transaction.TransactionType, t) || strings.Contains(transaction.Description, t)) {
+			return true
+		}
+	}
+	return false
+}
+
+// rate returns the price of one unit of the foreign currency of exchange in
+// base, or of the sold currency in the bought one when neither is base
+func rate(exchange *state.Exchange, base string) (float64, string, string) {
+	if exchange.SoldCurrency == base {
+		return exchange.SoldAmount / exchange.BoughtAmount, exchange.BoughtCurrency, base
+	}
+	return exchange.BoughtAmount / exchange.SoldAmount, exchange.SoldCurrency, exchange.BoughtCurrency
+}
+
+// exchangeRate describes the effective rate of exchange, like "1 USD = 34.1234 TRY"
+func exchangeRate(exchange *state.Exchange, base string) string {
+	r, unit, quote := rate(exchange, base)
+	return fmt.Sprintf("1 %s = %.4f %s", unit, r, quote)
+}
+
+// fxPosition is the amount of a foreign currency bought with the base
+// currency and what it cost
+type fxPosition struct {
+	Amount float64
+	Cost   float64
+}
+
+// fxResult is a row of fx
+type fxResult struct {
+	Ref string `json:"ref"`
+	state.Exchange
+	Rate string `json:"rate"`
+	// Gain is the realized gain (or loss) in the base currency of selling a
+	// foreign currency. It is nil for purchases and when the cost is unknown.
+	Gain *float64 `json:"gain,omitempty"`
+}
+
+// fxReport is the json output of fx
+type fxReport struct {
+	Base      string             `json:"base"`
+	Exchanges []fxResult         `json:"exchanges"`
+	Realized  map[string]float64 `json:"realized"`
+	Total     float64            `json:"total"`
+}
+
+// realizeFX computes the realized gains of the exchanges within [since, until]
+// at average cost. The cost of a foreign currency is built up by all earlier
+// exchanges from base, only exchanges change the positions.
+func realizeFX(exchanges map[string]*state.Exchange, base string, since, until time.Time) *fxReport {
+	refs := make([]string, 0, len(exchanges))
+	for ref := range exchanges {
+		refs = append(refs, ref)
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		a, b := exchanges[refs[i]], exchanges[refs[j]]
+		if !a.Date.Equal(b.Date) {
+			return a.Date.Before(b.Date)
+		}
+		return refs[i] < refs[j]
+	})
+
+	report := &fxReport{Base: base, Exchanges: []fxResult{}, Realized: map[string]float64{}}
+	positions := map[string]*fxPosition{}
+	// exchanges are compared by the calendar day in their own time zone, as
+	// Ininal lists them
+	first, last := since.Format(DATE_FORMAT), until.Format(DATE_FORMAT)
+
+	for _, ref := range refs {
+		exchange := exchanges[ref]
+		date := exchange.Date.Format(DATE_FORMAT)
+		if date > last {
+			continue
+		}
+
+		var gain *float64
+		switch {
+		case exchange.SoldCurrency == base && exchange.BoughtCurrency != base:
+			position := positions[exchange.BoughtCurrency]
+			if position == nil {
+				position = &fxPosition{}
+				positions[exchange.BoughtCurrency] = position
+			}
+			position.Amount += exchange.BoughtAmount
+			position.Cost += exchange.SoldAmount
+		case exchange.BoughtCurrency == base && exchange.SoldCurrency != base:
+			position := positions[exchange.SoldCurrency]
+			if position == nil || position.Amount <= 0 {
+				break
+			}
+			sold := exchange.SoldAmount
+			if sold > position.Amount {
+				// only the part bought through recorded exchanges has a cost
+				sold = position.Amount
+			}
+			cost := position.Cost * sold / position.Amount
+			g := exchange.BoughtAmount*sold/exchange.SoldAmount - cost
+			gain = &g
+			position.Amount -= sold
+			position.Cost -= cost
+		}
+
+		if date < first {
+			continue
+		}
+		report.Exchanges = append(report.Exchanges, fxResult{Ref: ref, Exchange: *exchange, Rate: exchangeRate(exchange, base), Gain: gain})
+		if gain != nil {
+			report.Realized[exchange.SoldCurrency] += *gain
+			report.Total += *gain
+		}
+	}
+
+	return report
+}
+
+func runFX(args []string) {
+	fs := flag.NewFlagSet("fx", flag.ExitOnError)
+	config := registerConfigFlags(fs)
+	registerWindowFlags(fs, config)
+	base := fs.String("base", BASE_CURRENCY, "Currency the gains are realized in")
+	foreign := fs.Bool("foreign", false, "List the transactions in another currency than their account with the implied rate and card markup instead")
+	var rateList []string
+	fs.Var(listValue{&rateList}, "rates", "Comma separated reference rates in the account currency for -foreign, like USD=34.10,EUR=37.20")
+	output := registerOutputFlag(fs, OUTPUT_TABLE)
+	// the report only reads the state file
+	config.noLogin, config.noVault = true, true
+	config.parse(fs, args)
+	config = config.singleIdentity()
+	checkOutput(*output)
+
+	st, err := state.Load(config.StateFile)
+	if err != nil {
+		fail(EXIT_ERROR, err)
+	}
+
+	if *foreign {
+		rates, err := parseRates(rateList)
+		if err != nil {
+			fail(EXIT_USAGE, err)
+		}
+		writeForeign(foreignTransactions(st, config.Since, config.Until, rates), *output)
+		return
+	}
+
+	report := realizeFX(st.Exchanges, strings.ToUpper(*base), config.Since, config.Until)
+
+	t := &table{
+		header: []string{"DATE", "REF", "SOLD", "BOUGHT", "RATE", "GAIN"},
+		data:   report,
+	}
+	for _, r := range report.Exchanges {
+		gain := ""
+		if r.Gain != nil {
+			gain = formatAmount(*r.Gain)
+		}
+		t.add(r.Date.Format(DATE_FORMAT), r.Ref, formatAmount(r.SoldAmount)+" "+r.SoldCurrency, formatAmount(r.BoughtAmount)+" "+r.BoughtCurrency, r.Rate, gain)
+	}
+
+	if err := t.write(os.Stdout, *output); err != nil {
+		fail(EXIT_ERROR, err)
+	}
+
+	currencies := make([]string, 0, len(report.Realized))
+	for currency := range report.Realized {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+	for _, currency := range currencies {
+		fmt.Fprintf(os.Stderr, "Realized on %s: %s %s\n", currency, formatAmount(report.Realized[currency]), report.Base)
+	}
+	fmt.Fprintf(os.Stderr, "%d exchanges, realized FX gain/loss %s %s\n", len(report.Exchanges), formatAmount(report.Total), report.Base)
+}
+
+// writeForeign prints the foreign transactions of fx -foreign and their
+// average markup
+func writeForeign(results []foreignResult, output string) {
+	t := &table{
+		header: []string{"DATE", "REF", "PAYEE", "AMOUNT", "ORIGINAL", "RATE", "REFERENCE", "MARKUP"},
+		data:   results,
+	}
+	markups := map[string][]float64{}
+	for _, r := range results {
+		original, rate, reference, markup := r.Currency, "", "", ""
+		if r.Rate > 0 {
+			original = formatAmount(r.OriginalAmount) + " " + r.Currency
+			rate = fmt.Sprintf("%.4f", r.Rate)
+		}
+		if r.Reference > 0 {
+			reference = fmt.Sprintf("%.4f", r.Reference)
+		}
+		if r.Markup != nil {
+			markup = fmt.Sprintf("%.2f%%", *r.Markup)
+			markups[r.Currency] = append(markups[r.Currency], *r.Markup)
+		}
+		t.add(r.Date, r.Ref, r.Payee, formatAmount(r.Amount)+" "+r.AccountCurrency, original, rate, reference, markup)
+	}
+
+	if err := t.write(os.Stdout, output); err != nil {
+		fail(EXIT_ERROR, err)
+	}
+
+	currencies := make([]string, 0, len(markups))
+	for currency := range markups {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+	for _, currency := range currencies {
+		sum := 0.0
+		for _, m := range markups[currency] {
+			sum += m
+		}
+		fmt.Fprintf(os.Stderr, "Average markup on %s: %.2f%% over %d transactions\n", currency, sum/float64(len(markups[currency])), len(markups[currency]))
+	}
+	fmt.Fprintf(os.Stderr, "%d transactions in foreign currencies\n", len(results))
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dvcrn/pocketsmith-ininal/state"
+)
+
+func buy(date string, try, usd float64) *state.Exchange {
+	return &state.Exchange{Date: at(date), SoldCurrency: "TRY", SoldAmount: try, BoughtCurrency: "USD", BoughtAmount: usd}
+}
+
+func sell(date string, usd, try float64) *state.Exchange {
+	return &state.Exchange{Date: at(date), SoldCurrency: "USD", SoldAmount: usd, BoughtCurrency: "TRY", BoughtAmount: try}
+}
+
+func TestRealizeFX(t *testing.T) {
+	exchanges := map[string]*state.Exchange{
+		// 200 USD at an average of 32 TRY
+		"1": buy("2024-01-05 10:00", 3000, 100),
+		"2": buy("2024-01-20 10:00", 3400, 100),
+		// sells at 35, the cost of 50 USD is 1600
+		"3": sell("2024-02-01 10:00", 50, 1750),
+		// a cross exchange doesn't change the TRY positions
+		"4": {Date: at("2024-02-10 10:00"), SoldCurrency: "USD", SoldAmount: 10, BoughtCurrency: "EUR", BoughtAmount: 9.2},
+		// sells at 33 from the remaining 150 USD that cost 4800
+		"5": sell("2024-03-01 10:00", 100, 3300),
+		// buys 50 more at 36, 100 USD cost 3400 now
+		"6": buy("2024-03-15 10:00", 1800, 50),
+		// sells more than was bought through exchanges at 37, only 100 USD
+		// have a cost
+		"7": sell("2024-04-01 10:00", 120, 4440),
+		// nothing is left to sell
+		"8": sell("2024-04-02 10:00", 10, 370),
+		// after the period
+		"9": sell("2024-05-01 10:00", 10, 370),
+	}
+
+	tests := []struct {
+		name         string
+		since, until string
+		// gains maps the listed exchanges to their gain, nil when there is none
+		gains map[string]*float64
+		total float64
+	}{
+		{
+			name:  "whole period",
+			since: "2024-01-01", until: "2024-04-30",
+			gains: map[string]*float64{
+				"1": nil, "2": nil, "3": ptr(150), "4": nil, "5": ptr(100), "6": nil,
+				"7": ptr(4440.0*100/120 - 3400), "8": nil,
+			},
+			total: 150 + 100 + 4440.0*100/120 - 3400,
+		},
+		{
+			// earlier exchanges still build up the cost
+			name:  "later period",
+			since: "2024-03-01", until: "2024-03-31",
+			gains: map[string]*float64{"5": ptr(100), "6": nil},
+			total: 100,
+		},
+		{
+			name:  "until is inclusive",
+			since: "2024-01-01", until: "2024-02-01",
+			gains: map[string]*float64{"1": nil, "2": nil, "3": ptr(150)},
+			total: 150,
+		},
+	}
+
+	for _, test := range tests {
+		report := realizeFX(exchanges, "TRY", day(test.since), day(test.until))
+
+		if len(report.Exchanges) != len(test.gains) {
+			t.Errorf("%s: expected %d exchanges, got %d", test.name, len(test.gains), len(report.Exchanges))
+			continue
+		}
+		for i, result := range report.Exchanges {
+			if i > 0 && result.Date.Before(report.Exchanges[i-1].Date) {
+				t.Errorf("%s: exchanges are not sorted by date", test.name)
+			}
+			expected, ok := test.gains[result.Ref]
+			switch {
+			case !ok:
+				t.Errorf("%s: unexpected exchange %s", test.name, result.Ref)
+			case expected == nil && result.Gain != nil:
+				t.Errorf("%s: expected no gain for %s, got %.2f", test.name, result.Ref, *result.Gain)
+			case expected != nil && (result.Gain == nil || !amountsEqual(*result.Gain, *expected)):
+				t.Errorf("%s: expected a gain of %.2f for %s, got %v", test.name, *expected, result.Ref, result.Gain)
+			}
+		}
+		if !amountsEqual(report.Total, test.total) || !amountsEqual(report.Realized["USD"], test.total) {
+			t.Errorf("%s: expected a total of %.2f, got %.2f (USD %.2f)", test.name, test.total, report.Total, report.Realized["USD"])
+		}
+	}
+}
+
+func TestRealizeFXDayBoundaries(t *testing.T) {
+	exchanges := map[string]*state.Exchange{
+		// 01:00 in Istanbul is still the day before in UTC
+		"first": buy("2024-03-01 01:00", 3200, 100),
+		"last":  sell("2024-03-31 23:30", 50, 1700),
+		"after": sell("2024-04-01 01:00", 50, 1800),
+	}
+
+	report := realizeFX(exchanges, "TRY", day("2024-03-01"), day("2024-03-31"))
+	var refs []string
+	for _, result := range report.Exchanges {
+		refs = append(refs, result.Ref)
+	}
+	if strings.Join(refs, ",") != "first,last" {
+		t.Errorf("expected the exchanges first,last, got %v", refs)
+	}
+	if !amountsEqual(report.Total, 100) {
+		t.Errorf("expected a total of 100.00, got %.2f", report.Total)
+	}
+}
+
+func ptr(f float64) *float64 {
+	return &f
+}
+
+func TestExchangeRate(t *testing.T) {
+	tests := []struct {
+		exchange *state.Exchange
+		expected string
+	}{
+		{buy("2024-01-05 10:00", 3412.34, 100), "1 USD = 34.1234 TRY"},
+		{sell("2024-01-05 10:00", 100, 3400), "1 USD = 34.0000 TRY"},
+		{&state.Exchange{SoldCurrency: "USD", SoldAmount: 100, BoughtCurrency: "EUR", BoughtAmount: 92}, "1 USD = 0.9200 EUR"},
+	}
+
+	for _, test := range tests {
+		if got := exchangeRate(test.exchange, "TRY"); got != test.expected {
+			t.Errorf("expected %q, got %q", test.expected, got)
+		}
+	}
+}
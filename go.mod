@@ -2,4 +2,12 @@ module github.com/dvcrn/pocketsmith-ininal
 
 go 1.23.3
 
-require github.com/dvcrn/pocketsmith-go v0.0.0-20241213060714-89b97a49580f
+require (
+	github.com/dvcrn/pocketsmith-go v0.0.0-20241213060714-89b97a49580f
+	github.com/robfig/cron/v3 v3.0.1
+	golang.org/x/crypto v0.31.0
+	golang.org/x/term v0.27.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require golang.org/x/sys v0.28.0 // indirect
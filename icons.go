@@ -0,0 +1,127 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dvcrn/pocketsmith-ininal/ininal"
+	"github.com/dvcrn/pocketsmith-ininal/rules"
+	"github.com/dvcrn/pocketsmith-ininal/state"
+)
+
+// iconResult is a row of icons
+type iconResult struct {
+	Icon string `json:"icon"`
+	// Category is the category of the icon mapping, by title or ID
+	Category string     `json:"category,omitempty"`
+	Labels   []string   `json:"labels,omitempty"`
+	Seen     state.Icon `json:"seen"`
+}
+
+func runIcons(args []string) {
+	fs := flag.NewFlagSet("icons", flag.ExitOnError)
+	config := registerConfigFlags(fs)
+	registerWindowFlags(fs, config)
+	fetch := fs.Bool("fetch", false, "Also scan the Ininal transactions of the window for icons, without saving them in the state")
+	onlyAccount := fs.String("account", "", "Only scan the Ininal account with this account number or IBAN, with -fetch")
+	unmapped := fs.Bool("unmapped", false, "Only list icons without a mapping in the rules file")
+	output := registerOutputFlag(fs, OUTPUT_TABLE)
+	fs.Parse(args)
+	// the Ininal login is only needed to fetch transactions
+	config.noLogin, config.noVault = !*fetch, !*fetch
+	if err := config.load(fs); err != nil {
+		failConfig(err)
+	}
+	config = config.singleIdentity()
+	checkOutput(*output)
+
+	txRules, err := rules.Load(config.RulesFile)
+	if err != nil {
+		fail(EXIT_USAGE, err)
+	}
+	st, err := state.Load(config.StateFile)
+	if err != nil {
+		fail(EXIT_ERROR, err)
+	}
+
+	icons := map[string]*state.Icon{}
+	for icon, seen := range st.Icons {
+		copied := *seen
+		icons[icon] = &copied
+	}
+
+	failed := false
+	if *fetch {
+		sess := loginOrFail(config)
+		var transactions []accountTransaction
+		transactions, failed = fetchTransactions(sess, config, selectAccounts(sess, *onlyAccount))
+		for _, tx := range transactions {
+			icon := strings.TrimSpace(tx.Icon)
+			if icon == "" {
+				continue
+			}
+			seen := icons[icon]
+			if seen == nil {
+				seen = &state.Icon{}
+				icons[icon] = seen
+			}
+			widenIcon(seen, tx.Transaction)
+		}
+	}
+
+	results := []iconResult{}
+	for icon, seen := range icons {
+		result := iconResult{Icon: icon, Seen: *seen}
+		if mapping := txRules.Icon(icon); mapping != nil {
+			if *unmapped {
+				continue
+			}
+			result.Category = mapping.Category
+			if result.Category == "" && mapping.CategoryID != 0 {
+				result.Category = fmt.Sprintf("#%d", mapping.CategoryID)
+			}
+			result.Labels = mapping.Labels
+		}
+		results = append(results, result)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Icon < results[j].Icon })
+
+	t := &table{
+		header: []string{"ICON", "CATEGORY", "LABELS", "IMPORTED", "FIRST SEEN", "LAST SEEN", "EXAMPLE"},
+		data:   results,
+	}
+	for _, r := range results {
+		t.add(r.Icon, r.Category, strings.Join(r.Labels, ","), fmt.Sprint(r.Seen.Imported), formatDate(r.Seen.FirstSeen), formatDate(r.Seen.LastSeen), r.Seen.Example)
+	}
+
+	if err := t.write(os.Stdout, *output); err != nil {
+		fail(EXIT_ERROR, err)
+	}
+	if failed {
+		os.Exit(EXIT_PARTIAL)
+	}
+}
+
+// widenIcon widens the dates an icon was seen to the date of transaction
+func widenIcon(seen *state.Icon, transaction ininal.Transaction) {
+	date := transaction.TransactionDate
+	if seen.FirstSeen.IsZero() || date.Before(seen.FirstSeen) {
+		seen.FirstSeen = date
+	}
+	if !date.Before(seen.LastSeen) {
+		seen.LastSeen = date
+		seen.Example = strings.TrimSpace(transaction.Description)
+	}
+}
+
+// formatDate formats t as a date, the zero time as an empty string
+func formatDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(DATE_FORMAT)
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/dvcrn/pocketsmith-ininal/ininal"
+	"github.com/dvcrn/pocketsmith-ininal/psapi"
+	"github.com/dvcrn/pocketsmith-ininal/rules"
+	"github.com/dvcrn/pocketsmith-ininal/state"
+)
+
+// Update policies for transactions that changed in Ininal after they were imported
+const (
+	// UPDATE_OVERWRITE always writes the new Ininal data to Pocketsmith
+	UPDATE_OVERWRITE = "overwrite"
+	// UPDATE_PRESERVE_EDITS writes the new Ininal data but keeps fields that
+	// were edited in Pocketsmith since they were last written by the importer
+	UPDATE_PRESERVE_EDITS = "preserve-edits"
+	// UPDATE_NEVER never touches already imported transactions
+	UPDATE_NEVER = "never"
+)
+
+// importer adds Ininal transactions to a Pocketsmith transaction account
+type importer struct {
+	api   *psapi.Client
+	state *state.State
+
+	// stopAfterKnown is the early-stop policy: when > 0 the import stops after
+	// that many consecutive transactions (newest first) were already imported.
+	// When 0 the whole window is reconciled.
+	stopAfterKnown int
+	updatePolicy   string
+	reversalAction string
+	reversalTypes  []string
+	fxTypes        []string
+	// foreignCurrency is how transactions in another currency than their
+	// account are marked, see the FOREIGN_* constants
+	foreignCurrency string
+	labels          LabelConfig
+	templates       *transactionTemplates
+	rules           *rules.Rules
+}
+
+type importResult struct {
+	Fetched int `json:"fetched"`
+	Created int `json:"created"`
+	Updated int `json:"updated"`
+	Skipped int `json:"skipped"`
+	Failed  int `json:"failed"`
+	// Reversed is the number of reversed or disappeared transactions handled
+	Reversed int `json:"reversed"`
+	// Stopped is set when the early-stop policy ended the import before all
+	// transactions were looked at
+	Stopped bool `json:"stopped"`
+	// Uncategorized are the created transactions no category rule or icon
+	// mapping matched, only collected when there are any
+	Uncategorized []uncategorized `json:"uncategorized,omitempty"`
+	// NewIcons are the Ininal icons seen for the first time that have no mapping
+	NewIcons []string `json:"newIcons,omitempty"`
+}
+
+// uncategorized is a created transaction without category
+type uncategorized struct {
+	Date        string  `json:"date"`
+	Payee       string  `json:"payee"`
+	Amount      float64 `json:"amount"`
+	ReferenceNo string  `json:"referenceNo"`
+}
+
+// sortTransactions orders transactions newest first. Transactions on the same
+// date are ordered by reference number so the order is stable between runs.
+func sortTransactions(transactions []ininal.Transaction) {
+	sort.SliceStable(transactions, func(i, j int) bool {
+		a, b := transactions[i], transactions[j]
+		if !a.TransactionDate.Equal(b.TransactionDate) {
+			return a.TransactionDate.After(b.TransactionDate)
+		}
+		return a.ReferenceNo > b.ReferenceNo
+	})
+}
+
+// contentHash hashes the fields of an Ininal transaction that end up in Pocketsmith
+func contentHash(transaction ininal.Transaction) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%.2f\x00%s\x00%s", strings.TrimSpace(transaction.Description), transaction.Amount, transaction.Currency, transaction.TransactionType)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func amountsEqual(a, b float64) bool {
+	return math.Abs(a-b) < 0.005
+}
+
+// TRANSFER_TYPE marks bank transfers when no transfer rule matches
+const TRANSFER_TYPE = "Banka Transferi"
+
+// isTransfer classifies transaction with the transfer rules. Currency
+// exchanges are transfers between the Ininal accounts.
+func isTransfer(txRules *rules.Rules, fxTypes []string, transaction ininal.Transaction, payee string) bool {
+	if rule := txRules.Transfer(transaction, payee); rule != nil {
+		return rule.IsTransfer()
+	}
+	return strings.Contains(transaction.TransactionType, TRANSFER_TYPE) || isFXType(transaction, fxTypes)
+}
+
+// buildTransaction maps an Ininal transaction of account to a new Pocketsmith
+// transaction. feeTx is set when a fee rule splits a fee off the transaction.
+func (im *importer) buildTransaction(transaction ininal.Transaction, account ininal.AccountInfo) (createTx, feeTx *psapi.CreateTransaction, err error) {
+	payee, _ := im.rules.Payee(transaction)
+	data := templateData{Transaction: transaction, Account: account, Card: accountCard(account), Payee: payee}
+	createTx = &psapi.CreateTransaction{
+		Amount:     transaction.Amount,
+		Date:       transaction.TransactionDate.Format(DATE_FORMAT),
+		IsTransfer: isTransfer(im.rules, im.fxTypes, transaction, payee),
+	}
+	for _, field := range []struct {
+		t    *template.Template
+		dest *string
+	}{
+		{im.templates.payee, &createTx.Payee},
+		{im.templates.note, &createTx.Note},
+		{im.templates.memo, &createTx.Memo},
+		{im.templates.chequeNumber, &createTx.ChequeNumber},
+	} {
+		value, err := executeTemplate(field.t, data)
+		if err != nil {
+			return nil, nil, err
+		}
+		*field.dest = value
+	}
+	mapping := im.rules.Icon(transaction.Icon)
+	if rule := im.rules.Category(transaction, payee); rule != nil {
+		createTx.CategoryID = rule.CategoryID
+	} else if mapping != nil {
+		createTx.CategoryID = mapping.CategoryID
+	}
+	var iconLabels, foreignLabels []string
+	if mapping != nil {
+		iconLabels = mapping.Labels
+	}
+	foreign := foreignAmount(transaction, account.Currency, im.fxTypes)
+	if foreign != nil {
+		if im.foreignCurrency == FOREIGN_NOTE || im.foreignCurrency == FOREIGN_BOTH {
+			createTx.Note = appendNote(createTx.Note, foreignNote(foreign, transaction.Amount))
+		}
+		if im.foreignCurrency == FOREIGN_LABEL || im.foreignCurrency == FOREIGN_BOTH {
+			foreignLabels = []string{foreignLabel(foreign)}
+		}
+	}
+	labels := mergeLabels(im.builtinLabels(transaction, account, foreign), iconLabels, im.rules.LabelsOf(transaction, payee), foreignLabels)
+	if rule := im.rules.Fee(transaction, payee); rule != nil {
+		if !rule.Bundled() {
+			createTx.CategoryID = rule.CategoryID
+			labels = mergeLabels(labels, []string{im.labels.Fee})
+		} else if fee := rule.FeeAmount(transaction.Amount); fee > 0 {
+			feeTx = im.splitFee(createTx, transaction, rule, fee)
+		}
+	}
+	createTx.Labels = strings.Join(labels, ",")
+	return createTx, feeTx, nil
+}
+
+// seeIcon records the icon of transaction in the state. It returns true when
+// the icon was seen for the first time and has no mapping.
+func (im *importer) seeIcon(transaction ininal.Transaction, created bool) bool {
+	icon := strings.TrimSpace(transaction.Icon)
+	if icon == "" {
+		return false
+	}
+
+	seen := im.state.Icons[icon]
+	isNew := seen == nil
+	if isNew {
+		seen = &state.Icon{}
+		im.state.Icons[icon] = seen
+	}
+	widenIcon(seen, transaction)
+	if created {
+		seen.Imported++
+	}
+
+	return isNew && im.rules.Icon(icon) == nil
+}
+
+// knownImports indexes the Pocketsmith transactions of an account by the Ininal
+// reference number. The state records which transaction was created for a
+// reference number, so imports are found whatever the memo template. Older
+// imports are found by the reference number in their memo or cheque number.
+type knownImports struct {
+	imports      map[string]*state.Import
+	byID         map[int]psapi.Transaction
+	byRef        map[string]psapi.Transaction
+	transactions []psapi.Transaction
+}
+
+func newKnownImports(transactions []psapi.Transaction, imports map[string]*state.Import) *knownImports {
+	k := &knownImports{imports: imports, byID: map[int]psapi.Transaction{}, byRef: map[string]psapi.Transaction{}, transactions: transactions}
+	for _, tx := range transactions {
+		k.byID[tx.ID] = tx
+		if ref := strings.TrimSpace(tx.ChequeNumber); ref != "" {
+			k.byRef[ref] = tx
+		}
+		if ref := strings.TrimSpace(tx.Memo); ref != "" {
+			k.byRef[ref] = tx
+		}
+	}
+	return k
+}
+
+func (k *knownImports) find(ref string) (psapi.Transaction, bool) {
+	if ref == "" {
+		return psapi.Transaction{}, false
+	}
+
+	if record := k.imports[ref]; record != nil {
+		if tx, ok := k.byID[record.TransactionID]; ok {
+			return tx, true
+		}
+	}
+
+	if tx, ok := k.byRef[ref]; ok {
+		return tx, true
+	}
+
+	// the memo may have been edited in Pocketsmith, fall back to a substring
+	// match. The memo of a split off fee contains the reference number of the
+	// purchase.
+	for _, tx := range k.transactions {
+		if strings.Contains(tx.Memo, ref) && !strings.HasSuffix(strings.TrimSpace(tx.Memo), FEE_SUFFIX) {
+			return tx, true
+		}
+	}
+
+	return psapi.Transaction{}, false
+}
+
+// recordImport stores the values written to Pocketsmith for transaction of
+// account
+func (im *importer) recordImport(transactionAccountID int, account ininal.AccountInfo, transaction ininal.Transaction, written psapi.Transaction) {
+	im.state.Imports[transaction.ReferenceNo] = &state.Import{
+		TransactionID:        written.ID,
+		TransactionAccountID: transactionAccountID,
+		Hash:                 contentHash(transaction),
+		Date:                 transaction.TransactionDate,
+		Payee:                written.Payee,
+		Amount:               written.Amount,
+		Note:                 written.Note,
+		IsTransfer:           written.IsTransfer,
+		CategoryID:           categoryID(written),
+		Foreign:              foreignAmount(transaction, account.Currency, im.fxTypes),
+		RepeatActionType:     repeatType(transaction),
+		Fee:                  im.standaloneFee(transaction),
+		UpdatedAt:            time.Now(),
+	}
+}
+
+// updateTransaction brings an already imported Pocketsmith transaction in line
+// with the current Ininal data. It returns whether the transaction was changed.
+func (im *importer) updateTransaction(transactionAccountID int, account ininal.AccountInfo, transaction ininal.Transaction, existing psapi.Transaction) (bool, error) {
+	record := im.state.Imports[transaction.ReferenceNo]
+	if record == nil || record.TransactionID != existing.ID {
+		// imported before the importer kept track of it, or re-created in
+		// Pocketsmith. Take the current Pocketsmith values as the baseline.
+		im.recordImport(transactionAccountID, account, transaction, existing)
+		return false, nil
+	}
+
+	retried := false
+	if record.Fee != nil && record.Fee.Pending {
+		if err := im.retryFee(transactionAccountID, account, transaction, record, &existing); err != nil {
+			return false, err
+		}
+		retried = true
+	}
+
+	hash := contentHash(transaction)
+	if im.updatePolicy == UPDATE_NEVER || record.Hash == hash {
+		return retried, nil
+	}
+
+	desired, feeTx, err := im.buildTransaction(transaction, account)
+	if err != nil {
+		return false, err
+	}
+	if err := im.reconcileFee(record, transaction, desired, feeTx); err != nil {
+		return false, err
+	}
+	if record.TransferRef != "" {
+		// keep the link made by linkTransfers
+		desired.IsTransfer = true
+		desired.Note = appendNote(desired.Note, record.TransferNote)
+	}
+	preserve := im.updatePolicy == UPDATE_PRESERVE_EDITS
+	update := &psapi.UpdateTransaction{}
+	changed := false
+
+	// a field is only written when it differs from Pocketsmith and, with
+	// preserve-edits, when it still holds the value the importer wrote last
+	if existing.Payee != desired.Payee && (!preserve || existing.Payee == record.Payee) {
+		update.Payee = &desired.Payee
+		record.Payee = desired.Payee
+		changed = true
+	}
+	if !amountsEqual(existing.Amount, desired.Amount) && (!preserve || amountsEqual(existing.Amount, record.Amount)) {
+		update.Amount = &desired.Amount
+		record.Amount = desired.Amount
+		changed = true
+	}
+	if existing.Note != desired.Note && (!preserve || existing.Note == record.Note) {
+		update.Note = &desired.Note
+		record.Note = desired.Note
+		changed = true
+	}
+	if existing.IsTransfer != desired.IsTransfer && (!preserve || existing.IsTransfer == record.IsTransfer) {
+		update.IsTransfer = &desired.IsTransfer
+		record.IsTransfer = desired.IsTransfer
+		changed = true
+	}
+	// categories are only set, a transaction no rule matches keeps its category
+	if existingCategory := categoryID(existing); desired.CategoryID != 0 && existingCategory != desired.CategoryID && (!preserve || existingCategory == record.CategoryID) {
+		update.CategoryID = &desired.CategoryID
+		record.CategoryID = desired.CategoryID
+		changed = true
+	}
+
+	if changed && im.labels.Updated != "" {
+		if labels, added := addLabel(existing.Labels, im.labels.Updated); added {
+			update.Labels = &labels
+		}
+	}
+
+	if changed {
+		fmt.Println("Updating changed transaction: ", transaction.ReferenceNo)
+		if _, err := im.api.UpdateTransaction(existing.ID, update); err != nil {
+			return false, err
+		}
+	}
+
+	record.Hash = hash
+	record.Foreign = foreignAmount(transaction, account.Currency, im.fxTypes)
+	record.RepeatActionType = repeatType(transaction)
+	record.UpdatedAt = time.Now()
+
+	return changed || retried, nil
+}
+
+// importTransactions reconciles transactions, which were fetched from Ininal for
+// the window [since, until] of account, against the given transaction account.
+// It adds all transactions that are not in Pocketsmith yet and updates the
+// ones that changed in Ininal since they were imported.
+func (im *importer) importTransactions(transactionAccountID int, account ininal.AccountInfo, since, until time.Time, transactions []ininal.Transaction) importResult {
+	result := importResult{Fetched: len(transactions)}
+
+	// Ininal and Pocketsmith may disagree about the date around midnight, so
+	// look a bit further on both sides
+	existing, err := im.api.ListTransactions(transactionAccountID, since.AddDate(0, 0, -3), until.AddDate(0, 0, 3))
+	if err != nil {
+		fmt.Printf("Error listing existing transactions: %v\n", err)
+		result.Failed = len(transactions)
+		return result
+	}
+	known := newKnownImports(existing, im.state.Imports)
+
+	sortTransactions(transactions)
+
+	consecutiveKnown := 0
+	for i, transaction := range transactions {
+		fmt.Printf("[%d/%d] Transaction: %s (%s) from %s\n", i+1, len(transactions), transaction.Description, transaction.ReferenceNo, transaction.TransactionDate.Format(DATE_FORMAT))
+
+		if existingTx, ok := known.find(transaction.ReferenceNo); ok {
+			fmt.Println("Found existing transaction by ref number: ", transaction.ReferenceNo)
+			if im.seeIcon(transaction, false) {
+				result.NewIcons = append(result.NewIcons, strings.TrimSpace(transaction.Icon))
+			}
+
+			updated, err := im.updateTransaction(transactionAccountID, account, transaction, existingTx)
+			if err != nil {
+				fmt.Printf("Error updating transaction: %v\n", err)
+				result.Failed++
+			} else if updated {
+				result.Updated++
+			} else {
+				result.Skipped++
+			}
+
+			consecutiveKnown++
+			if im.stopAfterKnown > 0 && consecutiveKnown >= im.stopAfterKnown {
+				fmt.Printf("Found %d already imported transactions in a row, skipping the remaining %d older transactions\n", consecutiveKnown, len(transactions)-i-1)
+				result.Stopped = true
+				break
+			}
+			continue
+		}
+		consecutiveKnown = 0
+
+		createTx, feeTx, err := im.buildTransaction(transaction, account)
+		if err != nil {
+			fmt.Printf("Error building transaction: %v\n", err)
+			result.Failed++
+			continue
+		}
+
+		fmt.Println("Creating transaction with createTx: ", createTx.Payee, createTx.Amount, createTx.Date, createTx.IsTransfer, createTx.Note)
+		created, err := im.api.AddTransaction(transactionAccountID, createTx)
+		if err != nil {
+			fmt.Printf("Error creating transaction: %v\n", err)
+			result.Failed++
+			continue
+		}
+		var fee *state.Fee
+		if feeTx != nil {
+			fee, created, err = im.addFee(transactionAccountID, transaction, created, feeTx, im.feeRule(transaction).Kind)
+		}
+		if err != nil {
+			// the fee is pending, the next sync finishes the split
+			fmt.Printf("Error splitting fee: %v\n", err)
+			result.Failed++
+		} else {
+			result.Created++
+		}
+		if im.seeIcon(transaction, true) {
+			result.NewIcons = append(result.NewIcons, strings.TrimSpace(transaction.Icon))
+		}
+		if createTx.CategoryID == 0 && im.rules.Categorizes() {
+			result.Uncategorized = append(result.Uncategorized, uncategorized{
+				Date:        createTx.Date,
+				Payee:       createTx.Payee,
+				Amount:      createTx.Amount,
+				ReferenceNo: transaction.ReferenceNo,
+			})
+		}
+
+		known.byID[created.ID] = *created
+		known.byRef[transaction.ReferenceNo] = *created
+		im.recordImport(transactionAccountID, account, transaction, *created)
+		if fee != nil {
+			im.state.Imports[transaction.ReferenceNo].Fee = fee
+		}
+	}
+
+	if err := im.state.Save(); err != nil {
+		fmt.Printf("Error saving state: %v\n", err)
+	}
+
+	return result
+}
+
+// syncTransactions imports transactions fetched for the window [since, until]
+// and handles reversals among them. complete reports whether Ininal returned
+// all transactions of the window, only then transactions missing from the
+// list are treated as disappeared.
+func (im *importer) syncTransactions(transactionAccountID int, account ininal.AccountInfo, since, until time.Time, transactions []ininal.Transaction, complete bool) importResult {
+	reversals := detectReversals(transactions, im.reversalTypes)
+	if complete {
+		reversals = append(reversals, detectDisappeared(im.state, transactionAccountID, since, until, transactions)...)
+	}
+
+	toImport := transactions
+	if im.reversalAction == REVERSAL_DELETE {
+		toImport = excludeReversed(im.state, transactions, reversals)
+	}
+
+	result := im.importTransactions(transactionAccountID, account, since, until, toImport)
+	result.Fetched = len(transactions)
+	result.Reversed = im.handleReversals(transactionAccountID, since, until, reversals)
+
+	return result
+}
@@ -6,13 +6,20 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"os"
+	"strings"
 	"time"
+
+	"github.com/dvcrn/pocketsmith-ininal/metrics"
 )
 
 const (
 	BaseURL = "https://api.ininal.com/v3.0"
 )
 
+// Location is the time zone Ininal dates transactions in and filters them by
+var Location = time.FixedZone("TRT", 3*60*60)
+
 type UserDetails struct {
 	Name                       string        `json:"name"`
 	Surname                    string        `json:"surname"`
@@ -54,7 +61,7 @@ type CardAccount struct {
 	CashdrawBlockedAmount    float64       `json:"cashdrawBlockedAmount"`
 	AvailableCashdrawAmount  float64       `json:"availableCashdrawAmount"`
 	AccountListResponse      []AccountInfo `json:"accountListResponse"`
-	AccessToken              string        `json:"accessToken`
+	AccessToken              string        `json:"accessToken"`
 }
 
 type AccountInfo struct {
@@ -71,6 +78,15 @@ type AccountInfo struct {
 	AvailableBalance float64    `json:"availableBalance"`
 }
 
+// IsClosed reports whether the account was closed and can no longer be used
+func (a AccountInfo) IsClosed() bool {
+	switch strings.ToUpper(a.AccountStatus) {
+	case "CLOSED", "CANCELLED", "CANCELED", "TERMINATED", "DELETED":
+		return true
+	}
+	return false
+}
+
 type CardInfo struct {
 	CardId        int    `json:"cardId"`
 	ProductCode   string `json:"productCode"`
@@ -81,6 +97,26 @@ type CardInfo struct {
 	CardToken     string `json:"cardToken"`
 }
 
+// IsBlocked reports whether the card can't be used for payments
+func (c CardInfo) IsBlocked() bool {
+	switch strings.ToUpper(c.CardStatus) {
+	case "BLOCKED", "LOST", "STOLEN", "SUSPENDED", "FRAUD", "CLOSED", "CANCELLED", "CANCELED", "EXPIRED":
+		return true
+	}
+	return false
+}
+
+// LastDigits returns the last four digits of the card number
+func (c CardInfo) LastDigits() string {
+	if len(c.CardNumber) <= 4 {
+		return c.CardNumber
+	}
+	return c.CardNumber[len(c.CardNumber)-4:]
+}
+
+// Transaction is an Ininal transaction. Amount is in the currency of the
+// account, Currency is the currency the transaction was made in, like USD for
+// an online purchase abroad with a TRY card.
 type Transaction struct {
 	TransactionDate  time.Time `json:"transactionDate"`
 	Description      string    `json:"description"`
@@ -93,11 +129,15 @@ type Transaction struct {
 }
 type Client struct {
 	httpClient *http.Client
+
+	// Log receives the debug output of the client, stderr by default
+	Log io.Writer
 }
 
 func NewClient() *Client {
 	return &Client{
-		httpClient: &http.Client{},
+		httpClient: metrics.NewClient("ininal"),
+		Log:        os.Stderr,
 	}
 }
 
@@ -118,7 +158,7 @@ func (c *Client) GetUserDetails(userToken, authToken string) (*UserDetails, erro
 	req.Header.Set("Accept-Language", "en-US;q=1.0, ja-US;q=0.9, de-US;q=0.8")
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.httpClient.Do(metrics.WithEndpoint(req, "user_details"))
 	if err != nil {
 		return nil, err
 	}
@@ -172,12 +212,7 @@ func (c *Client) Login(password, deviceID, loginCredential, loginToken string, b
 		Token:           loginToken,
 	}
 
-	fmt.Println("logging in with")
-	fmt.Println("password:", password)
-	fmt.Println("deviceID:", deviceID)
-	fmt.Println("loginCredential:", loginCredential)
-	fmt.Println("token:", loginToken)
-	fmt.Println("bearer:", bearerToken)
+	fmt.Fprintln(c.Log, "logging in with device ID", deviceID)
 
 	reqBody, err := json.Marshal(req)
 	if err != nil {
@@ -196,7 +231,7 @@ func (c *Client) Login(password, deviceID, loginCredential, loginToken string, b
 	request.Header.Set("Content-Language", "en")
 	request.Header.Set("User-Agent", "ininal/3.7.6 (com.ngier.ininalwallet; build:2; iOS 18.2.0) Alamofire/5.4.4")
 
-	resp, err := c.httpClient.Do(request)
+	resp, err := c.httpClient.Do(metrics.WithEndpoint(request, "login"))
 	if err != nil {
 		return nil, fmt.Errorf("failed to send request: %v", err)
 	}
@@ -233,7 +268,7 @@ func (c *Client) Verify(otp, token string, bearerToken string) (*LoginResponse,
 	request.Header.Set("Content-Language", "en")
 	request.Header.Set("User-Agent", "ininal/3.7.6 (com.ngier.ininalwallet; build:2; iOS 18.2.0) Alamofire/5.4.4")
 
-	resp, err := c.httpClient.Do(request)
+	resp, err := c.httpClient.Do(metrics.WithEndpoint(request, "login_verify"))
 	if err != nil {
 		return nil, fmt.Errorf("failed to send request: %v", err)
 	}
@@ -258,10 +293,7 @@ func (c *Client) generateDeviceSignature(deviceID string) (string, error) {
 func (c *Client) GetUserCardAccount(deviceID, userToken, authToken string) (*CardAccount, error) {
 	url := fmt.Sprintf("https://api.ininal.com/v3.2/users/%s/cardaccount", userToken)
 
-	fmt.Println("Getting card account for user token:", userToken)
-	fmt.Println("Auth token:", authToken)
-	fmt.Println("URL:", url)
-	fmt.Println("Device ID:", deviceID)
+	fmt.Fprintln(c.Log, "Getting card account for device ID:", deviceID)
 
 	reqBody, err := json.Marshal(map[string]string{
 		"deviceId": deviceID,
@@ -284,36 +316,29 @@ func (c *Client) GetUserCardAccount(deviceID, userToken, authToken string) (*Car
 	req.Header.Set("Connection", "keep-alive")
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.httpClient.Do(metrics.WithEndpoint(req, "card_account"))
 	if err != nil {
 		return nil, fmt.Errorf("failed to send request: %v", err)
 	}
 	defer resp.Body.Close()
 
-	// copy body into a separate buffer
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %v", err)
-	}
-	// create a new buffer with the copied body
-	resp.Body = io.NopCloser(bytes.NewBuffer(body))
-
-	// print body
-	fmt.Println(string(body))
-
 	var result CardAccountResponse
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
 		return nil, fmt.Errorf("failed to decode response: %v", err)
 	}
 
+	// an expired session is reported with an error status
+	if resp.StatusCode != http.StatusOK || (result.HttpCode != 0 && result.HttpCode != http.StatusOK) {
+		return nil, fmt.Errorf("failed to get card account: %d %s", resp.StatusCode, result.Description)
+	}
+
 	return &result.Response, nil
 }
 
 func (c *Client) GetUserTransactions(userToken, authToken, accountID string, startDate, endDate time.Time, resultLimit int) ([]Transaction, error) {
 	url := fmt.Sprintf("https://api.ininal.com/v3.1/users/%s/transactions/%s", userToken, accountID)
 
-	fmt.Println(url)
-	fmt.Println(authToken)
+	fmt.Fprintln(c.Log, "Getting transactions of account", accountID)
 
 	if resultLimit == 0 {
 		resultLimit = 3
@@ -341,7 +366,7 @@ func (c *Client) GetUserTransactions(userToken, authToken, accountID string, sta
 	req.Header.Set("Connection", "keep-alive")
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.httpClient.Do(metrics.WithEndpoint(req, "transactions"))
 	if err != nil {
 		return nil, fmt.Errorf("failed to send request: %v", err)
 	}
@@ -428,22 +453,12 @@ func (c *Client) GetCustomerDetails(userToken, authToken string) (*CustomerDetai
 	req.Header.Set("Connection", "keep-alive")
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.httpClient.Do(metrics.WithEndpoint(req, "customer_details"))
 	if err != nil {
 		return nil, fmt.Errorf("failed to send request: %v", err)
 	}
 	defer resp.Body.Close()
 
-	// copy body and print it out
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %v", err)
-	}
-	fmt.Println(string(body))
-
-	// put the body back into the response body
-	resp.Body = io.NopCloser(bytes.NewBuffer(body))
-
 	var result struct {
 		HTTPCode    int             `json:"httpCode"`
 		Description string          `json:"description"`
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/dvcrn/pocketsmith-ininal/ininal"
+	"github.com/dvcrn/pocketsmith-ininal/psapi"
+	"github.com/dvcrn/pocketsmith-ininal/state"
+)
+
+// The commands in this file only read from Ininal and never write to Pocketsmith
+
+// loginOrFail returns a session or exits
+func loginOrFail(config *Config) *session {
+	sess, err := login(config)
+	if err != nil {
+		fail(EXIT_ERROR, fmt.Errorf("failed to log into Ininal: %v", err))
+	}
+	return sess
+}
+
+// selectAccounts returns the Ininal accounts to look at, all of them when
+// numberOrIban is empty
+func selectAccounts(sess *session, numberOrIban string) []ininal.AccountInfo {
+	if numberOrIban == "" {
+		return sess.cardAccount.AccountListResponse
+	}
+
+	account, ok := sess.findAccount(numberOrIban)
+	if !ok {
+		fail(EXIT_USAGE, fmt.Errorf("no Ininal account with account number or IBAN %s", numberOrIban))
+	}
+	return []ininal.AccountInfo{account}
+}
+
+func runAccounts(args []string) {
+	fs := flag.NewFlagSet("accounts", flag.ExitOnError)
+	config := registerConfigFlags(fs)
+	output := registerOutputFlag(fs, OUTPUT_TABLE)
+	config.parse(fs, args)
+	config = config.singleIdentity()
+	checkOutput(*output)
+
+	sess := loginOrFail(config)
+
+	t := &table{
+		header: []string{"NUMBER", "NAME", "CURRENCY", "STATUS", "BALANCE", "AVAILABLE", "IBAN", "CARDS"},
+		data:   sess.cardAccount.AccountListResponse,
+	}
+	for _, account := range sess.cardAccount.AccountListResponse {
+		var cards []string
+		for _, card := range account.CardListResponse {
+			cards = append(cards, fmt.Sprintf("%s (%s)", card.LastDigits(), card.CardStatus))
+		}
+		t.add(account.AccountNumber, account.AccountName, account.Currency, account.AccountStatus, formatAmount(account.AccountBalance), formatAmount(account.AvailableBalance), account.Iban, strings.Join(cards, ", "))
+	}
+
+	if err := t.write(os.Stdout, *output); err != nil {
+		fail(EXIT_ERROR, err)
+	}
+}
+
+// accountTransaction is an Ininal transaction together with its account
+type accountTransaction struct {
+	AccountNumber string `json:"accountNumber"`
+	ininal.Transaction
+}
+
+// fetchTransactions fetches the transactions of the config window for accounts.
+// Accounts that fail are reported and skipped, failed tells whether any did.
+func fetchTransactions(sess *session, config *Config, accounts []ininal.AccountInfo) (transactions []accountTransaction, failed bool) {
+	for _, account := range accounts {
+		fetched, err := sess.transactions(account.AccountNumber, config.Since, config.Until, config.ResultLimit)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error fetching transactions of account %s: %v\n", account.AccountNumber, err)
+			failed = true
+			continue
+		}
+		if len(fetched) >= config.ResultLimit {
+			fmt.Fprintf(os.Stderr, "Warning: account %s returned %d transactions which is the limit, older transactions may be missing\n", account.AccountNumber, len(fetched))
+		}
+
+		sortTransactions(fetched)
+		for _, transaction := range fetched {
+			transactions = append(transactions, accountTransaction{AccountNumber: account.AccountNumber, Transaction: transaction})
+		}
+	}
+	return transactions, failed
+}
+
+func runTransactions(args []string) {
+	fs := flag.NewFlagSet("transactions", flag.ExitOnError)
+	config := registerConfigFlags(fs)
+	registerWindowFlags(fs, config)
+	onlyAccount := fs.String("account", "", "Only list the transactions of the Ininal account with this account number or IBAN")
+	output := registerOutputFlag(fs, OUTPUT_TABLE)
+	config.parse(fs, args)
+	config = config.singleIdentity()
+	checkOutput(*output)
+
+	sess := loginOrFail(config)
+	transactions, failed := fetchTransactions(sess, config, selectAccounts(sess, *onlyAccount))
+
+	t := &table{
+		header: []string{"DATE", "ACCOUNT", "REFERENCE", "DESCRIPTION", "TYPE", "AMOUNT", "CURRENCY"},
+		data:   transactions,
+	}
+	for _, tx := range transactions {
+		t.add(tx.TransactionDate.Format(DATE_FORMAT), tx.AccountNumber, tx.ReferenceNo, strings.TrimSpace(tx.Description), tx.TransactionType, formatAmount(tx.Amount), tx.Currency)
+	}
+
+	if err := t.write(os.Stdout, *output); err != nil {
+		fail(EXIT_ERROR, err)
+	}
+	if failed {
+		os.Exit(EXIT_PARTIAL)
+	}
+}
+
+func runExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	config := registerConfigFlags(fs)
+	registerWindowFlags(fs, config)
+	onlyAccount := fs.String("account", "", "Only export the transactions of the Ininal account with this account number or IBAN")
+	output := fs.String("o", OUTPUT_CSV, "Output format: csv or json")
+	outFile := fs.String("out", "", "File to write the export to, stdout when empty")
+	config.parse(fs, args)
+	config = config.singleIdentity()
+
+	if *output != OUTPUT_CSV && *output != OUTPUT_JSON {
+		fail(EXIT_USAGE, fmt.Errorf("unknown export format %q, expected csv or json", *output))
+	}
+
+	sess := loginOrFail(config)
+	transactions, failed := fetchTransactions(sess, config, selectAccounts(sess, *onlyAccount))
+
+	t := &table{
+		header: []string{"date", "account_number", "reference_no", "description", "transaction_type", "amount", "currency", "icon", "repeat_action_type"},
+		data:   transactions,
+	}
+	for _, tx := range transactions {
+		t.add(tx.TransactionDate.Format(DATE_FORMAT), tx.AccountNumber, tx.ReferenceNo, strings.TrimSpace(tx.Description), tx.TransactionType, formatAmount(tx.Amount), tx.Currency, tx.Icon, tx.RepeatActionType)
+	}
+
+	var w io.Writer = os.Stdout
+	if *outFile != "" {
+		f, err := os.Create(*outFile)
+		if err != nil {
+			fail(EXIT_ERROR, fmt.Errorf("failed to create export file: %v", err))
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if err := t.write(w, *output); err != nil {
+		fail(EXIT_ERROR, fmt.Errorf("failed to write export: %v", err))
+	}
+	if *outFile != "" {
+		fmt.Fprintf(os.Stderr, "Exported %d transactions to %s\n", len(transactions), *outFile)
+	}
+	if failed {
+		os.Exit(EXIT_PARTIAL)
+	}
+}
+
+// accountBalance is a row of the balance command
+type accountBalance struct {
+	AccountNumber    string  `json:"accountNumber"`
+	AccountName      string  `json:"accountName"`
+	Currency         string  `json:"currency"`
+	Balance          float64 `json:"balance"`
+	AvailableBalance float64 `json:"availableBalance"`
+
+	// the Pocketsmith side is only filled in with -compare
+	PocketsmithBalance *float64 `json:"pocketsmithBalance,omitempty"`
+	Difference         *float64 `json:"difference,omitempty"`
+	Error              string   `json:"error,omitempty"`
+}
+
+func runBalance(args []string) {
+	fs := flag.NewFlagSet("balance", flag.ExitOnError)
+	config := registerConfigFlags(fs)
+	registerPocketsmithFlags(fs, config, false)
+	compare := fs.Bool("compare", false, "Compare with the running balance of the synced Pocketsmith accounts (read only)")
+	output := registerOutputFlag(fs, OUTPUT_TABLE)
+	config.parse(fs, args)
+	config = config.singleIdentity()
+	checkOutput(*output)
+
+	if *compare && config.PocketsmithToken == "" {
+		fail(EXIT_USAGE, fmt.Errorf("-compare needs the Pocketsmith token"))
+	}
+
+	var im *importer
+	if *compare {
+		st, err := state.Load(config.StateFile)
+		if err != nil {
+			fail(EXIT_ERROR, err)
+		}
+		im = &importer{api: psapi.NewClient(config.PocketsmithToken), state: st}
+	}
+
+	sess := loginOrFail(config)
+
+	var balances []*accountBalance
+	failed := false
+	for _, account := range sess.cardAccount.AccountListResponse {
+		b := &accountBalance{
+			AccountNumber:    account.AccountNumber,
+			AccountName:      account.AccountName,
+			Currency:         account.Currency,
+			Balance:          account.AccountBalance,
+			AvailableBalance: account.AvailableBalance,
+		}
+		balances = append(balances, b)
+
+		if im == nil {
+			continue
+		}
+		known := im.state.Accounts[account.AccountNumber]
+		if known == nil || known.TransactionAccountID == 0 {
+			b.Error = "not synced yet"
+			continue
+		}
+		check, err := im.checkBalance(known.TransactionAccountID, account, nil, config.OpeningBalance)
+		if err != nil {
+			b.Error = err.Error()
+			failed = true
+			continue
+		}
+		b.PocketsmithBalance = &check.PocketsmithBalance
+		b.Difference = &check.Difference
+	}
+
+	t := &table{
+		header: []string{"ACCOUNT", "NAME", "CURRENCY", "BALANCE", "AVAILABLE"},
+		data:   balances,
+	}
+	if *compare {
+		t.header = append(t.header, "POCKETSMITH", "DIFFERENCE", "ERROR")
+	}
+	for _, b := range balances {
+		row := []string{b.AccountNumber, b.AccountName, b.Currency, formatAmount(b.Balance), formatAmount(b.AvailableBalance)}
+		if *compare {
+			pocketsmith, difference := "", ""
+			if b.PocketsmithBalance != nil {
+				pocketsmith, difference = formatAmount(*b.PocketsmithBalance), formatAmount(*b.Difference)
+			}
+			row = append(row, pocketsmith, difference, b.Error)
+		}
+		t.add(row...)
+	}
+
+	if err := t.write(os.Stdout, *output); err != nil {
+		fail(EXIT_ERROR, err)
+	}
+	if failed {
+		os.Exit(EXIT_PARTIAL)
+	}
+}
+
+func runProfile(args []string) {
+	fs := flag.NewFlagSet("profile", flag.ExitOnError)
+	config := registerConfigFlags(fs)
+	output := registerOutputFlag(fs, OUTPUT_TABLE)
+	config.parse(fs, args)
+	config = config.singleIdentity()
+	checkOutput(*output)
+
+	sess := loginOrFail(config)
+
+	details, err := sess.client.GetUserDetails(sess.userToken, sess.userAuth)
+	if err != nil {
+		fail(EXIT_ERROR, fmt.Errorf("failed to get user details: %v", err))
+	}
+
+	t := &table{header: []string{"FIELD", "VALUE"}, data: details}
+	t.add("Name", strings.TrimSpace(details.Name+" "+details.Surname))
+	t.add("Email", details.Email)
+	t.add("Phone", details.GsmNumber)
+	t.add("Status", details.UserStatusText)
+	t.add("KYC status", details.KycStatus)
+	t.add("Total card balance", formatAmount(details.TotalActiveCardBalance))
+	t.add("Loadable limit", formatAmount(details.LoadableLimit))
+	t.add("Monthly loadable limit", formatAmount(details.MonthlyLoadableLimit))
+	t.add("Cash withdraw limit", formatAmount(details.CashWithdrawLimit))
+
+	if err := t.write(os.Stdout, *output); err != nil {
+		fail(EXIT_ERROR, err)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/dvcrn/pocketsmith-ininal/ininal"
+	"github.com/dvcrn/pocketsmith-ininal/state"
+)
+
+// The default labels
+const (
+	SOURCE_LABEL  = "ininal"
+	FX_LABEL      = "fx"
+	FEE_LABEL     = "fee"
+	UPDATED_LABEL = "updated"
+)
+
+// LabelConfig holds the labels the importer adds besides the ones of the
+// rules. Empty labels are not added.
+type LabelConfig struct {
+	// Source is added to every imported transaction so imported data can be
+	// filtered
+	Source string `yaml:"source"`
+	// CardType adds the lower case type of the card of the account, like
+	// virtual
+	CardType bool `yaml:"card_type"`
+	// FX is added to currency exchanges and transactions in a foreign currency
+	FX string `yaml:"fx"`
+	// Fee is added to fees and the transactions fees were split off into
+	Fee string `yaml:"fee"`
+	// Recurring is added to payments Ininal marks as recurring
+	Recurring string `yaml:"recurring"`
+	// Updated is added when the importer updates a transaction that changed
+	// in Ininal
+	Updated string `yaml:"updated"`
+	// Reversed is added to reversed and disappeared transactions with the
+	// label and note reversal actions
+	Reversed string `yaml:"reversed"`
+}
+
+// cleanLabel turns s into a label Pocketsmith can store, they are sent as a
+// comma separated list
+func cleanLabel(s string) string {
+	return strings.Join(strings.Fields(strings.ReplaceAll(s, ",", " ")), " ")
+}
+
+// mergeLabels joins the label lists, dropping empty and repeated labels
+func mergeLabels(lists ...[]string) []string {
+	var labels []string
+	seen := map[string]bool{}
+	for _, list := range lists {
+		for _, label := range list {
+			if label = cleanLabel(label); label == "" || seen[label] {
+				continue
+			}
+			seen[label] = true
+			labels = append(labels, label)
+		}
+	}
+	return labels
+}
+
+// builtinLabels are the labels of LabelConfig that apply to transaction of
+// account. foreign is the original amount of transaction, or nil.
+func (im *importer) builtinLabels(transaction ininal.Transaction, account ininal.AccountInfo, foreign *state.Foreign) []string {
+	labels := []string{im.labels.Source}
+	if im.labels.CardType {
+		labels = append(labels, strings.ToLower(accountCard(account).CardType))
+	}
+	if foreign != nil || isFXType(transaction, im.fxTypes) {
+		labels = append(labels, im.labels.FX)
+	}
+	if repeatType(transaction) != "" {
+		labels = append(labels, im.labels.Recurring)
+	}
+	return labels
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dvcrn/pocketsmith-go"
+	"github.com/dvcrn/pocketsmith-ininal/ininal"
+	"github.com/dvcrn/pocketsmith-ininal/metrics"
+)
+
+var (
+	transactionsMetric = metrics.NewCounter(
+		"ininal_importer_transactions_total",
+		"Transactions handled by the sync per account and result: fetched, created, updated, skipped, failed or reversed",
+		"identity", "account", "result",
+	)
+	balanceMetric = metrics.NewGauge(
+		"ininal_importer_account_balance",
+		"Ininal balance of the account at the last sync",
+		"identity", "account", "currency",
+	)
+	availableBalanceMetric = metrics.NewGauge(
+		"ininal_importer_account_available_balance",
+		"Available Ininal balance of the account at the last sync",
+		"identity", "account", "currency",
+	)
+	loginsMetric = metrics.NewCounter(
+		"ininal_importer_logins_total",
+		"Ininal logins without a cached session by result: success or failure",
+		"identity", "result",
+	)
+	otpMetric = metrics.NewCounter(
+		"ininal_importer_otp_requests_total",
+		"OTPs requested from the OTP provider",
+		"identity", "provider",
+	)
+	syncRunsMetric = metrics.NewCounter(
+		"ininal_importer_sync_runs_total",
+		"Sync runs by result: success or failure",
+		"result",
+	)
+	lastSuccessMetric = metrics.NewGauge(
+		"ininal_importer_last_success_timestamp_seconds",
+		"Unix time of the end of the last sync run without failures",
+	)
+)
+
+func recordBalance(config *Config, account ininal.AccountInfo) {
+	balanceMetric.Set(account.AccountBalance, config.Identity, account.AccountNumber, account.Currency)
+	availableBalanceMetric.Set(account.AvailableBalance, config.Identity, account.AccountNumber, account.Currency)
+}
+
+// recordPocketsmith adds a call of pocketsmith-go that started at start to the
+// request metrics, the library doesn't let its HTTP client be replaced. Not
+// found is an answer of the API, not a failed request.
+func recordPocketsmith(endpoint string, start time.Time, err error) {
+	status := "ok"
+	if err != nil && err != pocketsmith.ErrNotFound {
+		status = "error"
+	}
+	metrics.Observe("pocketsmith", endpoint, status, time.Since(start))
+}
+
+func recordLogin(config *Config, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	loginsMetric.Inc(config.Identity, result)
+}
+
+// recordRun adds the outcome of a sync run to the metrics
+func recordRun(report *runReport) {
+	for _, identity := range report.Identities {
+		for _, account := range identity.Accounts {
+			if account.Result == nil {
+				continue
+			}
+			result := account.Result
+			for name, count := range map[string]int{
+				"fetched":  result.Fetched,
+				"created":  result.Created,
+				"updated":  result.Updated,
+				"skipped":  result.Skipped,
+				"failed":   result.Failed,
+				"reversed": result.Reversed,
+			} {
+				transactionsMetric.Add(float64(count), identity.Identity, account.AccountNumber, name)
+			}
+		}
+	}
+
+	if report.failed() {
+		syncRunsMetric.Inc("failure")
+		return
+	}
+	syncRunsMetric.Inc("success")
+	lastSuccessMetric.Set(float64(report.FinishedAt.Unix()))
+}
+
+// writeMetricsFile writes the metrics to path for the textfile collector of
+// the Prometheus node exporter, replacing the file atomically
+func writeMetricsFile(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create metrics file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := metrics.Default.Write(tmp); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write metrics file: %v", err)
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write metrics file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write metrics file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace metrics file: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	requests = NewCounter(
+		"ininal_importer_requests_total",
+		"API requests sent to Ininal and Pocketsmith by endpoint and HTTP status",
+		"service", "endpoint", "status",
+	)
+	requestDuration = NewHistogram(
+		"ininal_importer_request_duration_seconds",
+		"Latency of the API requests sent to Ininal and Pocketsmith",
+		DEFAULT_BUCKETS,
+		"service", "endpoint", "status",
+	)
+)
+
+type endpointKey struct{}
+
+// WithEndpoint names the endpoint of req in the request metrics. The URL isn't
+// used because it contains IDs and tokens.
+func WithEndpoint(req *http.Request, endpoint string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), endpointKey{}, endpoint))
+}
+
+// Transport counts and times the requests of an API client
+type Transport struct {
+	// Service is the name of the API, like ininal
+	Service string
+	// Next sends the requests, http.DefaultTransport when nil
+	Next http.RoundTripper
+}
+
+// NewClient returns an HTTP client recording its requests as service
+func NewClient(service string) *http.Client {
+	return &http.Client{Transport: &Transport{Service: service}}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.Next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	endpoint, _ := req.Context().Value(endpointKey{}).(string)
+	if endpoint == "" {
+		endpoint = "unknown"
+	}
+
+	start := time.Now()
+	resp, err := next.RoundTrip(req)
+
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	Observe(t.Service, endpoint, status, time.Since(start))
+
+	return resp, err
+}
+
+// Observe records a request that took duration in the request metrics. It is
+// used for requests sent by libraries that don't accept an HTTP client, which
+// record the status "ok" or "error" when the HTTP status isn't known.
+func Observe(service, endpoint, status string, duration time.Duration) {
+	requests.Inc(service, endpoint, status)
+	requestDuration.Observe(duration.Seconds(), service, endpoint, status)
+}
@@ -0,0 +1,171 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func written(t *testing.T, m metric) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := m.write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func expectPanic(t *testing.T, name string, f func()) {
+	t.Helper()
+	defer func() {
+		if recover() == nil {
+			t.Errorf("%s: expected a panic", name)
+		}
+	}()
+	f()
+}
+
+func TestCounter(t *testing.T) {
+	c := NewCounter("test_counter_total", "A counter\nover two lines", "account", "result")
+	c.Inc("2", "created")
+	c.Add(2.5, "1", "created")
+	c.Inc("1", "created")
+	c.Add(0, "1", "failed")
+
+	expected := `# HELP test_counter_total A counter\nover two lines
+# TYPE test_counter_total counter
+test_counter_total{account="1",result="created"} 3.5
+test_counter_total{account="1",result="failed"} 0
+test_counter_total{account="2",result="created"} 1
+`
+	if got := written(t, c); got != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, got)
+	}
+}
+
+func TestGauge(t *testing.T) {
+	g := NewGauge("test_gauge", "A gauge")
+	if got := written(t, g); got != "" {
+		t.Errorf("expected a gauge without values to be left out, got\n%s", got)
+	}
+
+	g.Set(1.5)
+	g.Set(-1729.25)
+	expected := `# HELP test_gauge A gauge
+# TYPE test_gauge gauge
+test_gauge -1729.25
+`
+	if got := written(t, g); got != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, got)
+	}
+}
+
+func TestLabelEscaping(t *testing.T) {
+	g := NewGauge("test_escaping", `Help with a \ backslash`, "name")
+	g.Set(1, "Ininal \"Main\"\nC:\\")
+
+	expected := `# HELP test_escaping Help with a \\ backslash
+# TYPE test_escaping gauge
+test_escaping{name="Ininal \"Main\"\nC:\\"} 1
+`
+	if got := written(t, g); got != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, got)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram("test_duration_seconds", "A histogram", []float64{0.1, 1}, "endpoint")
+	h.Observe(0.05, "GET /me")
+	h.Observe(0.1, "GET /me")
+	h.Observe(0.5, "GET /me")
+	h.Observe(3, "GET /me")
+
+	expected := `# HELP test_duration_seconds A histogram
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{endpoint="GET /me",le="0.1"} 2
+test_duration_seconds_bucket{endpoint="GET /me",le="1"} 3
+test_duration_seconds_bucket{endpoint="GET /me",le="+Inf"} 4
+test_duration_seconds_sum{endpoint="GET /me"} 3.65
+test_duration_seconds_count{endpoint="GET /me"} 4
+`
+	if got := written(t, h); got != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, got)
+	}
+}
+
+func TestMisuse(t *testing.T) {
+	c := NewCounter("test_misuse_total", "Misused", "service")
+	expectPanic(t, "too few label values", func() { c.Inc() })
+	expectPanic(t, "too many label values", func() { c.Inc("ininal", "extra") })
+	expectPanic(t, "negative counter delta", func() { c.Add(-1, "ininal") })
+
+	if got := written(t, c); got != "" {
+		t.Errorf("expected no series after misuse, got\n%s", got)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	r := &Registry{}
+	g := NewGauge("test_registry_b", "Second")
+	c := NewCounter("test_registry_a_total", "First")
+	r.register(g)
+	r.register(c)
+	g.Set(2)
+	c.Inc()
+
+	var buf bytes.Buffer
+	if err := r.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	// metrics are written in the order they were registered
+	expected := `# HELP test_registry_b Second
+# TYPE test_registry_b gauge
+test_registry_b 2
+# HELP test_registry_a_total First
+# TYPE test_registry_a_total counter
+test_registry_a_total 1
+`
+	if got := buf.String(); got != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, got)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &Transport{Service: "test"}}
+	req, _ := http.NewRequest("GET", server.URL+"/users/42", nil)
+	resp, err := client.Do(WithEndpoint(req, "GET /users/:id"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	req, _ = http.NewRequest("GET", server.URL, nil)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	Observe("test", "GET /me", "ok", 0)
+
+	got := written(t, requests)
+	for _, line := range []string{
+		`ininal_importer_requests_total{service="test",endpoint="GET /users/:id",status="404"} 1`,
+		`ininal_importer_requests_total{service="test",endpoint="unknown",status="404"} 1`,
+		`ininal_importer_requests_total{service="test",endpoint="GET /me",status="ok"} 1`,
+	} {
+		if !strings.Contains(got, line+"\n") {
+			t.Errorf("expected %s in\n%s", line, got)
+		}
+	}
+	if got := written(t, requestDuration); !strings.Contains(got, `ininal_importer_request_duration_seconds_count{service="test",endpoint="GET /me",status="ok"} 1`) {
+		t.Errorf("expected the GET /me request in the durations, got\n%s", got)
+	}
+}
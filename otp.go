@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// OTP providers
+const (
+	// OTP_PROMPT asks for the OTP on the terminal
+	OTP_PROMPT = "prompt"
+	// OTP_COMMAND runs a command that prints the OTP, for example a script
+	// reading forwarded SMS
+	OTP_COMMAND = "command"
+	// OTP_FILE waits until the OTP is written to a file
+	OTP_FILE = "file"
+	// OTP_API waits until the OTP is posted to the /otp endpoint of the daemon
+	// API. Outside of the daemon it falls back to the prompt.
+	OTP_API = "api"
+)
+
+func (o OTPConfig) validate() error {
+	switch o.Provider {
+	case OTP_PROMPT, OTP_API:
+	case OTP_COMMAND:
+		if o.Command == "" {
+			return fmt.Errorf("the command OTP provider needs otp.command")
+		}
+	case OTP_FILE:
+		if o.Path == "" {
+			return fmt.Errorf("the file OTP provider needs otp.path")
+		}
+	default:
+		return fmt.Errorf("OTP provider must be one of prompt, command, file or api, got %q", o.Provider)
+	}
+	if o.Timeout < 0 {
+		return fmt.Errorf("OTP timeout must not be negative")
+	}
+	return nil
+}
+
+// readOTP obtains the OTP sent by Ininal for the login of config
+func readOTP(config *Config) (string, error) {
+	otpMetric.Inc(config.Identity, config.OTP.Provider)
+
+	switch config.OTP.Provider {
+	case OTP_COMMAND:
+		return commandOTP(config)
+	case OTP_FILE:
+		return fileOTP(config)
+	case OTP_API:
+		if apiOTPs != nil {
+			return apiOTPs.wait(config)
+		}
+		return promptOTP(config)
+	default:
+		return promptOTP(config)
+	}
+}
+
+func promptOTP(config *Config) (string, error) {
+	if config.Identity != "" {
+		fmt.Fprintf(os.Stderr, "Please enter the OTP code sent to the phone of %s:\n", config.Identity)
+	} else {
+		fmt.Fprintln(os.Stderr, "Please enter the OTP code sent to your phone:")
+	}
+
+	var otp string
+	if _, err := fmt.Scanln(&otp); err != nil {
+		return "", fmt.Errorf("failed to read OTP: %v", err)
+	}
+	return otp, nil
+}
+
+// commandOTP runs the OTP command with sh. The identity and phone number are
+// passed in ININAL_IDENTITY and ININAL_LOGIN_CREDENTIAL.
+func commandOTP(config *Config) (string, error) {
+	cmd := exec.Command("sh", "-c", config.OTP.Command)
+	cmd.Env = append(os.Environ(), "ININAL_IDENTITY="+config.Identity, "ININAL_LOGIN_CREDENTIAL="+config.LoginCredential)
+	cmd.Stderr = os.Stderr
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("failed to run OTP command: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	var timeout <-chan time.Time
+	if config.OTP.Timeout > 0 {
+		timeout = time.After(config.OTP.Timeout)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return "", fmt.Errorf("failed to run OTP command: %v", err)
+		}
+	case <-timeout:
+		cmd.Process.Kill()
+		return "", fmt.Errorf("OTP command did not finish within %s", config.OTP.Timeout)
+	}
+
+	otp := strings.TrimSpace(out.String())
+	if otp == "" {
+		return "", fmt.Errorf("OTP command printed nothing")
+	}
+	return otp, nil
+}
+
+// fileOTP waits for the OTP file to appear and removes it once it was read,
+// so a stale OTP is never used twice
+func fileOTP(config *Config) (string, error) {
+	path := config.OTP.Path
+	fmt.Fprintf(os.Stderr, "Waiting for the OTP to be written to %s\n", path)
+
+	// an OTP left over from an earlier login is no use
+	os.Remove(path)
+
+	var deadline time.Time
+	if config.OTP.Timeout > 0 {
+		deadline = time.Now().Add(config.OTP.Timeout)
+	}
+
+	for {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			if otp := strings.TrimSpace(string(data)); otp != "" {
+				os.Remove(path)
+				return otp, nil
+			}
+		} else if !os.IsNotExist(err) {
+			return "", fmt.Errorf("failed to read OTP file: %v", err)
+		}
+
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return "", fmt.Errorf("no OTP was written to %s within %s", path, config.OTP.Timeout)
+		}
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,367 @@
+// Package psapi implements the Pocketsmith API endpoints that are not covered
+// by github.com/dvcrn/pocketsmith-go.
+package psapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dvcrn/pocketsmith-ininal/metrics"
+)
+
+const (
+	BaseURL = "https://api.pocketsmith.com/v2"
+
+	// perPage is the page size used for paginated list endpoints
+	perPage = 100
+)
+
+// ErrNotFound is wrapped by the errors of requests Pocketsmith answers with 404
+var ErrNotFound = errors.New("not found")
+
+type Category struct {
+	ID       int        `json:"id"`
+	Title    string     `json:"title"`
+	ParentID int        `json:"parent_id"`
+	Children []Category `json:"children"`
+}
+
+type Transaction struct {
+	ID             int       `json:"id"`
+	Payee          string    `json:"payee"`
+	OriginalPayee  string    `json:"original_payee"`
+	Date           string    `json:"date"`
+	Amount         float64   `json:"amount"`
+	Memo           string    `json:"memo"`
+	ChequeNumber   string    `json:"cheque_number"`
+	Note           string    `json:"note"`
+	Labels         []string  `json:"labels"`
+	IsTransfer     bool      `json:"is_transfer"`
+	NeedsReview    bool      `json:"needs_review"`
+	Status         string    `json:"status"`
+	ClosingBalance float64   `json:"closing_balance"`
+	Category       *Category `json:"category"`
+}
+
+type Client struct {
+	token      string
+	httpClient *http.Client
+}
+
+func NewClient(token string) *Client {
+	return &Client{
+		token:      token,
+		httpClient: metrics.NewClient("pocketsmith"),
+	}
+}
+
+// endpointName replaces the IDs in path so requests to the same endpoint are
+// counted together, like /transactions/:id. Event IDs like 42-1514764800 are
+// IDs too.
+func endpointName(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if segment != "" && strings.Trim(segment, "0123456789-") == "" {
+			segments[i] = ":id"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// do sends a request to path and decodes the JSON response into out, if given
+func (c *Client) do(method, path string, query url.Values, body io.Reader, out interface{}) error {
+	u := BaseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Developer-Key", c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(metrics.WithEndpoint(req, method+" "+endpointName(path)))
+	if err != nil {
+		return fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		if resp.StatusCode == http.StatusNotFound {
+			return fmt.Errorf("%s %s failed with status %d: %s: %w", method, path, resp.StatusCode, apiErr.Error, ErrNotFound)
+		}
+		return fmt.Errorf("%s %s failed with status %d: %s", method, path, resp.StatusCode, apiErr.Error)
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+
+	return nil
+}
+
+// ListTransactions returns all transactions of a transaction account between
+// startDate and endDate (inclusive), following pagination.
+func (c *Client) ListTransactions(transactionAccountID int, startDate, endDate time.Time) ([]Transaction, error) {
+	var all []Transaction
+
+	for page := 1; ; page++ {
+		query := url.Values{}
+		query.Set("start_date", startDate.Format("2006-01-02"))
+		query.Set("end_date", endDate.Format("2006-01-02"))
+		query.Set("page", fmt.Sprint(page))
+		query.Set("per_page", fmt.Sprint(perPage))
+
+		var transactions []Transaction
+		if err := c.do("GET", fmt.Sprintf("/transaction_accounts/%d/transactions", transactionAccountID), query, nil, &transactions); err != nil {
+			return nil, err
+		}
+
+		all = append(all, transactions...)
+		if len(transactions) < perPage {
+			break
+		}
+	}
+
+	return all, nil
+}
+
+type CreateTransaction struct {
+	Payee        string  `json:"payee"`
+	Amount       float64 `json:"amount"`
+	Date         string  `json:"date"`
+	IsTransfer   bool    `json:"is_transfer"`
+	Note         string  `json:"note,omitempty"`
+	Memo         string  `json:"memo,omitempty"`
+	ChequeNumber string  `json:"cheque_number,omitempty"`
+	CategoryID   int     `json:"category_id,omitempty"`
+	// Labels is a comma separated list
+	Labels string `json:"labels,omitempty"`
+}
+
+// UpdateTransaction holds the fields to change on a transaction. Nil fields are
+// left untouched.
+type UpdateTransaction struct {
+	Payee      *string  `json:"payee,omitempty"`
+	Amount     *float64 `json:"amount,omitempty"`
+	Note       *string  `json:"note,omitempty"`
+	IsTransfer *bool    `json:"is_transfer,omitempty"`
+	CategoryID *int     `json:"category_id,omitempty"`
+	// Labels is a comma separated list that replaces the current labels
+	Labels *string `json:"labels,omitempty"`
+}
+
+func (c *Client) AddTransaction(transactionAccountID int, tx *CreateTransaction) (*Transaction, error) {
+	reqBody, err := json.Marshal(tx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	var created Transaction
+	if err := c.do("POST", fmt.Sprintf("/transaction_accounts/%d/transactions", transactionAccountID), nil, bytes.NewReader(reqBody), &created); err != nil {
+		return nil, err
+	}
+
+	return &created, nil
+}
+
+func (c *Client) UpdateTransaction(transactionID int, tx *UpdateTransaction) (*Transaction, error) {
+	reqBody, err := json.Marshal(tx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	var updated Transaction
+	if err := c.do("PUT", fmt.Sprintf("/transactions/%d", transactionID), nil, bytes.NewReader(reqBody), &updated); err != nil {
+		return nil, err
+	}
+
+	return &updated, nil
+}
+
+func (c *Client) GetTransaction(transactionID int) (*Transaction, error) {
+	var tx Transaction
+	if err := c.do("GET", fmt.Sprintf("/transactions/%d", transactionID), nil, nil, &tx); err != nil {
+		return nil, err
+	}
+	return &tx, nil
+}
+
+func (c *Client) DeleteTransaction(transactionID int) error {
+	return c.do("DELETE", fmt.Sprintf("/transactions/%d", transactionID), nil, nil, nil)
+}
+
+// ListCategories returns the categories of the user as a tree, subcategories
+// are in Children
+func (c *Client) ListCategories(userID int) ([]Category, error) {
+	var categories []Category
+	if err := c.do("GET", fmt.Sprintf("/users/%d/categories", userID), nil, nil, &categories); err != nil {
+		return nil, err
+	}
+	return categories, nil
+}
+
+type Institution struct {
+	ID           int    `json:"id"`
+	Title        string `json:"title"`
+	CurrencyCode string `json:"currency_code"`
+}
+
+type TransactionAccount struct {
+	ID             int          `json:"id"`
+	Name           string       `json:"name"`
+	Number         string       `json:"number"`
+	CurrencyCode   string       `json:"currency_code"`
+	CurrentBalance float64      `json:"current_balance"`
+	Institution    *Institution `json:"institution"`
+}
+
+type Scenario struct {
+	ID    int    `json:"id"`
+	Title string `json:"title"`
+}
+
+type Account struct {
+	ID                        int                  `json:"id"`
+	Title                     string               `json:"title"`
+	Type                      string               `json:"type"`
+	CurrencyCode              string               `json:"currency_code"`
+	CurrentBalance            float64              `json:"current_balance"`
+	PrimaryTransactionAccount *TransactionAccount  `json:"primary_transaction_account"`
+	TransactionAccounts       []TransactionAccount `json:"transaction_accounts"`
+	PrimaryScenario           *Scenario            `json:"primary_scenario"`
+}
+
+func (c *Client) ListAccounts(userID int) ([]Account, error) {
+	var accounts []Account
+	if err := c.do("GET", fmt.Sprintf("/users/%d/accounts", userID), nil, nil, &accounts); err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+func (c *Client) GetAccount(accountID int) (*Account, error) {
+	var account Account
+	if err := c.do("GET", fmt.Sprintf("/accounts/%d", accountID), nil, nil, &account); err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+func (c *Client) GetTransactionAccount(transactionAccountID int) (*TransactionAccount, error) {
+	var account TransactionAccount
+	if err := c.do("GET", fmt.Sprintf("/transaction_accounts/%d", transactionAccountID), nil, nil, &account); err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// UpdateAccount holds the fields to change on an account. Nil fields are left
+// untouched.
+type UpdateAccount struct {
+	Title      *string `json:"title,omitempty"`
+	IsNetWorth *bool   `json:"is_net_worth,omitempty"`
+}
+
+func (c *Client) UpdateAccount(accountID int, account *UpdateAccount) (*Account, error) {
+	reqBody, err := json.Marshal(account)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	var updated Account
+	if err := c.do("PUT", fmt.Sprintf("/accounts/%d", accountID), nil, bytes.NewReader(reqBody), &updated); err != nil {
+		return nil, err
+	}
+
+	return &updated, nil
+}
+
+// Repeat types of budget events
+const (
+	REPEAT_ONCE    = "once"
+	REPEAT_WEEKLY  = "weekly"
+	REPEAT_MONTHLY = "monthly"
+	REPEAT_YEARLY  = "yearly"
+)
+
+// Event is a budget event of a scenario, repeating events share their ID
+// prefix
+type Event struct {
+	ID             string    `json:"id"`
+	Category       *Category `json:"category"`
+	Scenario       *Scenario `json:"scenario"`
+	Amount         float64   `json:"amount"`
+	Date           string    `json:"date"`
+	RepeatType     string    `json:"repeat_type"`
+	RepeatInterval int       `json:"repeat_interval"`
+	Note           string    `json:"note"`
+}
+
+type CreateEvent struct {
+	CategoryID     int     `json:"category_id"`
+	Amount         float64 `json:"amount"`
+	Date           string  `json:"date"`
+	RepeatType     string  `json:"repeat_type"`
+	RepeatInterval int     `json:"repeat_interval"`
+	Note           string  `json:"note,omitempty"`
+}
+
+// UpdateEvent holds the fields to change on an event. Nil fields are left
+// untouched. Behaviour selects which occurrences of a repeating event change:
+// one, forward or all.
+type UpdateEvent struct {
+	Amount    *float64 `json:"amount,omitempty"`
+	Date      *string  `json:"date,omitempty"`
+	Note      *string  `json:"note,omitempty"`
+	Behaviour string   `json:"behaviour"`
+}
+
+func (c *Client) CreateEvent(scenarioID int, event *CreateEvent) (*Event, error) {
+	reqBody, err := json.Marshal(event)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	var created Event
+	if err := c.do("POST", fmt.Sprintf("/scenarios/%d/events", scenarioID), nil, bytes.NewReader(reqBody), &created); err != nil {
+		return nil, err
+	}
+
+	return &created, nil
+}
+
+func (c *Client) UpdateEvent(eventID string, event *UpdateEvent) (*Event, error) {
+	reqBody, err := json.Marshal(event)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	var updated Event
+	if err := c.do("PUT", "/events/"+url.PathEscape(eventID), nil, bytes.NewReader(reqBody), &updated); err != nil {
+		return nil, err
+	}
+
+	return &updated, nil
+}
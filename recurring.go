@@ -0,0 +1,380 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dvcrn/pocketsmith-go"
+	"github.com/dvcrn/pocketsmith-ininal/ininal"
+	"github.com/dvcrn/pocketsmith-ininal/psapi"
+	"github.com/dvcrn/pocketsmith-ininal/state"
+)
+
+// RECURRING_LABEL is the default recurring label
+const RECURRING_LABEL = "recurring"
+
+// Sources of recurring payments
+const (
+	// RECURRING_ININAL are payments Ininal gave a repeat type
+	RECURRING_ININAL = "ininal"
+	// RECURRING_PERIODIC are payments to the same payee at regular intervals
+	RECURRING_PERIODIC = "periodic"
+)
+
+// RECURRING_MIN_OCCURRENCES is how many payments a series needs to be
+// recognized by its periodicity
+const RECURRING_MIN_OCCURRENCES = 3
+
+// RECURRING_AMOUNT_TOLERANCE is how much, as a fraction, the payments of a
+// periodic series may differ from their median
+const RECURRING_AMOUNT_TOLERANCE = 0.2
+
+// recurringPeriod is a period recurring payments are recognized with. The
+// interval between two payments must be within [min, max] days.
+type recurringPeriod struct {
+	repeatType string
+	min, max   int
+	next       func(time.Time) time.Time
+}
+
+var recurringPeriods = []recurringPeriod{
+	{psapi.REPEAT_WEEKLY, 5, 9, func(t time.Time) time.Time { return t.AddDate(0, 0, 7) }},
+	{psapi.REPEAT_MONTHLY, 26, 35, func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }},
+	{psapi.REPEAT_YEARLY, 350, 380, func(t time.Time) time.Time { return t.AddDate(1, 0, 0) }},
+}
+
+// repeatType returns the repeat type Ininal gave transaction, or "" when it
+// is not a recurring payment
+func repeatType(transaction ininal.Transaction) string {
+	switch t := strings.TrimSpace(transaction.RepeatActionType); strings.ToUpper(t) {
+	case "", "0", "NONE", "NO", "FALSE", "NULL":
+		return ""
+	default:
+		return t
+	}
+}
+
+// periodOfRepeatType maps an Ininal repeat type to a period, or nil
+func periodOfRepeatType(t string) *recurringPeriod {
+	t = strings.ToUpper(t)
+	for _, period := range []struct {
+		parts      []string
+		repeatType string
+	}{
+		{[]string{"WEEK", "HAFTALIK"}, psapi.REPEAT_WEEKLY},
+		{[]string{"MONTH", "AYLIK"}, psapi.REPEAT_MONTHLY},
+		{[]string{"YEAR", "ANNUAL", "YILLIK"}, psapi.REPEAT_YEARLY},
+	} {
+		for _, part := range period.parts {
+			if strings.Contains(t, part) {
+				return findPeriod(period.repeatType)
+			}
+		}
+	}
+	return nil
+}
+
+func findPeriod(repeatType string) *recurringPeriod {
+	for i := range recurringPeriods {
+		if recurringPeriods[i].repeatType == repeatType {
+			return &recurringPeriods[i]
+		}
+	}
+	return nil
+}
+
+// recurringPayment is a series of payments to the same payee from the same
+// Pocketsmith transaction account
+type recurringPayment struct {
+	Key                  string `json:"key"`
+	TransactionAccountID int    `json:"transactionAccountId"`
+	Payee                string `json:"payee"`
+	// Amount is the amount of the latest payment
+	Amount      float64   `json:"amount"`
+	CategoryID  int       `json:"categoryId,omitempty"`
+	Period      string    `json:"period"`
+	Source      string    `json:"source"`
+	Occurrences int       `json:"occurrences"`
+	LastDate    time.Time `json:"lastDate"`
+	NextDate    time.Time `json:"nextDate"`
+	// Late is set when the next payment is more than a period overdue, the
+	// series probably ended
+	Late bool `json:"late"`
+	// EventID is the Pocketsmith budget event of the series
+	EventID string `json:"eventId,omitempty"`
+}
+
+// periodOfIntervals returns the period at least 3 out of 4 intervals between
+// dates, which are sorted, fall into, or nil
+func periodOfIntervals(dates []time.Time) *recurringPeriod {
+	if len(dates) < 2 {
+		return nil
+	}
+	for i := range recurringPeriods {
+		period := &recurringPeriods[i]
+		matching := 0
+		for j := 1; j < len(dates); j++ {
+			days := int(math.Round(dates[j].Sub(dates[j-1]).Hours() / 24))
+			if days >= period.min && days <= period.max {
+				matching++
+			}
+		}
+		if matching*4 >= (len(dates)-1)*3 {
+			return period
+		}
+	}
+	return nil
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	if n := len(sorted); n%2 == 0 {
+		return (sorted[n/2-1] + sorted[n/2]) / 2
+	}
+	return sorted[len(sorted)/2]
+}
+
+// detectRecurring finds the recurring payments among the imported
+// transactions. Payments with an Ininal repeat type are recurring on their
+// own, other payments need RECURRING_MIN_OCCURRENCES payments of similar
+// amounts at regular intervals. Transfers and reversed or disappeared
+// transactions are not payments.
+func detectRecurring(imports map[string]*state.Import, reversals map[string]*state.Reversal, now time.Time) []*recurringPayment {
+	series := map[string][]*state.Import{}
+	for ref, record := range imports {
+		if record.Amount >= 0 || record.IsTransfer || strings.TrimSpace(record.Payee) == "" || reversals[ref] != nil {
+			continue
+		}
+		key := fmt.Sprintf("%d:%s", record.TransactionAccountID, strings.ToLower(strings.TrimSpace(record.Payee)))
+		series[key] = append(series[key], record)
+	}
+
+	payments := []*recurringPayment{}
+	for key, records := range series {
+		sort.Slice(records, func(i, j int) bool { return records[i].Date.Before(records[j].Date) })
+		latest := records[len(records)-1]
+
+		dates := make([]time.Time, len(records))
+		amounts := make([]float64, len(records))
+		fromIninal := ""
+		for i, record := range records {
+			dates[i], amounts[i] = record.Date, record.Amount
+			if record.RepeatActionType != "" {
+				fromIninal = record.RepeatActionType
+			}
+		}
+
+		source := RECURRING_PERIODIC
+		period := periodOfIntervals(dates)
+		if fromIninal != "" {
+			source = RECURRING_ININAL
+			if p := periodOfRepeatType(fromIninal); p != nil {
+				period = p
+			} else if period == nil {
+				period = findPeriod(psapi.REPEAT_MONTHLY)
+			}
+		} else {
+			if period == nil || len(records) < RECURRING_MIN_OCCURRENCES {
+				continue
+			}
+			m := median(amounts)
+			similar := true
+			for _, amount := range amounts {
+				if math.Abs(amount-m) > math.Abs(m)*RECURRING_AMOUNT_TOLERANCE {
+					similar = false
+					break
+				}
+			}
+			if !similar {
+				continue
+			}
+		}
+
+		next := period.next(latest.Date)
+		payments = append(payments, &recurringPayment{
+			Key:                  key,
+			TransactionAccountID: latest.TransactionAccountID,
+			Payee:                latest.Payee,
+			Amount:               latest.Amount,
+			CategoryID:           latest.CategoryID,
+			Period:               period.repeatType,
+			Source:               source,
+			Occurrences:          len(records),
+			LastDate:             latest.Date,
+			NextDate:             next,
+			Late:                 now.After(period.next(next)),
+		})
+	}
+
+	sort.Slice(payments, func(i, j int) bool {
+		if !payments[i].NextDate.Equal(payments[j].NextDate) {
+			return payments[i].NextDate.Before(payments[j].NextDate)
+		}
+		return payments[i].Key < payments[j].Key
+	})
+	return payments
+}
+
+// scenarioIDs maps the Pocketsmith transaction accounts of the user to the
+// primary scenario of their account
+func scenarioIDs(api *psapi.Client, userID int) (map[int]int, error) {
+	accounts, err := api.ListAccounts(userID)
+	if err != nil {
+		return nil, err
+	}
+	scenarios := map[int]int{}
+	for _, account := range accounts {
+		if account.PrimaryScenario == nil {
+			continue
+		}
+		for _, transactionAccount := range account.TransactionAccounts {
+			scenarios[transactionAccount.ID] = account.PrimaryScenario.ID
+		}
+	}
+	return scenarios, nil
+}
+
+// syncEvent creates or updates the budget event of payment. categoryID is used
+// when the payments have no category.
+func syncEvent(api *psapi.Client, st *state.State, scenarios map[int]int, payment *recurringPayment, categoryID int) (string, error) {
+	date := payment.NextDate.Format(DATE_FORMAT)
+	note := "Ininal recurring payment: " + payment.Payee
+
+	if known := st.Events[payment.Key]; known != nil {
+		payment.EventID = known.EventID
+		if amountsEqual(known.Amount, payment.Amount) && known.Date.Equal(payment.NextDate) {
+			return "", nil
+		}
+		event, err := api.UpdateEvent(known.EventID, &psapi.UpdateEvent{Amount: &payment.Amount, Date: &date, Note: &note, Behaviour: "forward"})
+		if err != nil {
+			return "", err
+		}
+		known.EventID, known.Amount, known.Date, known.UpdatedAt = event.ID, payment.Amount, payment.NextDate, time.Now()
+		payment.EventID = event.ID
+		return "updated", nil
+	}
+
+	if payment.CategoryID != 0 {
+		categoryID = payment.CategoryID
+	}
+	if categoryID == 0 {
+		return "", fmt.Errorf("no category, use -event-category")
+	}
+	scenarioID, ok := scenarios[payment.TransactionAccountID]
+	if !ok {
+		return "", fmt.Errorf("no scenario found for transaction account %d", payment.TransactionAccountID)
+	}
+
+	event, err := api.CreateEvent(scenarioID, &psapi.CreateEvent{
+		CategoryID:     categoryID,
+		Amount:         payment.Amount,
+		Date:           date,
+		RepeatType:     payment.Period,
+		RepeatInterval: 1,
+		Note:           note,
+	})
+	if err != nil {
+		return "", err
+	}
+	st.Events[payment.Key] = &state.Event{EventID: event.ID, ScenarioID: scenarioID, Amount: payment.Amount, Date: payment.NextDate, UpdatedAt: time.Now()}
+	payment.EventID = event.ID
+	return "created", nil
+}
+
+func runRecurring(args []string) {
+	fs := flag.NewFlagSet("recurring", flag.ExitOnError)
+	config := registerConfigFlags(fs)
+	registerPocketsmithFlags(fs, config, false)
+	events := fs.Bool("events", false, "Create or update a Pocketsmith budget event for every recurring payment that is not late")
+	eventCategory := fs.Int("event-category", 0, "ID of the Pocketsmith category of budget events for payments without a category")
+	all := fs.Bool("all", false, "Also list late series, whose next payment is more than a period overdue")
+	output := registerOutputFlag(fs, OUTPUT_TABLE)
+	fs.Parse(args)
+	// the report only reads the state file, the Pocketsmith token is needed
+	// for the events and may be kept in the vault
+	config.noLogin, config.noVault = true, !*events
+	if err := config.load(fs); err != nil {
+		failConfig(err)
+	}
+	config = config.singleIdentity()
+	checkOutput(*output)
+
+	if *events && config.PocketsmithToken == "" {
+		fail(EXIT_USAGE, fmt.Errorf("-events needs the Pocketsmith token"))
+	}
+
+	st, err := state.Load(config.StateFile)
+	if err != nil {
+		fail(EXIT_ERROR, err)
+	}
+
+	payments := []*recurringPayment{}
+	for _, payment := range detectRecurring(st.Imports, st.Reversals, time.Now()) {
+		if !payment.Late || *all {
+			payments = append(payments, payment)
+		}
+	}
+
+	failed := false
+	if *events {
+		api := psapi.NewClient(config.PocketsmithToken)
+		start := time.Now()
+		user, err := pocketsmith.NewClient(config.PocketsmithToken).GetCurrentUser()
+		recordPocketsmith("GET /me", start, err)
+		if err != nil {
+			fail(EXIT_ERROR, fmt.Errorf("failed to get the Pocketsmith user: %v", err))
+		}
+		scenarios, err := scenarioIDs(api, user.ID)
+		if err != nil {
+			fail(EXIT_ERROR, fmt.Errorf("failed to list the Pocketsmith accounts: %v", err))
+		}
+
+		for _, payment := range payments {
+			if payment.Late {
+				continue
+			}
+			action, err := syncEvent(api, st, scenarios, payment, *eventCategory)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to sync the event of %s: %v\n", payment.Payee, err)
+				failed = true
+			} else if action != "" {
+				fmt.Fprintf(os.Stderr, "Event of %s %s\n", payment.Payee, action)
+			}
+		}
+		if err := st.Save(); err != nil {
+			fail(EXIT_ERROR, err)
+		}
+	} else {
+		for _, payment := range payments {
+			if known := st.Events[payment.Key]; known != nil {
+				payment.EventID = known.EventID
+			}
+		}
+	}
+
+	t := &table{
+		header: []string{"PAYEE", "ACCOUNT", "PERIOD", "AMOUNT", "COUNT", "LAST", "NEXT", "SOURCE", "EVENT"},
+		data:   payments,
+	}
+	for _, p := range payments {
+		next := p.NextDate.Format(DATE_FORMAT)
+		if p.Late {
+			next += " (late)"
+		}
+		t.add(p.Payee, fmt.Sprint(p.TransactionAccountID), p.Period, formatAmount(p.Amount), fmt.Sprint(p.Occurrences), p.LastDate.Format(DATE_FORMAT), next, p.Source, p.EventID)
+	}
+
+	if err := t.write(os.Stdout, *output); err != nil {
+		fail(EXIT_ERROR, err)
+	}
+	fmt.Fprintf(os.Stderr, "%d recurring payments\n", len(payments))
+	if failed {
+		os.Exit(EXIT_PARTIAL)
+	}
+}
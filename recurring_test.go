@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/dvcrn/pocketsmith-ininal/psapi"
+	"github.com/dvcrn/pocketsmith-ininal/state"
+)
+
+func dates(days ...string) []time.Time {
+	var list []time.Time
+	for _, d := range days {
+		list = append(list, at(d+" 10:00"))
+	}
+	return list
+}
+
+func TestPeriodOfIntervals(t *testing.T) {
+	tests := []struct {
+		name     string
+		dates    []time.Time
+		expected string
+	}{
+		{"weekly", dates("2024-03-01", "2024-03-08", "2024-03-15", "2024-03-22"), psapi.REPEAT_WEEKLY},
+		{"monthly", dates("2024-01-31", "2024-02-29", "2024-03-31", "2024-04-30"), psapi.REPEAT_MONTHLY},
+		{"yearly", dates("2021-06-01", "2022-06-01", "2023-06-03"), psapi.REPEAT_YEARLY},
+		// a missed month is one interval of four off
+		{"3 of 4 intervals", dates("2024-01-05", "2024-02-05", "2024-03-05", "2024-05-05", "2024-06-05"), psapi.REPEAT_MONTHLY},
+		{"2 of 4 intervals", dates("2024-01-05", "2024-02-05", "2024-04-05", "2024-06-05", "2024-07-05"), ""},
+		{"1 of 2 intervals", dates("2024-01-05", "2024-02-05", "2024-04-05"), ""},
+		{"bounds of the monthly range", dates("2024-01-01", "2024-01-27", "2024-03-02"), psapi.REPEAT_MONTHLY},
+		{"outside the monthly range", dates("2024-01-01", "2024-01-26", "2024-02-21"), ""},
+		{"single date", dates("2024-01-05"), ""},
+	}
+
+	for _, test := range tests {
+		period := periodOfIntervals(test.dates)
+		got := ""
+		if period != nil {
+			got = period.repeatType
+		}
+		if got != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, got)
+		}
+	}
+}
+
+func TestPeriodOfRepeatType(t *testing.T) {
+	tests := map[string]string{
+		"WEEKLY":    psapi.REPEAT_WEEKLY,
+		"Haftalık":  psapi.REPEAT_WEEKLY,
+		"HAFTALIK":  psapi.REPEAT_WEEKLY,
+		"MONTHLY":   psapi.REPEAT_MONTHLY,
+		"AYLIK":     psapi.REPEAT_MONTHLY,
+		"YEARLY":    psapi.REPEAT_YEARLY,
+		"ANNUAL":    psapi.REPEAT_YEARLY,
+		"DAILY":     "",
+		"AUTO_PAY":  "",
+		"MONTH_END": psapi.REPEAT_MONTHLY,
+	}
+
+	for repeatType, expected := range tests {
+		period := periodOfRepeatType(repeatType)
+		got := ""
+		if period != nil {
+			got = period.repeatType
+		}
+		if got != expected {
+			t.Errorf("%s: expected %q, got %q", repeatType, expected, got)
+		}
+	}
+}
+
+// series adds the imports of payments to payee on days
+func series(imports map[string]*state.Import, accountID int, payee string, amounts []float64, days ...string) {
+	for i, d := range days {
+		imports[fmt.Sprintf("%d-%s-%d", accountID, payee, i)] = &state.Import{
+			TransactionAccountID: accountID,
+			Payee:                payee,
+			Amount:               amounts[i%len(amounts)],
+			Date:                 at(d + " 10:00"),
+		}
+	}
+}
+
+func TestDetectRecurring(t *testing.T) {
+	imports := map[string]*state.Import{}
+	series(imports, 1, "Netflix", []float64{-199.99}, "2024-01-15", "2024-02-15", "2024-03-15")
+	// 19% off the median is still similar
+	series(imports, 1, "Electricity", []float64{-400, -476, -420}, "2024-01-20", "2024-02-19", "2024-03-21")
+	// 25% off is not
+	series(imports, 1, "Water", []float64{-100, -100, -125}, "2024-01-10", "2024-02-10", "2024-03-10")
+	// two payments are not enough
+	series(imports, 1, "Gym", []float64{-500}, "2024-02-01", "2024-03-01")
+	// the same payee of another account is another series
+	series(imports, 2, "Netflix", []float64{-9.99}, "2024-03-01", "2024-03-08")
+	// case and spaces of the payee don't matter
+	series(imports, 1, "Spotify", []float64{-59.99}, "2024-03-04", "2024-03-11")
+	series(imports, 1, " SPOTIFY ", []float64{-59.99}, "2024-03-18")
+	// a series that ended
+	series(imports, 1, "Magazine", []float64{-30}, "2023-09-01", "2023-10-01", "2023-11-01")
+	// Ininal marks a payment as recurring on its own
+	imports["ininal"] = &state.Import{TransactionAccountID: 1, Payee: "Turkcell", Amount: -250, Date: at("2024-03-05 10:00"), RepeatActionType: "AYLIK"}
+	imports["ininal unknown"] = &state.Import{TransactionAccountID: 1, Payee: "Insurance", Amount: -900, Date: at("2024-03-06 10:00"), RepeatActionType: "AUTO"}
+	// credits and transfers are not payments
+	series(imports, 1, "Salary", []float64{5000}, "2024-01-01", "2024-02-01", "2024-03-01")
+	imports["transfer1"] = &state.Import{TransactionAccountID: 1, Payee: "Savings", Amount: -100, Date: at("2024-01-02 10:00"), IsTransfer: true}
+	imports["transfer2"] = &state.Import{TransactionAccountID: 1, Payee: "Savings", Amount: -100, Date: at("2024-02-02 10:00"), IsTransfer: true}
+	imports["transfer3"] = &state.Import{TransactionAccountID: 1, Payee: "Savings", Amount: -100, Date: at("2024-03-02 10:00"), IsTransfer: true}
+	// a refunded payment is not part of the series
+	series(imports, 1, "Disney", []float64{-149.99}, "2024-01-10", "2024-02-10", "2024-03-10")
+	imports["disney refunded"] = &state.Import{TransactionAccountID: 1, Payee: "Disney", Amount: -149.99, Date: at("2024-03-20 10:00")}
+	// nor is a disappeared one
+	imports["gym disappeared"] = &state.Import{TransactionAccountID: 1, Payee: "Gym", Amount: -500, Date: at("2024-01-01 10:00")}
+	reversals := map[string]*state.Reversal{
+		"disney refunded": {ReversalRef: "refund", Action: REVERSAL_NOTE},
+		"gym disappeared": {Action: REVERSAL_LABEL},
+	}
+
+	expected := map[string]struct {
+		period, source string
+		occurrences    int
+		next           string
+		late           bool
+	}{
+		"1:netflix":     {psapi.REPEAT_MONTHLY, RECURRING_PERIODIC, 3, "2024-04-15", false},
+		"1:electricity": {psapi.REPEAT_MONTHLY, RECURRING_PERIODIC, 3, "2024-04-21", false},
+		"1:spotify":     {psapi.REPEAT_WEEKLY, RECURRING_PERIODIC, 3, "2024-03-25", false},
+		"1:magazine":    {psapi.REPEAT_MONTHLY, RECURRING_PERIODIC, 3, "2023-12-01", true},
+		"1:turkcell":    {psapi.REPEAT_MONTHLY, RECURRING_ININAL, 1, "2024-04-05", false},
+		"1:insurance":   {psapi.REPEAT_MONTHLY, RECURRING_ININAL, 1, "2024-04-06", false},
+		"1:disney":      {psapi.REPEAT_MONTHLY, RECURRING_PERIODIC, 3, "2024-04-10", false},
+	}
+
+	payments := detectRecurring(imports, reversals, at("2024-03-25 12:00"))
+	if len(payments) != len(expected) {
+		var keys []string
+		for _, payment := range payments {
+			keys = append(keys, payment.Key)
+		}
+		t.Fatalf("expected %d recurring payments, got %v", len(expected), keys)
+	}
+	for i, payment := range payments {
+		e, ok := expected[payment.Key]
+		if !ok {
+			t.Errorf("unexpected recurring payment %s", payment.Key)
+			continue
+		}
+		next := payment.NextDate.Format(DATE_FORMAT)
+		if payment.Period != e.period || payment.Source != e.source || payment.Occurrences != e.occurrences || next != e.next || payment.Late != e.late {
+			t.Errorf("%s: expected %+v, got %s %s %d %s late %v", payment.Key, e, payment.Period, payment.Source, payment.Occurrences, next, payment.Late)
+		}
+		if i > 0 && payment.NextDate.Before(payments[i-1].NextDate) {
+			t.Errorf("recurring payments are not sorted by the next date")
+		}
+	}
+}
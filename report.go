@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// accountReport summarizes the sync of a single Ininal account
+type accountReport struct {
+	AccountNumber string `json:"accountNumber"`
+	AccountName   string `json:"accountName"`
+	Currency      string `json:"currency"`
+	Status        string `json:"status"`
+
+	// SkipReason is set when the account was not synced
+	SkipReason string        `json:"skipReason,omitempty"`
+	Error      string        `json:"error,omitempty"`
+	Result     *importResult `json:"result,omitempty"`
+	Balance    *balanceCheck `json:"balance,omitempty"`
+
+	BlockedCards []string `json:"blockedCards,omitempty"`
+	Notes        []string `json:"notes,omitempty"`
+}
+
+// identityReport summarizes the sync of one Ininal login
+type identityReport struct {
+	// Identity is empty when the config has no identities
+	Identity          string `json:"identity,omitempty"`
+	PocketsmithUserID int    `json:"pocketsmithUserId,omitempty"`
+	// Error is set when the identity could not be synced at all
+	Error    string           `json:"error,omitempty"`
+	Accounts []*accountReport `json:"accounts"`
+	// Transfers are the transfers linked in this run
+	Transfers []string `json:"transfers,omitempty"`
+	Notes     []string `json:"notes,omitempty"`
+}
+
+// runReport summarizes a sync run
+type runReport struct {
+	StartedAt  time.Time         `json:"startedAt"`
+	FinishedAt time.Time         `json:"finishedAt"`
+	Identities []*identityReport `json:"identities"`
+	// Error is set when the run could not start at all
+	Error string `json:"error,omitempty"`
+	// BalanceMismatch is set when the balance check of any account failed
+	BalanceMismatch bool `json:"balanceMismatch"`
+}
+
+// failed reports whether any identity or account failed to sync or had
+// failed transactions
+func (r *runReport) failed() bool {
+	if r.Error != "" {
+		return true
+	}
+	for _, identity := range r.Identities {
+		if identity.Error != "" {
+			return true
+		}
+		for _, account := range identity.Accounts {
+			if account.Error != "" || (account.Result != nil && account.Result.Failed > 0) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *runReport) print() {
+	fmt.Printf("\nSync summary (%s):\n", r.FinishedAt.Sub(r.StartedAt).Round(time.Second))
+
+	for _, identity := range r.Identities {
+		indent := ""
+		if identity.Identity != "" {
+			fmt.Printf("Identity %s:\n", identity.Identity)
+			indent = "  "
+		}
+		if identity.Error != "" {
+			fmt.Printf("%s- error: %s\n", indent, identity.Error)
+		}
+
+		for _, account := range identity.Accounts {
+			fmt.Printf("%s- Account %s %s (%s, %s)\n", indent, account.AccountNumber, account.AccountName, account.Currency, account.Status)
+
+			switch {
+			case account.SkipReason != "":
+				fmt.Printf("%s    skipped: %s\n", indent, account.SkipReason)
+			case account.Error != "":
+				fmt.Printf("%s    error: %s\n", indent, account.Error)
+			}
+
+			if res := account.Result; res != nil {
+				fmt.Printf("%s    %d fetched, %d created, %d updated, %d skipped, %d failed, %d reversals\n", indent, res.Fetched, res.Created, res.Updated, res.Skipped, res.Failed, res.Reversed)
+				if len(res.Uncategorized) > 0 {
+					fmt.Printf("%s    %d created transactions matched no category rule:\n", indent, len(res.Uncategorized))
+					for _, tx := range res.Uncategorized {
+						fmt.Printf("%s      %s %s %.2f (%s)\n", indent, tx.Date, tx.Payee, tx.Amount, tx.ReferenceNo)
+					}
+				}
+				if len(res.NewIcons) > 0 {
+					fmt.Printf("%s    new Ininal icons without mapping: %s\n", indent, strings.Join(res.NewIcons, ", "))
+				}
+			}
+			if b := account.Balance; b != nil {
+				fmt.Printf("%s    balance: Ininal %.2f, Pocketsmith %.2f, difference %.2f\n", indent, b.IninalBalance, b.PocketsmithBalance, b.Difference)
+			}
+			for _, card := range account.BlockedCards {
+				fmt.Printf("%s    blocked card: %s\n", indent, card)
+			}
+			for _, note := range account.Notes {
+				fmt.Printf("%s    %s\n", indent, note)
+			}
+		}
+
+		if len(identity.Transfers) > 0 {
+			fmt.Printf("%s- Linked %d transfers:\n", indent, len(identity.Transfers))
+			for _, transfer := range identity.Transfers {
+				fmt.Printf("%s    %s\n", indent, transfer)
+			}
+		}
+		for _, note := range identity.Notes {
+			fmt.Printf("%s- %s\n", indent, note)
+		}
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dvcrn/pocketsmith-ininal/ininal"
+	"github.com/dvcrn/pocketsmith-ininal/psapi"
+	"github.com/dvcrn/pocketsmith-ininal/state"
+)
+
+// Actions taken for reversed or disappeared transactions
+const (
+	// REVERSAL_DELETE deletes the original (and the reversing) transaction from Pocketsmith
+	REVERSAL_DELETE = "delete"
+	// REVERSAL_LABEL adds the reversed label to both transactions
+	REVERSAL_LABEL = "label"
+	// REVERSAL_NOTE appends a note to both transactions, and the reversed
+	// label unless it is disabled
+	REVERSAL_NOTE = "note"
+	// REVERSAL_NONE only reports reversals
+	REVERSAL_NONE = "none"
+)
+
+// REVERSED_LABEL is the default reversed label
+const REVERSED_LABEL = "reversed"
+
+// reversedLabel is the label added to reversed transactions
+func (im *importer) reversedLabel() string {
+	if im.labels.Reversed == "" {
+		return REVERSED_LABEL
+	}
+	return im.labels.Reversed
+}
+
+// DEFAULT_REVERSAL_TYPES are the transaction types (or parts of them) used by
+// Ininal for refunds and cancelled authorizations
+var DEFAULT_REVERSAL_TYPES = []string{"İade", "Iade", "İptal", "Iptal", "Refund", "Reversal", "Cancel"}
+
+// reversal is an Ininal transaction that was undone. reversal is nil when the
+// original transaction disappeared from Ininal instead.
+type reversal struct {
+	original ininal.Transaction
+	reversal *ininal.Transaction
+}
+
+func (r reversal) String() string {
+	if r.reversal == nil {
+		return fmt.Sprintf("%s (%s, %.2f) disappeared from Ininal", r.original.ReferenceNo, strings.TrimSpace(r.original.Description), r.original.Amount)
+	}
+	return fmt.Sprintf("%s (%s, %.2f) reversed by %s", r.original.ReferenceNo, strings.TrimSpace(r.original.Description), r.original.Amount, r.reversal.ReferenceNo)
+}
+
+func isReversalType(transaction ininal.Transaction, reversalTypes []string) bool {
+	for _, t := range reversalTypes {
+		if t != "" && (strings.Contains(transaction.TransactionType, t) || strings.Contains(transaction.Description, t)) {
+			return true
+		}
+	}
+	return false
+}
+
+// referencesTransaction reports whether reversal mentions the reference number of original
+func referencesTransaction(reversal, original ininal.Transaction) bool {
+	if original.ReferenceNo == "" || reversal.ReferenceNo == original.ReferenceNo {
+		return false
+	}
+	return strings.Contains(reversal.Description, original.ReferenceNo) || strings.Contains(reversal.TransactionType, original.ReferenceNo)
+}
+
+// detectReversals pairs reversing transactions with the transactions they undo.
+// A pair needs the same amount with opposite sign, and either the reversing
+// transaction has one of reversalTypes or it references the original.
+func detectReversals(transactions []ininal.Transaction, reversalTypes []string) []reversal {
+	var reversals []reversal
+	paired := map[int]bool{}
+
+	for i, candidate := range transactions {
+		if candidate.Amount == 0 || paired[i] {
+			continue
+		}
+
+		isType := isReversalType(candidate, reversalTypes)
+
+		match := -1
+		for j, original := range transactions {
+			if i == j || paired[j] || !amountsEqual(original.Amount, -candidate.Amount) {
+				continue
+			}
+			if original.TransactionDate.After(candidate.TransactionDate) || isReversalType(original, reversalTypes) {
+				continue
+			}
+
+			if referencesTransaction(candidate, original) {
+				// a linked reference is the strongest signal
+				match = j
+				break
+			}
+
+			// otherwise prefer the most recent original before the reversal
+			if isType && (match == -1 || original.TransactionDate.After(transactions[match].TransactionDate)) {
+				match = j
+			}
+		}
+
+		if match == -1 {
+			continue
+		}
+
+		paired[i] = true
+		paired[match] = true
+		rev := candidate
+		reversals = append(reversals, reversal{original: transactions[match], reversal: &rev})
+	}
+
+	return reversals
+}
+
+// listedDay reports whether date is on one of the days Ininal lists for
+// [since, until]. Ininal is asked for the calendar days of since and until and
+// filters by the day of the transaction in its own time zone, which the
+// recorded dates keep.
+func listedDay(date, since, until time.Time) bool {
+	day := date.Format(DATE_FORMAT)
+	return day >= since.Format(DATE_FORMAT) && day <= until.Format(DATE_FORMAT)
+}
+
+// detectDisappeared returns imported transactions of the transaction account
+// that are dated within [since, until] but no longer listed by Ininal
+func detectDisappeared(st *state.State, transactionAccountID int, since, until time.Time, transactions []ininal.Transaction) []reversal {
+	listed := map[string]bool{}
+	for _, transaction := range transactions {
+		listed[transaction.ReferenceNo] = true
+	}
+
+	var disappeared []reversal
+	for ref, record := range st.Imports {
+		if record.TransactionAccountID != transactionAccountID || listed[ref] {
+			continue
+		}
+		if !listedDay(record.Date, since, until) {
+			continue
+		}
+
+		disappeared = append(disappeared, reversal{original: ininal.Transaction{
+			TransactionDate: record.Date,
+			Description:     record.Payee,
+			ReferenceNo:     ref,
+			Amount:          record.Amount,
+		}})
+	}
+
+	return disappeared
+}
+
+// excludeReversed removes transactions that must not be imported because they
+// were (or are about to be) deleted as part of a reversal
+func excludeReversed(st *state.State, transactions []ininal.Transaction, reversals []reversal) []ininal.Transaction {
+	excluded := map[string]bool{}
+	for _, r := range reversals {
+		excluded[r.original.ReferenceNo] = true
+		if r.reversal != nil {
+			excluded[r.reversal.ReferenceNo] = true
+		}
+	}
+	for ref, handled := range st.Reversals {
+		if handled.Action == REVERSAL_DELETE {
+			excluded[ref] = true
+			if handled.ReversalRef != "" {
+				excluded[handled.ReversalRef] = true
+			}
+		}
+	}
+
+	var remaining []ininal.Transaction
+	for _, transaction := range transactions {
+		if !excluded[transaction.ReferenceNo] {
+			remaining = append(remaining, transaction)
+		}
+	}
+	return remaining
+}
+
+func appendNote(note, addition string) string {
+	if strings.Contains(note, addition) {
+		return note
+	}
+	if note == "" {
+		return addition
+	}
+	return note + " | " + addition
+}
+
+func addLabel(labels []string, label string) (string, bool) {
+	for _, l := range labels {
+		if l == label {
+			return strings.Join(labels, ","), false
+		}
+	}
+	return strings.Join(append(labels, label), ","), true
+}
+
+// markTransaction applies the label or note action to the Pocketsmith
+// transaction imported for ref
+func (im *importer) markTransaction(existing map[int]psapi.Transaction, ref string, action string, note string) error {
+	record := im.state.Imports[ref]
+	if record == nil {
+		return nil
+	}
+	tx, ok := existing[record.TransactionID]
+	if !ok {
+		return nil
+	}
+
+	update := &psapi.UpdateTransaction{}
+	changed := false
+	if action == REVERSAL_LABEL || im.labels.Reversed != "" {
+		if labels, added := addLabel(tx.Labels, im.reversedLabel()); added {
+			update.Labels = &labels
+			changed = true
+		}
+	}
+	if action == REVERSAL_NOTE {
+		if newNote := appendNote(tx.Note, note); newNote != tx.Note {
+			update.Note = &newNote
+			// keep preserve-edits from treating our own note as a user edit
+			record.Note = newNote
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	_, err := im.api.UpdateTransaction(tx.ID, update)
+	return err
+}
+
+// deleteTransaction removes the Pocketsmith transaction imported for ref
+func (im *importer) deleteTransaction(ref string) error {
+	record := im.state.Imports[ref]
+	if record == nil {
+		return nil
+	}
+	if err := im.api.DeleteTransaction(record.TransactionID); err != nil {
+		return err
+	}
+	if record.Fee != nil && record.Fee.TransactionID != 0 {
+		if err := im.api.DeleteTransaction(record.Fee.TransactionID); err != nil {
+			return fmt.Errorf("failed to delete fee transaction %d: %v", record.Fee.TransactionID, err)
+		}
+	}
+	delete(im.state.Imports, ref)
+	return nil
+}
+
+// handleReversals applies the configured reversal action to reversals found in
+// the transaction account. It returns the number of reversals handled.
+func (im *importer) handleReversals(transactionAccountID int, since, until time.Time, reversals []reversal) int {
+	if len(reversals) == 0 {
+		return 0
+	}
+
+	var existing map[int]psapi.Transaction
+	if im.reversalAction == REVERSAL_LABEL || im.reversalAction == REVERSAL_NOTE {
+		transactions, err := im.api.ListTransactions(transactionAccountID, since.AddDate(0, 0, -3), until.AddDate(0, 0, 3))
+		if err != nil {
+			fmt.Printf("Error listing transactions to mark reversals: %v\n", err)
+			return 0
+		}
+		existing = map[int]psapi.Transaction{}
+		for _, tx := range transactions {
+			existing[tx.ID] = tx
+		}
+	}
+
+	handled := 0
+	for _, r := range reversals {
+		if prev := im.state.Reversals[r.original.ReferenceNo]; prev != nil && prev.Action == im.reversalAction {
+			continue
+		}
+
+		fmt.Println("Reversal:", r)
+		if im.reversalAction == REVERSAL_NONE {
+			continue
+		}
+
+		var err error
+		reversalRef := ""
+		if r.reversal != nil {
+			reversalRef = r.reversal.ReferenceNo
+		}
+
+		switch im.reversalAction {
+		case REVERSAL_DELETE:
+			err = im.deleteTransaction(r.original.ReferenceNo)
+			if err == nil && reversalRef != "" {
+				err = im.deleteTransaction(reversalRef)
+			}
+		case REVERSAL_LABEL, REVERSAL_NOTE:
+			if reversalRef == "" {
+				err = im.markTransaction(existing, r.original.ReferenceNo, im.reversalAction, "No longer listed by Ininal")
+			} else {
+				err = im.markTransaction(existing, r.original.ReferenceNo, im.reversalAction, "Reversed by "+reversalRef)
+				if err == nil {
+					err = im.markTransaction(existing, reversalRef, im.reversalAction, "Reversal of "+r.original.ReferenceNo)
+				}
+			}
+		}
+
+		if err != nil {
+			fmt.Printf("Error handling reversal of %s: %v\n", r.original.ReferenceNo, err)
+			continue
+		}
+
+		im.state.Reversals[r.original.ReferenceNo] = &state.Reversal{
+			ReversalRef: reversalRef,
+			Action:      im.reversalAction,
+			HandledAt:   time.Now(),
+		}
+		handled++
+	}
+
+	if err := im.state.Save(); err != nil {
+		fmt.Printf("Error saving state: %v\n", err)
+	}
+
+	return handled
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/dvcrn/pocketsmith-ininal/ininal"
+	"github.com/dvcrn/pocketsmith-ininal/state"
+)
+
+// istanbul is the time zone of the dates Ininal returns
+var istanbul = time.FixedZone("TRT", 3*60*60)
+
+func at(s string) time.Time {
+	t, err := time.ParseInLocation("2006-01-02 15:04", s, istanbul)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestDetectReversals(t *testing.T) {
+	tests := []struct {
+		name         string
+		transactions []ininal.Transaction
+		// expected maps the reference numbers of originals to their reversal
+		expected map[string]string
+	}{
+		{
+			name: "reversal type",
+			transactions: []ininal.Transaction{
+				{ReferenceNo: "1", TransactionDate: at("2024-03-01 10:00"), Amount: -50, TransactionType: "Alışveriş"},
+				{ReferenceNo: "2", TransactionDate: at("2024-03-02 10:00"), Amount: 50, TransactionType: "İade"},
+			},
+			expected: map[string]string{"1": "2"},
+		},
+		{
+			name: "most recent original before the reversal",
+			transactions: []ininal.Transaction{
+				{ReferenceNo: "1", TransactionDate: at("2024-03-01 10:00"), Amount: -50},
+				{ReferenceNo: "2", TransactionDate: at("2024-03-03 10:00"), Amount: -50},
+				{ReferenceNo: "3", TransactionDate: at("2024-03-04 10:00"), Amount: 50, TransactionType: "Refund"},
+				{ReferenceNo: "4", TransactionDate: at("2024-03-05 10:00"), Amount: -50},
+			},
+			expected: map[string]string{"2": "3"},
+		},
+		{
+			name: "reference wins over recency",
+			transactions: []ininal.Transaction{
+				{ReferenceNo: "1", TransactionDate: at("2024-03-01 10:00"), Amount: -20},
+				{ReferenceNo: "2", TransactionDate: at("2024-03-03 10:00"), Amount: -20},
+				{ReferenceNo: "3", TransactionDate: at("2024-03-04 10:00"), Amount: 20, Description: "Correction of 1"},
+			},
+			expected: map[string]string{"1": "3"},
+		},
+		{
+			name: "same timestamp",
+			transactions: []ininal.Transaction{
+				{ReferenceNo: "1", TransactionDate: at("2024-03-01 10:00"), Amount: -20},
+				{ReferenceNo: "2", TransactionDate: at("2024-03-01 10:00"), Amount: 20, TransactionType: "İptal"},
+			},
+			expected: map[string]string{"1": "2"},
+		},
+		{
+			name: "reversal before the original",
+			transactions: []ininal.Transaction{
+				{ReferenceNo: "1", TransactionDate: at("2024-03-02 10:00"), Amount: -20},
+				{ReferenceNo: "2", TransactionDate: at("2024-03-01 10:00"), Amount: 20, TransactionType: "İade"},
+			},
+			expected: map[string]string{},
+		},
+		{
+			name: "different amount",
+			transactions: []ininal.Transaction{
+				{ReferenceNo: "1", TransactionDate: at("2024-03-01 10:00"), Amount: -20},
+				{ReferenceNo: "2", TransactionDate: at("2024-03-02 10:00"), Amount: 19.99, TransactionType: "İade"},
+			},
+			expected: map[string]string{},
+		},
+		{
+			name: "opposite amounts without a reversal type or reference",
+			transactions: []ininal.Transaction{
+				{ReferenceNo: "1", TransactionDate: at("2024-03-01 10:00"), Amount: -100},
+				{ReferenceNo: "2", TransactionDate: at("2024-03-02 10:00"), Amount: 100, TransactionType: "Para Yükleme"},
+			},
+			expected: map[string]string{},
+		},
+		{
+			name: "each transaction is paired once",
+			transactions: []ininal.Transaction{
+				{ReferenceNo: "1", TransactionDate: at("2024-03-01 10:00"), Amount: -10},
+				{ReferenceNo: "2", TransactionDate: at("2024-03-02 10:00"), Amount: 10, TransactionType: "İade"},
+				{ReferenceNo: "3", TransactionDate: at("2024-03-03 10:00"), Amount: 10, TransactionType: "İade"},
+			},
+			expected: map[string]string{"1": "2"},
+		},
+	}
+
+	for _, test := range tests {
+		reversals := detectReversals(test.transactions, DEFAULT_REVERSAL_TYPES)
+		got := map[string]string{}
+		for _, r := range reversals {
+			got[r.original.ReferenceNo] = r.reversal.ReferenceNo
+		}
+		if len(got) != len(test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, got)
+			continue
+		}
+		for original, reversal := range test.expected {
+			if got[original] != reversal {
+				t.Errorf("%s: expected %v, got %v", test.name, test.expected, got)
+				break
+			}
+		}
+	}
+}
+
+func TestDetectDisappeared(t *testing.T) {
+	imports := map[string]*state.Import{
+		"listed":         {TransactionAccountID: 1, Date: at("2024-03-10 12:00")},
+		"other account":  {TransactionAccountID: 2, Date: at("2024-03-10 12:00")},
+		"first day":      {TransactionAccountID: 1, Date: at("2024-03-01 00:05")},
+		"last day":       {TransactionAccountID: 1, Date: at("2024-03-31 23:55")},
+		"day before":     {TransactionAccountID: 1, Date: at("2024-02-29 23:55")},
+		"early next day": {TransactionAccountID: 1, Date: at("2024-04-01 00:30")},
+		"later next day": {TransactionAccountID: 1, Date: at("2024-04-01 15:00")},
+	}
+	st := &state.State{Imports: imports}
+
+	// the window of a backfill chunk or a sync, as parsed from the flags
+	since, until := day("2024-03-01"), day("2024-03-31")
+	transactions := []ininal.Transaction{{ReferenceNo: "listed"}}
+
+	var got []string
+	for _, r := range detectDisappeared(st, 1, since, until, transactions) {
+		if r.reversal != nil {
+			t.Errorf("%s: disappeared transactions have no reversal", r.original.ReferenceNo)
+		}
+		got = append(got, r.original.ReferenceNo)
+	}
+	sort.Strings(got)
+
+	expected := []string{"first day", "last day"}
+	if len(got) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, got)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/dvcrn/pocketsmith-ininal/rules"
+)
+
+// ruleResult is a row of rules test
+type ruleResult struct {
+	accountTransaction
+	Payee string `json:"payee"`
+	// Rule is the name or number of the payee rule that matched
+	Rule string `json:"rule,omitempty"`
+	// Category is the category of the matching category rule or icon mapping,
+	// by title or ID
+	Category string `json:"category,omitempty"`
+	// Transfer is set when the transfer rules classify the transaction as a
+	// transfer
+	Transfer bool `json:"transfer"`
+	// Labels are the labels of the matching label rules and icon mapping
+	Labels []string `json:"labels,omitempty"`
+}
+
+func runRules(args []string) {
+	if len(args) == 0 || args[0] != "test" {
+		fail(EXIT_USAGE, fmt.Errorf("usage: rules test [flags]"))
+	}
+
+	fs := flag.NewFlagSet("rules test", flag.ExitOnError)
+	config := registerConfigFlags(fs)
+	registerWindowFlags(fs, config)
+	onlyAccount := fs.String("account", "", "Only use the transactions of the Ininal account with this account number or IBAN")
+	changed := fs.Bool("changed", false, "Only list transactions whose payee is rewritten by a rule")
+	output := registerOutputFlag(fs, OUTPUT_TABLE)
+	config.parse(fs, args[1:])
+	config = config.singleIdentity()
+	checkOutput(*output)
+
+	txRules, err := rules.Load(config.RulesFile)
+	if err != nil {
+		fail(EXIT_USAGE, err)
+	}
+
+	sess := loginOrFail(config)
+	transactions, failed := fetchTransactions(sess, config, selectAccounts(sess, *onlyAccount))
+
+	results := []ruleResult{}
+	matched, categorized := 0, 0
+	for _, tx := range transactions {
+		payee, rule := txRules.Payee(tx.Transaction)
+		result := ruleResult{accountTransaction: tx, Payee: payee}
+		if rule != nil {
+			matched++
+			result.Rule = rule.Name
+			if result.Rule == "" {
+				result.Rule = fmt.Sprint(ruleIndex(txRules.Payees, rule))
+			}
+		} else if *changed {
+			continue
+		}
+		if category := txRules.Category(tx.Transaction, payee); category != nil {
+			categorized++
+			result.Category = category.Category
+			if result.Category == "" {
+				result.Category = fmt.Sprintf("#%d", category.CategoryID)
+			}
+		} else if mapping := txRules.Icon(tx.Icon); mapping != nil && (mapping.Category != "" || mapping.CategoryID != 0) {
+			categorized++
+			result.Category = mapping.Category
+			if result.Category == "" {
+				result.Category = fmt.Sprintf("#%d", mapping.CategoryID)
+			}
+		}
+		result.Transfer = isTransfer(txRules, config.FXTypes, tx.Transaction, payee)
+		var iconLabels []string
+		if mapping := txRules.Icon(tx.Icon); mapping != nil {
+			iconLabels = mapping.Labels
+		}
+		result.Labels = mergeLabels(iconLabels, txRules.LabelsOf(tx.Transaction, payee))
+		results = append(results, result)
+	}
+
+	t := &table{
+		header: []string{"DATE", "DESCRIPTION", "TYPE", "AMOUNT", "CURRENCY", "PAYEE", "RULE", "CATEGORY", "TRANSFER", "LABELS"},
+		data:   results,
+	}
+	for _, r := range results {
+		t.add(r.TransactionDate.Format(DATE_FORMAT), strings.TrimSpace(r.Description), r.TransactionType, formatAmount(r.Amount), r.Currency, r.Payee, r.Rule, r.Category, fmt.Sprint(r.Transfer), strings.Join(r.Labels, ","))
+	}
+
+	if err := t.write(os.Stdout, *output); err != nil {
+		fail(EXIT_ERROR, err)
+	}
+	fmt.Fprintf(os.Stderr, "%d of %d transactions matched a payee rule, %d a category rule or icon mapping\n", matched, len(transactions), categorized)
+	if failed {
+		os.Exit(EXIT_PARTIAL)
+	}
+}
+
+// ruleIndex returns the 1-based position of rule
+func ruleIndex(payees []*rules.PayeeRule, rule *rules.PayeeRule) int {
+	for i, r := range payees {
+		if r == rule {
+			return i + 1
+		}
+	}
+	return 0
+}
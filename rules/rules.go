@@ -0,0 +1,514 @@
+// Package rules rewrites the data of Ininal transactions before they are
+// imported, with rules loaded from a YAML file
+package rules
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/dvcrn/pocketsmith-ininal/ininal"
+	"gopkg.in/yaml.v3"
+)
+
+// Amount signs a rule can match
+const (
+	// SIGN_DEBIT matches money leaving the account, negative amounts
+	SIGN_DEBIT = "debit"
+	// SIGN_CREDIT matches money coming in, positive amounts
+	SIGN_CREDIT = "credit"
+)
+
+// TextMatch matches a text field. Contains and Prefix ignore case, Regex is a
+// Go regular expression. All that are set must match. In YAML a plain string
+// is short for contains.
+type TextMatch struct {
+	Contains string `yaml:"contains,omitempty"`
+	Prefix   string `yaml:"prefix,omitempty"`
+	Regex    string `yaml:"regex,omitempty"`
+
+	regex *regexp.Regexp
+}
+
+func (t *TextMatch) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&t.Contains)
+	}
+	type plain TextMatch
+	return node.Decode((*plain)(t))
+}
+
+func (t *TextMatch) compile() error {
+	if t.Contains == "" && t.Prefix == "" && t.Regex == "" {
+		return fmt.Errorf("needs contains, prefix or regex")
+	}
+	if t.Regex != "" {
+		regex, err := regexp.Compile(t.Regex)
+		if err != nil {
+			return fmt.Errorf("invalid regex: %v", err)
+		}
+		t.regex = regex
+	}
+	return nil
+}
+
+// match reports whether s matches. The submatch indexes of the regex are
+// returned when it is set.
+func (t *TextMatch) match(s string) (bool, []int) {
+	if t.Contains != "" && !strings.Contains(fold(s), fold(t.Contains)) {
+		return false, nil
+	}
+	if t.Prefix != "" && !strings.HasPrefix(fold(s), fold(t.Prefix)) {
+		return false, nil
+	}
+	if t.regex != nil {
+		submatches := t.regex.FindStringSubmatchIndex(s)
+		if submatches == nil {
+			return false, nil
+		}
+		return true, submatches
+	}
+	return true, nil
+}
+
+// fold lower cases s for comparisons. The Turkish dotted and dotless i both
+// become i, so "TRANSFERİ" matches "transferi".
+func fold(s string) string {
+	return strings.NewReplacer("i̇", "i", "ı", "i").Replace(strings.ToLower(s))
+}
+
+// AmountRange matches the absolute amount, both bounds are inclusive
+type AmountRange struct {
+	Min *float64 `yaml:"min,omitempty"`
+	Max *float64 `yaml:"max,omitempty"`
+}
+
+// Match selects transactions. Every condition that is set must match.
+type Match struct {
+	Description *TextMatch `yaml:"description,omitempty"`
+	// Payee matches the payee after the payee rules, only in category rules
+	Payee *TextMatch `yaml:"payee,omitempty"`
+	// Type matches the Ininal transaction type, like "Banka Transferi"
+	Type *TextMatch `yaml:"type,omitempty"`
+	// Icon matches the icon Ininal shows for the transaction
+	Icon *TextMatch `yaml:"icon,omitempty"`
+	// Sign is debit or credit
+	Sign string `yaml:"sign,omitempty"`
+	// Currency matches the currency the transaction was made in, which is
+	// not the account currency for foreign card payments
+	Currency string `yaml:"currency,omitempty"`
+	// Amount matches the amount in the currency of the account
+	Amount *AmountRange `yaml:"amount,omitempty"`
+}
+
+func (m *Match) compile() error {
+	if m.Description == nil && m.Payee == nil && m.Type == nil && m.Icon == nil && m.Sign == "" && m.Currency == "" && m.Amount == nil {
+		return fmt.Errorf("match needs at least one condition")
+	}
+	for _, text := range []struct {
+		name  string
+		match *TextMatch
+	}{{"description", m.Description}, {"payee", m.Payee}, {"type", m.Type}, {"icon", m.Icon}} {
+		if text.match == nil {
+			continue
+		}
+		if err := text.match.compile(); err != nil {
+			return fmt.Errorf("%s %v", text.name, err)
+		}
+	}
+	if m.Sign != "" && m.Sign != SIGN_DEBIT && m.Sign != SIGN_CREDIT {
+		return fmt.Errorf("sign must be debit or credit, got %q", m.Sign)
+	}
+	if m.Amount != nil {
+		if m.Amount.Min == nil && m.Amount.Max == nil {
+			return fmt.Errorf("amount needs min or max")
+		}
+		if m.Amount.Min != nil && m.Amount.Max != nil && *m.Amount.Min > *m.Amount.Max {
+			return fmt.Errorf("amount min must not be larger than max")
+		}
+	}
+	return nil
+}
+
+// match reports whether transaction with payee matches. The submatch indexes
+// of the description regex are returned when it is set.
+func (m *Match) match(transaction ininal.Transaction, payee string) (bool, []int) {
+	var submatches []int
+	if m.Description != nil {
+		var ok bool
+		if ok, submatches = m.Description.match(strings.TrimSpace(transaction.Description)); !ok {
+			return false, nil
+		}
+	}
+	for _, text := range []struct {
+		match *TextMatch
+		value string
+	}{{m.Payee, payee}, {m.Type, transaction.TransactionType}, {m.Icon, transaction.Icon}} {
+		if text.match == nil {
+			continue
+		}
+		if ok, _ := text.match.match(strings.TrimSpace(text.value)); !ok {
+			return false, nil
+		}
+	}
+	switch m.Sign {
+	case SIGN_DEBIT:
+		if transaction.Amount >= 0 {
+			return false, nil
+		}
+	case SIGN_CREDIT:
+		if transaction.Amount <= 0 {
+			return false, nil
+		}
+	}
+	if m.Currency != "" && !strings.EqualFold(m.Currency, transaction.Currency) {
+		return false, nil
+	}
+	if m.Amount != nil {
+		amount := math.Abs(transaction.Amount)
+		if (m.Amount.Min != nil && amount < *m.Amount.Min) || (m.Amount.Max != nil && amount > *m.Amount.Max) {
+			return false, nil
+		}
+	}
+	return true, submatches
+}
+
+// PayeeRule rewrites the payee of the transactions it matches
+type PayeeRule struct {
+	// Name identifies the rule in the output of rules test
+	Name  string `yaml:"name,omitempty"`
+	Match Match  `yaml:"match"`
+	// Payee replaces the payee. The groups of a description regex can be used
+	// as $1 or ${name}.
+	Payee string `yaml:"payee"`
+}
+
+// CategoryRule sets the Pocketsmith category of the transactions it matches
+type CategoryRule struct {
+	Name  string `yaml:"name,omitempty"`
+	Match Match  `yaml:"match"`
+	// Category is the title of the Pocketsmith category, or "Parent/Child"
+	// when the title is not unique. CategoryID can be given instead.
+	Category   string `yaml:"category,omitempty"`
+	CategoryID int    `yaml:"category_id,omitempty"`
+}
+
+// TransferRule classifies the transactions it matches as transfers between
+// accounts, or as no transfers with transfer: false
+type TransferRule struct {
+	Name  string `yaml:"name,omitempty"`
+	Match Match  `yaml:"match"`
+	// Transfer is true when left out
+	Transfer *bool `yaml:"transfer,omitempty"`
+}
+
+// IsTransfer reports whether the transactions the rule matches are transfers
+func (rule *TransferRule) IsTransfer() bool {
+	return rule.Transfer == nil || *rule.Transfer
+}
+
+// LabelRule adds labels to the transactions it matches
+type LabelRule struct {
+	Name   string   `yaml:"name,omitempty"`
+	Match  Match    `yaml:"match"`
+	Labels []string `yaml:"labels"`
+}
+
+// FeeRule recognizes the fees Ininal charges. A fee that is a transaction of
+// its own gets the category of the rule. A fee bundled into a purchase, given
+// by Fee and Percent, is split off into a transaction of its own with the
+// category of the rule.
+type FeeRule struct {
+	Name  string `yaml:"name,omitempty"`
+	Match Match  `yaml:"match"`
+	// Kind groups the fees in the fee summary, like cash-withdrawal or fx
+	Kind       string `yaml:"kind"`
+	Category   string `yaml:"category,omitempty"`
+	CategoryID int    `yaml:"category_id,omitempty"`
+	// Fee is the fixed part of a bundled fee, in the currency of the account
+	Fee float64 `yaml:"fee,omitempty"`
+	// Percent is the part of a bundled fee that is a percentage of the
+	// purchase without the fee
+	Percent float64 `yaml:"percent,omitempty"`
+}
+
+// Bundled reports whether the rule matches purchases with a fee bundled into
+// their amount
+func (rule *FeeRule) Bundled() bool {
+	return rule.Fee != 0 || rule.Percent != 0
+}
+
+// FeeAmount returns the positive fee bundled into amount, rounded to cents.
+// It is 0 when the fee would be the whole amount.
+func (rule *FeeRule) FeeAmount(amount float64) float64 {
+	total := math.Abs(amount)
+	purchase := (total - rule.Fee) / (1 + rule.Percent/100)
+	if purchase <= 0 {
+		return 0
+	}
+	return math.Round((total-purchase)*100) / 100
+}
+
+// IconMapping assigns a category and labels to the transactions with an Ininal
+// icon. The category is only used when no category rule matches.
+type IconMapping struct {
+	Category   string   `yaml:"category,omitempty"`
+	CategoryID int      `yaml:"category_id,omitempty"`
+	Labels     []string `yaml:"labels,omitempty"`
+}
+
+// Rules is the content of the rules file
+type Rules struct {
+	// Payees are tried in order, the first matching rule sets the payee
+	Payees []*PayeeRule `yaml:"payees"`
+	// Categories are tried in order, the first matching rule sets the category
+	Categories []*CategoryRule `yaml:"categories"`
+	// Transfers are tried in order, the first matching rule decides whether a
+	// transaction is a transfer
+	Transfers []*TransferRule `yaml:"transfers"`
+	// Fees are tried in order, the first matching rule recognizes a fee
+	Fees []*FeeRule `yaml:"fees"`
+	// Labels are all applied, every matching rule adds its labels
+	Labels []*LabelRule `yaml:"labels"`
+	// Icons maps Ininal icons, like the ones listed by the icons command, to
+	// categories and labels
+	Icons map[string]*IconMapping `yaml:"icons"`
+}
+
+// Load reads the rules file at path. A missing file results in no rules.
+func Load(path string) (*Rules, error) {
+	if path == "" {
+		return &Rules{}, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Rules{}, nil
+		}
+		return nil, fmt.Errorf("failed to read rules file: %v", err)
+	}
+
+	rules, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rules file %s: %v", path, err)
+	}
+	return rules, nil
+}
+
+// Parse decodes and checks rules. All invalid rules are reported at once.
+func Parse(data []byte) (*Rules, error) {
+	rules := &Rules{}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(rules); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	var errs []error
+	for i, rule := range rules.Payees {
+		if err := rule.Match.compile(); err != nil {
+			errs = append(errs, fmt.Errorf("payee rule %s: %v", ruleName(i, rule.Name), err))
+		}
+		if rule.Match.Payee != nil {
+			errs = append(errs, fmt.Errorf("payee rule %s: payee rules can't match the payee", ruleName(i, rule.Name)))
+		}
+		if strings.TrimSpace(rule.Payee) == "" {
+			errs = append(errs, fmt.Errorf("payee rule %s: payee is required", ruleName(i, rule.Name)))
+		}
+	}
+	for i, rule := range rules.Categories {
+		if err := rule.Match.compile(); err != nil {
+			errs = append(errs, fmt.Errorf("category rule %s: %v", ruleName(i, rule.Name), err))
+		}
+		if (rule.Category == "") == (rule.CategoryID == 0) {
+			errs = append(errs, fmt.Errorf("category rule %s: needs either category or category_id", ruleName(i, rule.Name)))
+		}
+	}
+	for i, rule := range rules.Transfers {
+		if err := rule.Match.compile(); err != nil {
+			errs = append(errs, fmt.Errorf("transfer rule %s: %v", ruleName(i, rule.Name), err))
+		}
+	}
+	for i, rule := range rules.Fees {
+		if err := rule.Match.compile(); err != nil {
+			errs = append(errs, fmt.Errorf("fee rule %s: %v", ruleName(i, rule.Name), err))
+		}
+		if strings.TrimSpace(rule.Kind) == "" {
+			errs = append(errs, fmt.Errorf("fee rule %s: kind is required", ruleName(i, rule.Name)))
+		}
+		if (rule.Category == "") == (rule.CategoryID == 0) {
+			errs = append(errs, fmt.Errorf("fee rule %s: needs either category or category_id", ruleName(i, rule.Name)))
+		}
+		if rule.Fee < 0 || rule.Percent < 0 {
+			errs = append(errs, fmt.Errorf("fee rule %s: fee and percent must not be negative", ruleName(i, rule.Name)))
+		}
+	}
+	for i, rule := range rules.Labels {
+		if err := rule.Match.compile(); err != nil {
+			errs = append(errs, fmt.Errorf("label rule %s: %v", ruleName(i, rule.Name), err))
+		}
+		if len(rule.Labels) == 0 {
+			errs = append(errs, fmt.Errorf("label rule %s: labels are required", ruleName(i, rule.Name)))
+		}
+		if err := checkLabels(rule.Labels); err != nil {
+			errs = append(errs, fmt.Errorf("label rule %s: %v", ruleName(i, rule.Name), err))
+		}
+	}
+	icons := make([]string, 0, len(rules.Icons))
+	for icon := range rules.Icons {
+		icons = append(icons, icon)
+	}
+	sort.Strings(icons)
+	for _, icon := range icons {
+		mapping := rules.Icons[icon]
+		if mapping == nil || (mapping.Category == "" && mapping.CategoryID == 0 && len(mapping.Labels) == 0) {
+			errs = append(errs, fmt.Errorf("icon %s: needs category, category_id or labels", icon))
+			continue
+		}
+		if mapping.Category != "" && mapping.CategoryID != 0 {
+			errs = append(errs, fmt.Errorf("icon %s: needs either category or category_id", icon))
+		}
+		if err := checkLabels(mapping.Labels); err != nil {
+			errs = append(errs, fmt.Errorf("icon %s: %v", icon, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return rules, nil
+}
+
+// checkLabels rejects labels Pocketsmith can't store, they are sent as a
+// comma separated list
+func checkLabels(labels []string) error {
+	for _, label := range labels {
+		if strings.TrimSpace(label) == "" || strings.Contains(label, ",") {
+			return fmt.Errorf("invalid label %q, labels must not be empty or contain commas", label)
+		}
+	}
+	return nil
+}
+
+func ruleName(i int, name string) string {
+	if name != "" {
+		return fmt.Sprintf("%d (%s)", i+1, name)
+	}
+	return fmt.Sprint(i + 1)
+}
+
+// Payee returns the payee of transaction and the rule that set it. Without a
+// matching rule it is the trimmed description and rule is nil.
+func (r *Rules) Payee(transaction ininal.Transaction) (payee string, rule *PayeeRule) {
+	description := strings.TrimSpace(transaction.Description)
+	if r == nil {
+		return description, nil
+	}
+
+	for _, rule := range r.Payees {
+		ok, submatches := rule.Match.match(transaction, "")
+		if !ok {
+			continue
+		}
+
+		payee := rule.Payee
+		if submatches != nil {
+			payee = string(rule.Match.Description.regex.ExpandString(nil, rule.Payee, description, submatches))
+		}
+		// collapse the whitespace left by empty groups
+		if payee = strings.Join(strings.Fields(payee), " "); payee != "" {
+			return payee, rule
+		}
+	}
+
+	return description, nil
+}
+
+// Icon returns the mapping of the Ininal icon, or nil
+func (r *Rules) Icon(icon string) *IconMapping {
+	if r == nil || icon == "" {
+		return nil
+	}
+	return r.Icons[strings.TrimSpace(icon)]
+}
+
+// Categorizes reports whether any rule or icon mapping sets a category
+func (r *Rules) Categorizes() bool {
+	if r == nil {
+		return false
+	}
+	if len(r.Categories) > 0 {
+		return true
+	}
+	for _, mapping := range r.Icons {
+		if mapping.Category != "" || mapping.CategoryID != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Category returns the first category rule matching transaction with payee,
+// or nil
+func (r *Rules) Category(transaction ininal.Transaction, payee string) *CategoryRule {
+	if r == nil {
+		return nil
+	}
+	for _, rule := range r.Categories {
+		if ok, _ := rule.Match.match(transaction, payee); ok {
+			return rule
+		}
+	}
+	return nil
+}
+
+// Transfer returns the first transfer rule matching transaction with payee,
+// or nil
+func (r *Rules) Transfer(transaction ininal.Transaction, payee string) *TransferRule {
+	if r == nil {
+		return nil
+	}
+	for _, rule := range r.Transfers {
+		if ok, _ := rule.Match.match(transaction, payee); ok {
+			return rule
+		}
+	}
+	return nil
+}
+
+// Fee returns the first fee rule matching transaction with payee, or nil
+func (r *Rules) Fee(transaction ininal.Transaction, payee string) *FeeRule {
+	if r == nil {
+		return nil
+	}
+	for _, rule := range r.Fees {
+		if ok, _ := rule.Match.match(transaction, payee); ok {
+			return rule
+		}
+	}
+	return nil
+}
+
+// LabelsOf returns the labels of all label rules matching transaction with
+// payee, in the order of the rules
+func (r *Rules) LabelsOf(transaction ininal.Transaction, payee string) []string {
+	if r == nil {
+		return nil
+	}
+	var labels []string
+	for _, rule := range r.Labels {
+		if ok, _ := rule.Match.match(transaction, payee); ok {
+			labels = append(labels, rule.Labels...)
+		}
+	}
+	return labels
+}
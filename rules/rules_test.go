@@ -0,0 +1,473 @@
+package rules
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/dvcrn/pocketsmith-ininal/ininal"
+)
+
+func loadTestRules(t *testing.T) *Rules {
+	t.Helper()
+	data, err := os.ReadFile("testdata/rules.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := Parse(data)
+	if err != nil {
+		t.Fatalf("failed to parse rules: %v", err)
+	}
+	return rules
+}
+
+// descriptions seen in Ininal transaction lists
+func TestPayeeCorpus(t *testing.T) {
+	rules := loadTestRules(t)
+
+	tests := []struct {
+		description     string
+		transactionType string
+		amount          float64
+		currency        string
+		payee           string
+		rule            string
+	}{
+		{"MIGROS 1234 ISTANBUL TR", "Alışveriş", -152.40, "TRY", "Migros", "migros"},
+		{"Migros Jet Kadikoy", "Alışveriş", -23.50, "TRY", "Migros", "migros"},
+		{"A101 YENI MAGAZACILIK ISTANBUL TR", "Alışveriş", -87.25, "TRY", "A101 YENI MAGAZACILIK", "card purchase with location"},
+		{"BIM BIRLESIK MAGAZALAR 4471 ANKARA TR", "Alışveriş", -45, "TRY", "BIM BIRLESIK MAGAZALAR", "card purchase with location"},
+		{"  SOK MARKET 0912 İSTANBUL TR  ", "Alışveriş", -19.9, "TRY", "SOK MARKET", "card purchase with location"},
+		{"Banka Transferi - AHMET YILMAZ", "Banka Transferi", 500, "TRY", "Transfer AHMET YILMAZ", "bank transfer"},
+		{"MEHMET KAYA", "BANKA TRANSFERİ", -250, "TRY", "Transfer MEHMET KAYA", "bank transfer"},
+		{"Kredi Kartından Para Yükleme", "Para Yükleme", 1000, "TRY", "Top-up", "top-up"},
+		{"NETFLIX.COM AMSTERDAM NL", "Alışveriş", -15.49, "USD", "NETFLIX", "online in foreign currency"},
+		{"SPOTIFY P1A2B3C4 STOCKHOLM SE", "Alışveriş", -9.99, "USD", "SPOTIFY P1A2B3C4 STOCKHOLM SE", ""},
+		// a refund of a card purchase is a credit, the location rule only takes debits
+		{"A101 YENI MAGAZACILIK ISTANBUL TR", "İade", 87.25, "TRY", "A101 YENI MAGAZACILIK ISTANBUL TR", ""},
+		{"Kart Aidatı", "Ücret", -7.5, "TRY", "Kart Aidatı", ""},
+	}
+
+	for _, test := range tests {
+		payee, rule := rules.Payee(ininal.Transaction{
+			Description:     test.description,
+			TransactionType: test.transactionType,
+			Amount:          test.amount,
+			Currency:        test.currency,
+		})
+		if payee != test.payee {
+			t.Errorf("%q: expected payee %q, got %q", test.description, test.payee, payee)
+		}
+
+		name := ""
+		if rule != nil {
+			name = rule.Name
+		}
+		if name != test.rule {
+			t.Errorf("%q: expected rule %q, got %q", test.description, test.rule, name)
+		}
+	}
+}
+
+func TestCategoryCorpus(t *testing.T) {
+	rules := loadTestRules(t)
+
+	tests := []struct {
+		description     string
+		transactionType string
+		icon            string
+		amount          float64
+		currency        string
+		rule            string
+	}{
+		{"MIGROS 1234 ISTANBUL TR", "Alışveriş", "market", -152.40, "TRY", "groceries"},
+		// the payee rule turns the description into "A101 YENI MAGAZACILIK"
+		{"A101 YENI MAGAZACILIK ISTANBUL TR", "Alışveriş", "market", -87.25, "TRY", "groceries"},
+		{"Banka Transferi - AHMET YILMAZ", "Banka Transferi", "transfer", 100, "TRY", "small transfers"},
+		{"Banka Transferi - AHMET YILMAZ", "Banka Transferi", "transfer", -100.01, "TRY", "transfers"},
+		{"NETFLIX.COM AMSTERDAM NL", "Alışveriş", "entertainment", -15.49, "USD", "streaming"},
+		{"NETFLIX.COM AMSTERDAM NL", "Alışveriş", "entertainment", -15.49, "TRY", ""},
+		{"Kart Aidatı", "Ücret", "fee", -7.5, "TRY", ""},
+	}
+
+	for _, test := range tests {
+		transaction := ininal.Transaction{
+			Description:     test.description,
+			TransactionType: test.transactionType,
+			Icon:            test.icon,
+			Amount:          test.amount,
+			Currency:        test.currency,
+		}
+		payee, _ := rules.Payee(transaction)
+		rule := rules.Category(transaction, payee)
+
+		name := ""
+		if rule != nil {
+			name = rule.Name
+		}
+		if name != test.rule {
+			t.Errorf("%q %.2f %s: expected category rule %q, got %q", test.description, test.amount, test.currency, test.rule, name)
+		}
+	}
+}
+
+func TestTransferCorpus(t *testing.T) {
+	rules := loadTestRules(t)
+
+	tests := []struct {
+		description     string
+		transactionType string
+		icon            string
+		rule            string
+		transfer        bool
+	}{
+		{"Kredi Kartından Yükleme", "Para Yükleme", "topup", "top-ups", true},
+		{"ininal Cashback", "Para Yükleme", "topup", "not a transfer", false},
+		{"MEHMET KAYA", "Para Gönderme", "transfer", "wallet sends", true},
+		{"USD Hesabına Aktarım", "Döviz Alış", "exchange", "fx", true},
+		{"MIGROS 1234 ISTANBUL TR", "Alışveriş", "market", "", false},
+	}
+
+	for _, test := range tests {
+		transaction := ininal.Transaction{
+			Description:     test.description,
+			TransactionType: test.transactionType,
+			Icon:            test.icon,
+		}
+		payee, _ := rules.Payee(transaction)
+		rule := rules.Transfer(transaction, payee)
+
+		name, transfer := "", false
+		if rule != nil {
+			name, transfer = rule.Name, rule.IsTransfer()
+		}
+		if name != test.rule || transfer != test.transfer {
+			t.Errorf("%q: expected transfer rule %q (%v), got %q (%v)", test.description, test.rule, test.transfer, name, transfer)
+		}
+	}
+}
+
+func TestIcons(t *testing.T) {
+	rules := loadTestRules(t)
+
+	if mapping := rules.Icon("market"); mapping == nil || mapping.Category != "Groceries" || len(mapping.Labels) != 1 {
+		t.Errorf("unexpected mapping of market: %+v", mapping)
+	}
+	if mapping := rules.Icon("atm"); mapping == nil || mapping.Category != "" || mapping.Labels[0] != "cash-withdrawal" {
+		t.Errorf("unexpected mapping of atm: %+v", mapping)
+	}
+	if mapping := rules.Icon("unknown"); mapping != nil {
+		t.Errorf("expected no mapping, got %+v", mapping)
+	}
+	if mapping := rules.Icon(""); mapping != nil {
+		t.Errorf("expected no mapping for an empty icon, got %+v", mapping)
+	}
+
+	labelsOnly, err := Parse([]byte("icons:\n  atm:\n    labels: [cash]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if labelsOnly.Categorizes() {
+		t.Error("labels only must not count as categorizing")
+	}
+	if !rules.Categorizes() {
+		t.Error("expected the test rules to categorize")
+	}
+
+	_, err = Parse([]byte(`
+icons:
+  a: {}
+  b:
+    category: Fees
+    category_id: 1
+  c:
+    labels: ["x,y"]
+`))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, expected := range []string{
+		"icon a: needs category, category_id or labels",
+		"icon b: needs either category or category_id",
+		`icon c: invalid label "x,y"`,
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected %q in %q", expected, err)
+		}
+	}
+}
+
+func TestLabels(t *testing.T) {
+	rules := loadTestRules(t)
+
+	tests := []struct {
+		description     string
+		transactionType string
+		icon            string
+		amount          float64
+		labels          string
+	}{
+		{"ATM ISTANBUL", "Para Çekme", "atm", -200, "cash-withdrawal"},
+		{"Kredi Kartından Para Yükleme", "Para Yükleme", "topup", 1000, "top-up"},
+		// the payee rule turns the description into "Migros"
+		{"MIGROS 1234 ISTANBUL TR", "Alışveriş", "market", -152.40, "groceries,food"},
+		{"Kart Aidatı", "Ücret", "fee", -7.5, ""},
+	}
+
+	for _, test := range tests {
+		transaction := ininal.Transaction{
+			Description:     test.description,
+			TransactionType: test.transactionType,
+			Icon:            test.icon,
+			Amount:          test.amount,
+		}
+		payee, _ := rules.Payee(transaction)
+		if labels := strings.Join(rules.LabelsOf(transaction, payee), ","); labels != test.labels {
+			t.Errorf("%q: expected labels %q, got %q", test.description, test.labels, labels)
+		}
+	}
+
+	_, err := Parse([]byte(`
+labels:
+  - match:
+      icon: atm
+  - match:
+      icon: atm
+    labels: ["a,b"]
+`))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, expected := range []string{
+		"label rule 1: labels are required",
+		`label rule 2: invalid label "a,b"`,
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected %q in %q", expected, err)
+		}
+	}
+}
+
+func TestFees(t *testing.T) {
+	rules := loadTestRules(t)
+
+	tests := []struct {
+		description     string
+		transactionType string
+		icon            string
+		amount          float64
+		rule            string
+		fee             float64
+	}{
+		{"Kart Aidatı", "Ücret", "fee", -7.5, "card fee", 0},
+		// 200 withdrawn with a fee of 5 and 1%
+		{"ATM ISTANBUL", "Para Çekme", "atm", -207, "atm fee", 7},
+		{"ATM ISTANBUL", "Para Çekme", "atm", -4, "atm fee", 0},
+		// a refund at the ATM is no fee
+		{"ATM ISTANBUL", "Para Çekme", "atm", 207, "", 0},
+		{"MIGROS 1234 ISTANBUL TR", "Alışveriş", "market", -152.40, "", 0},
+	}
+
+	for _, test := range tests {
+		transaction := ininal.Transaction{
+			Description:     test.description,
+			TransactionType: test.transactionType,
+			Icon:            test.icon,
+			Amount:          test.amount,
+		}
+		payee, _ := rules.Payee(transaction)
+		rule := rules.Fee(transaction, payee)
+
+		name, fee := "", 0.0
+		if rule != nil {
+			name = rule.Name
+			if rule.Bundled() {
+				fee = rule.FeeAmount(test.amount)
+			}
+		}
+		if name != test.rule || fee != test.fee {
+			t.Errorf("%q %.2f: expected fee rule %q (%.2f), got %q (%.2f)", test.description, test.amount, test.rule, test.fee, name, fee)
+		}
+	}
+
+	_, err := Parse([]byte(`
+fees:
+  - match:
+      icon: atm
+    category: Fees
+  - match:
+      icon: atm
+    kind: atm
+    fee: -1
+  - match:
+      icon: atm
+    kind: atm
+    category: Fees
+    category_id: 1
+`))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, expected := range []string{
+		"fee rule 1: kind is required",
+		"fee rule 2: needs either category or category_id",
+		"fee rule 2: fee and percent must not be negative",
+		"fee rule 3: needs either category or category_id",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected %q in %q", expected, err)
+		}
+	}
+}
+
+func TestAmountRange(t *testing.T) {
+	min, max := 10.0, 20.0
+	tests := []struct {
+		amountRange AmountRange
+		amount      float64
+		ok          bool
+	}{
+		{AmountRange{Min: &min}, -10, true},
+		{AmountRange{Min: &min}, 9.99, false},
+		{AmountRange{Max: &max}, 20, true},
+		{AmountRange{Max: &max}, -20.01, false},
+		{AmountRange{Min: &min, Max: &max}, 15, true},
+		{AmountRange{Min: &min, Max: &max}, 25, false},
+	}
+
+	for _, test := range tests {
+		match := Match{Amount: &test.amountRange}
+		if err := match.compile(); err != nil {
+			t.Fatal(err)
+		}
+		if ok, _ := match.match(ininal.Transaction{Amount: test.amount}, ""); ok != test.ok {
+			t.Errorf("%.2f: expected %v, got %v", test.amount, test.ok, ok)
+		}
+	}
+}
+
+func TestTextMatch(t *testing.T) {
+	tests := []struct {
+		match TextMatch
+		s     string
+		ok    bool
+	}{
+		{TextMatch{Contains: "transfer"}, "Banka Transferi", true},
+		{TextMatch{Contains: "transferi"}, "BANKA TRANSFERİ", true},
+		{TextMatch{Contains: "ııı"}, "III", true},
+		{TextMatch{Prefix: "banka"}, "Banka Transferi", true},
+		{TextMatch{Prefix: "transfer"}, "Banka Transferi", false},
+		{TextMatch{Regex: `^\d+$`}, "12345", true},
+		{TextMatch{Regex: `^\d+$`}, "12a45", false},
+		{TextMatch{Prefix: "banka", Regex: "Havale"}, "Banka Transferi", false},
+	}
+
+	for _, test := range tests {
+		if err := test.match.compile(); err != nil {
+			t.Fatal(err)
+		}
+		if ok, _ := test.match.match(test.s); ok != test.ok {
+			t.Errorf("%+v on %q: expected %v, got %v", test.match, test.s, test.ok, ok)
+		}
+	}
+}
+
+func TestMatchSignAndCurrency(t *testing.T) {
+	match := Match{Sign: SIGN_DEBIT, Currency: "try"}
+	if err := match.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		amount   float64
+		currency string
+		ok       bool
+	}{
+		{-10, "TRY", true},
+		{10, "TRY", false},
+		{0, "TRY", false},
+		{-10, "USD", false},
+	}
+	for _, test := range tests {
+		if ok, _ := match.match(ininal.Transaction{Amount: test.amount, Currency: test.currency}, ""); ok != test.ok {
+			t.Errorf("%.2f %s: expected %v, got %v", test.amount, test.currency, test.ok, ok)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	_, err := Parse([]byte(`
+payees:
+  - match: {}
+    payee: Nobody
+  - name: broken
+    match:
+      description:
+        regex: '('
+    payee: Broken
+  - match:
+      sign: outgoing
+    payee: Out
+  - match:
+      description: x
+`))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, expected := range []string{
+		"payee rule 1: match needs at least one condition",
+		"payee rule 2 (broken): description invalid regex",
+		"payee rule 3: sign must be debit or credit",
+		"payee rule 4: payee is required",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected %q in %q", expected, err)
+		}
+	}
+
+	_, err = Parse([]byte(`
+payees:
+  - match:
+      payee: x
+    payee: y
+categories:
+  - match:
+      amount: {}
+    category: Fees
+  - name: both
+    match:
+      sign: debit
+    category: Fees
+    category_id: 1
+  - match:
+      amount: {min: 5, max: 1}
+    category: Fees
+`))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, expected := range []string{
+		"payee rule 1: payee rules can't match the payee",
+		"category rule 1: amount needs min or max",
+		"category rule 2 (both): needs either category or category_id",
+		"category rule 3: amount min must not be larger than max",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected %q in %q", expected, err)
+		}
+	}
+
+	if _, err := Parse([]byte("payee:\n  - payee: x\n")); err == nil {
+		t.Error("expected an error for an unknown field")
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	rules, err := Load("testdata/missing.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payee, rule := rules.Payee(ininal.Transaction{Description: " GETIR "}); payee != "GETIR" || rule != nil {
+		t.Errorf("expected the trimmed description, got %q", payee)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// SECRET_FLAGS are the flags holding credentials. Their environment variables
+// can also be given as <VAR>_FILE, and their values can be secret references.
+var SECRET_FLAGS = map[string]bool{
+	"device-id":          true,
+	"login-token":        true,
+	"user-token":         true,
+	"login-bearer-token": true,
+	"pocketsmith-token":  true,
+	"password":           true,
+	"login-credential":   true,
+	"device-signature":   true,
+	"api-token":          true,
+}
+
+// Secret reference prefixes
+const (
+	// SECRET_FILE reads the secret from a file, like a mounted Docker secret
+	SECRET_FILE = "file://"
+	// SECRET_ENV reads the secret from another environment variable
+	SECRET_ENV = "env://"
+	// SECRET_EXEC runs a command with sh and uses its output, for example a
+	// password manager CLI
+	SECRET_EXEC = "exec://"
+)
+
+// readSecretFile reads a secret from path. Surrounding whitespace, like the
+// trailing newline most editors add, is removed.
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file: %v", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// resolveSecret returns the secret value references. Values without one of
+// the SECRET_* prefixes are returned as they are.
+func resolveSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, SECRET_FILE):
+		return readSecretFile(strings.TrimPrefix(value, SECRET_FILE))
+
+	case strings.HasPrefix(value, SECRET_ENV):
+		name := strings.TrimPrefix(value, SECRET_ENV)
+		secret, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return secret, nil
+
+	case strings.HasPrefix(value, SECRET_EXEC):
+		cmd := exec.Command("sh", "-c", strings.TrimPrefix(value, SECRET_EXEC))
+		cmd.Stderr = os.Stderr
+		var out bytes.Buffer
+		cmd.Stdout = &out
+		if err := cmd.Run(); err != nil {
+			// the command line may itself be sensitive, so it isn't repeated
+			return "", fmt.Errorf("failed to run secret command: %v", err)
+		}
+		return strings.TrimSpace(out.String()), nil
+	}
+
+	return value, nil
+}
+
+// resolveSecrets replaces the secret references in the credentials of config
+// and its identities
+func (config *Config) resolveSecrets() []error {
+	var errs []error
+
+	resolve := func(value *string, name string) {
+		secret, err := resolveSecret(*value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", name, err))
+			return
+		}
+		*value = secret
+	}
+
+	credentials := func(ininal *IninalConfig, pocketsmith *PocketsmithConfig, prefix string) {
+		resolve(&ininal.DeviceID, prefix+"ininal.device_id")
+		resolve(&ininal.LoginToken, prefix+"ininal.login_token")
+		resolve(&ininal.UserToken, prefix+"ininal.user_token")
+		resolve(&ininal.LoginBearerToken, prefix+"ininal.login_bearer_token")
+		resolve(&ininal.Password, prefix+"ininal.password")
+		resolve(&ininal.LoginCredential, prefix+"ininal.login_credential")
+		resolve(&ininal.DeviceSignature, prefix+"ininal.device_signature")
+		resolve(&pocketsmith.PocketsmithToken, prefix+"pocketsmith.token")
+	}
+
+	credentials(&config.IninalConfig, &config.PocketsmithConfig, "")
+	resolve(&config.API.Token, "api.token")
+	for i := range config.Identities {
+		identity := &config.Identities[i]
+		credentials(&identity.IninalConfig, &identity.PocketsmithConfig, fmt.Sprintf("identity %s: ", identity.Name))
+	}
+
+	return errs
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dvcrn/pocketsmith-ininal/ininal"
+)
+
+// session holds the tokens obtained after logging into Ininal
+type session struct {
+	client      *ininal.Client
+	userToken   string
+	userAuth    string
+	cardAccount *ininal.CardAccount
+}
+
+// cachedSession is the part of a session kept in the session file
+type cachedSession struct {
+	// LoginCredential and DeviceID identify the login the session belongs to
+	LoginCredential string    `json:"loginCredential"`
+	DeviceID        string    `json:"deviceId"`
+	UserToken       string    `json:"userToken"`
+	UserAuth        string    `json:"userAuth"`
+	CreatedAt       time.Time `json:"createdAt"`
+}
+
+// login returns a session for the Ininal login of config. A cached session is
+// reused while Ininal still accepts it, otherwise a new one is created.
+func login(config *Config) (*session, error) {
+	client := ininal.NewClient()
+
+	if cached := loadSession(config); cached != nil {
+		cardAccount, err := client.GetUserCardAccount(config.DeviceID, cached.UserToken, cached.UserAuth)
+		if err == nil {
+			fmt.Fprintln(os.Stderr, "Using the cached Ininal session from", cached.CreatedAt.Format(time.RFC3339))
+			return &session{
+				client:      client,
+				userToken:   cached.UserToken,
+				userAuth:    cached.UserAuth,
+				cardAccount: cardAccount,
+			}, nil
+		}
+		fmt.Fprintf(os.Stderr, "The cached Ininal session is no longer valid, logging in again: %v\n", err)
+	}
+
+	return newSession(config, client)
+}
+
+// newSession logs into Ininal, asking for the OTP when needed, and caches the session
+func newSession(config *Config, client *ininal.Client) (sess *session, err error) {
+	defer func() { recordLogin(config, err) }()
+
+	var userToken string
+	var userAuth string
+
+	// First login step
+	loginResp, err := client.Login(
+		config.Password,
+		config.DeviceID,
+		config.LoginCredential,
+		config.LoginToken,
+		config.LoginBearerToken,
+		config.DeviceSignature,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// wait and ask for OTP
+	if loginResp.Response.AuthStatus == "OTP_REQUIRED" {
+		otp, err := readOTP(config)
+		if err != nil {
+			return nil, err
+		}
+
+		verifyResp, err := client.Verify(otp, loginResp.Response.Token, config.LoginBearerToken)
+		if err != nil {
+			return nil, err
+		}
+
+		userToken = verifyResp.Response.UserToken
+		userAuth = verifyResp.Response.Token
+	} else {
+		fmt.Fprintln(os.Stderr, "OTP not required")
+		userToken = loginResp.Response.UserToken
+		userAuth = loginResp.Response.Token
+	}
+
+	cardAccount, err := client.GetUserCardAccount(config.DeviceID, userToken, userAuth)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := saveSession(config, &cachedSession{
+		LoginCredential: config.LoginCredential,
+		DeviceID:        config.DeviceID,
+		UserToken:       userToken,
+		UserAuth:        userAuth,
+		CreatedAt:       time.Now(),
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "Error caching the Ininal session: %v\n", err)
+	}
+
+	return &session{
+		client:      client,
+		userToken:   userToken,
+		userAuth:    userAuth,
+		cardAccount: cardAccount,
+	}, nil
+}
+
+// loadSession returns the cached session of the login of config, if any.
+// With a vault the session is kept in the vault instead of the session file.
+func loadSession(config *Config) *cachedSession {
+	var cached cachedSession
+	if config.vault != nil {
+		login := config.vault.data.Logins[config.Identity]
+		if login == nil || login.Session == nil {
+			return nil
+		}
+		cached = *login.Session
+	} else {
+		if config.SessionFile == "" {
+			return nil
+		}
+
+		data, err := os.ReadFile(config.SessionFile)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				fmt.Fprintf(os.Stderr, "Error reading the session file: %v\n", err)
+			}
+			return nil
+		}
+
+		if err := json.Unmarshal(data, &cached); err != nil {
+			fmt.Fprintf(os.Stderr, "Error decoding the session file: %v\n", err)
+			return nil
+		}
+	}
+
+	if cached.LoginCredential != config.LoginCredential || cached.DeviceID != config.DeviceID {
+		return nil
+	}
+
+	return &cached
+}
+
+// saveSession writes the session file. It holds credentials, so it is only
+// readable by the current user.
+func saveSession(config *Config, cached *cachedSession) error {
+	if config.vault != nil {
+		config.vault.login(config.Identity).Session = cached
+		return config.vault.save()
+	}
+	if config.SessionFile == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(cached, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode session: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(config.SessionFile), filepath.Base(config.SessionFile)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary session file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write session file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write session file: %v", err)
+	}
+
+	if err := os.Rename(tmp.Name(), config.SessionFile); err != nil {
+		return fmt.Errorf("failed to replace session file: %v", err)
+	}
+
+	return nil
+}
+
+// removeSession deletes the session file
+func removeSession(config *Config) error {
+	if config.vault != nil {
+		if login := config.vault.data.Logins[config.Identity]; login != nil && login.Session != nil {
+			login.Session = nil
+			return config.vault.save()
+		}
+		return nil
+	}
+	if config.SessionFile == "" {
+		return nil
+	}
+	if err := os.Remove(config.SessionFile); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove session file: %v", err)
+	}
+	return nil
+}
+
+func (s *session) transactions(accountNumber string, startDate, endDate time.Time, resultLimit int) ([]ininal.Transaction, error) {
+	return s.client.GetUserTransactions(
+		s.userToken,
+		s.cardAccount.AccessToken,
+		accountNumber,
+		startDate,
+		endDate,
+		resultLimit,
+	)
+}
+
+// findAccount returns the Ininal account with the given account number or IBAN
+func (s *session) findAccount(numberOrIban string) (ininal.AccountInfo, bool) {
+	iban := normalizeIban(numberOrIban)
+	for _, account := range s.cardAccount.AccountListResponse {
+		if account.AccountNumber == numberOrIban || (iban != "" && normalizeIban(account.Iban) == iban) {
+			return account, true
+		}
+	}
+	return ininal.AccountInfo{}, false
+}
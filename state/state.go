@@ -0,0 +1,220 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// State is persisted between runs so long-running operations like backfills
+// can pick up where they stopped.
+type State struct {
+	path string
+
+	Backfills map[string]*Backfill `json:"backfills"`
+	// Imports maps Ininal reference numbers to the Pocketsmith transactions
+	// created for them
+	Imports map[string]*Import `json:"imports"`
+	// Reversals maps the reference numbers of reversed or disappeared Ininal
+	// transactions to how they were handled
+	Reversals map[string]*Reversal `json:"reversals"`
+	// Accounts maps Ininal account numbers to what is known about them
+	Accounts map[string]*Account `json:"accounts"`
+	// Icons maps the Ininal transaction icons seen so far to how often they
+	// were seen
+	Icons map[string]*Icon `json:"icons"`
+	// Exchanges maps the reference numbers of the sold legs of currency
+	// exchanges between Ininal accounts to the exchange
+	Exchanges map[string]*Exchange `json:"exchanges"`
+	// Events maps recurring payments, by the key of the series, to the
+	// Pocketsmith budget events created for them
+	Events map[string]*Event `json:"events"`
+}
+
+// Event records a Pocketsmith budget event created for a recurring payment
+type Event struct {
+	EventID    string    `json:"eventId"`
+	ScenarioID int       `json:"scenarioId"`
+	Amount     float64   `json:"amount"`
+	Date       time.Time `json:"date"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+// Exchange records a currency exchange between two Ininal accounts. The
+// amounts are positive.
+type Exchange struct {
+	Date           time.Time `json:"date"`
+	SoldCurrency   string    `json:"soldCurrency"`
+	SoldAmount     float64   `json:"soldAmount"`
+	BoughtRef      string    `json:"boughtRef"`
+	BoughtCurrency string    `json:"boughtCurrency"`
+	BoughtAmount   float64   `json:"boughtAmount"`
+}
+
+// Icon records an Ininal transaction icon seen while syncing
+type Icon struct {
+	// Imported is the number of transactions with the icon created in Pocketsmith
+	Imported  int       `json:"imported"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+	// Example is the description of the latest transaction with the icon
+	Example string `json:"example"`
+}
+
+// Account records an Ininal account that was synced to Pocketsmith
+type Account struct {
+	TransactionAccountID int       `json:"transactionAccountId"`
+	Status               string    `json:"status"`
+	LastSyncAt           time.Time `json:"lastSyncAt"`
+	// ArchivedAt is set once the Pocketsmith account was archived after the
+	// Ininal account closed
+	ArchivedAt time.Time `json:"archivedAt"`
+}
+
+// Backfill tracks the progress of a historical import for a single Ininal account.
+type Backfill struct {
+	From      time.Time `json:"from"`
+	To        time.Time `json:"to"`
+	ChunkDays int       `json:"chunkDays"`
+	// Completed is the end date of the last chunk that was fully imported
+	Completed time.Time `json:"completed"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Import records an Ininal transaction that was imported into Pocketsmith
+type Import struct {
+	TransactionID        int `json:"transactionId"`
+	TransactionAccountID int `json:"transactionAccountId"`
+	// Hash is the content hash of the Ininal transaction at the time of the
+	// last import or update
+	Hash string    `json:"hash"`
+	Date time.Time `json:"date"`
+
+	// The values last written to Pocketsmith, used to detect edits made in
+	// Pocketsmith
+	Payee      string  `json:"payee"`
+	Amount     float64 `json:"amount"`
+	Note       string  `json:"note"`
+	IsTransfer bool    `json:"isTransfer"`
+	CategoryID int     `json:"categoryId,omitempty"`
+	// TransferRef is the reference number of the other leg when the
+	// transaction was linked as a transfer, or pocketsmith:<id> when the other
+	// leg is in another Pocketsmith account
+	TransferRef string `json:"transferRef,omitempty"`
+	// TransferNote is the note added when linking the transfer
+	TransferNote string `json:"transferNote,omitempty"`
+	// Foreign is set when the transaction was made in another currency than
+	// its account
+	Foreign *Foreign `json:"foreign,omitempty"`
+	// RepeatActionType is the repeat type Ininal gave the transaction, set
+	// for payments Ininal knows to be recurring
+	RepeatActionType string `json:"repeatActionType,omitempty"`
+	// Fee is set when the transaction is a fee or had a fee split off
+	Fee *Fee `json:"fee,omitempty"`
+
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Fee records a fee charged by Ininal
+type Fee struct {
+	Kind string `json:"kind"`
+	// Amount is positive
+	Amount float64 `json:"amount"`
+	// TransactionID is the Pocketsmith transaction the fee was split off
+	// into, 0 when the imported transaction is the fee
+	TransactionID int `json:"transactionId,omitempty"`
+	// Pending is set when the fee was split off the imported transaction but
+	// neither its transaction could be created nor the fee put back. The
+	// next sync tries again.
+	Pending bool `json:"pending,omitempty"`
+}
+
+// Foreign is the original currency and amount of a transaction made in another
+// currency than its account
+type Foreign struct {
+	Currency string `json:"currency"`
+	// Amount has the sign of the transaction, it is 0 when the original amount
+	// is unknown
+	Amount float64 `json:"amount"`
+	// AccountCurrency is the currency of the account the transaction was
+	// converted to
+	AccountCurrency string `json:"accountCurrency"`
+}
+
+// Reversal records a reversed or disappeared transaction that was handled
+type Reversal struct {
+	// ReversalRef is the reference number of the reversing transaction, empty
+	// when the original transaction disappeared from Ininal
+	ReversalRef string    `json:"reversalRef"`
+	Action      string    `json:"action"`
+	HandledAt   time.Time `json:"handledAt"`
+}
+
+// Load reads the state file at path. A missing file results in an empty state.
+func Load(path string) (*State, error) {
+	s := &State{path: path}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read state file: %v", err)
+		}
+	} else if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("failed to decode state file: %v", err)
+	}
+
+	if s.Backfills == nil {
+		s.Backfills = map[string]*Backfill{}
+	}
+	if s.Imports == nil {
+		s.Imports = map[string]*Import{}
+	}
+	if s.Reversals == nil {
+		s.Reversals = map[string]*Reversal{}
+	}
+	if s.Accounts == nil {
+		s.Accounts = map[string]*Account{}
+	}
+	if s.Icons == nil {
+		s.Icons = map[string]*Icon{}
+	}
+	if s.Exchanges == nil {
+		s.Exchanges = map[string]*Exchange{}
+	}
+	if s.Events == nil {
+		s.Events = map[string]*Event{}
+	}
+
+	return s, nil
+}
+
+// Save writes the state back to disk. The file is replaced atomically so an
+// interrupted run never leaves a truncated state behind.
+func (s *State) Save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary state file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to replace state file: %v", err)
+	}
+
+	return nil
+}
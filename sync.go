@@ -0,0 +1,291 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/dvcrn/pocketsmith-go"
+	"github.com/dvcrn/pocketsmith-ininal/ininal"
+	"github.com/dvcrn/pocketsmith-ininal/psapi"
+	"github.com/dvcrn/pocketsmith-ininal/rules"
+	"github.com/dvcrn/pocketsmith-ininal/state"
+)
+
+// syncer syncs the accounts of an Ininal login into Pocketsmith
+type syncer struct {
+	config   *Config
+	ps       *pocketsmith.Client
+	api      *psapi.Client
+	im       *importer
+	mappings *AccountMappings
+	userID   int
+	// legs are the imported transactions that may be transfers, linked once
+	// all accounts are synced
+	legs []transferLeg
+}
+
+// syncAccount syncs a single Ininal account and reports the outcome
+func (s *syncer) syncAccount(sess *session, account ininal.AccountInfo) *accountReport {
+	config := s.config
+	st := s.im.state
+
+	report := &accountReport{
+		AccountNumber: account.AccountNumber,
+		AccountName:   account.AccountName,
+		Currency:      account.Currency,
+		Status:        account.AccountStatus,
+	}
+	recordBalance(config, account)
+
+	for _, card := range account.CardListResponse {
+		if card.IsBlocked() {
+			report.BlockedCards = append(report.BlockedCards, fmt.Sprintf("%s card ending in %s is %s", card.CardType, card.LastDigits(), card.CardStatus))
+		}
+	}
+
+	known := st.Accounts[account.AccountNumber]
+	if account.IsClosed() && known != nil && !known.ArchivedAt.IsZero() {
+		report.SkipReason = "account is closed and was archived in Pocketsmith"
+		return report
+	}
+
+	fmt.Printf("Fetching transactions from %s to %s\n", config.Since.Format(DATE_FORMAT), config.Until.Format(DATE_FORMAT))
+	transactions, err := sess.transactions(account.AccountNumber, config.Since, config.Until, config.ResultLimit)
+	if err != nil {
+		fmt.Printf("Error fetching transactions: %v\n", err)
+		report.Error = fmt.Sprintf("failed to fetch transactions: %v", err)
+		return report
+	}
+
+	// don't create Pocketsmith accounts for accounts that were closed without
+	// ever being used
+	if account.IsClosed() && known == nil && amountsEqual(account.AccountBalance, 0) && len(transactions) == 0 {
+		report.SkipReason = "account is closed and was never used"
+		return report
+	}
+
+	fmt.Println("Creating Pocketsmith account for account", account.AccountNumber)
+
+	psAcc, err := resolveAccount(s.ps, s.api, s.userID, s.mappings, account, known)
+	if err != nil {
+		fmt.Printf("Error creating/finding Pocketsmith account: %v\n", err)
+		report.Error = fmt.Sprintf("failed to create/find Pocketsmith account: %v", err)
+		return report
+	}
+	if psAcc == nil {
+		fmt.Println("Ignoring account", account.AccountNumber)
+		report.SkipReason = "ignored by the account mapping"
+		return report
+	}
+
+	dateString := time.Now().Format(DATE_FORMAT)
+
+	start := time.Now()
+	updateRes, err := s.ps.UpdateTransactionAccount(psAcc.TransactionAccountID, psAcc.InstitutionID, account.AccountBalance, dateString)
+	recordPocketsmith("PUT /transaction_accounts/:id", start, err)
+	if err != nil {
+		fmt.Printf("Error updating Ininal account balance: %v\n", err)
+		report.Error = fmt.Sprintf("failed to update balance: %v", err)
+		return report
+	}
+	fmt.Println("Updated Ininal Account balance: ", updateRes.CurrentBalance)
+
+	fmt.Println(len(transactions))
+	complete := len(transactions) < config.ResultLimit
+	if !complete {
+		fmt.Printf("Warning: Ininal returned %d transactions which is the configured limit, older transactions may be missing. Use -limit or the backfill command to import them\n", len(transactions))
+		report.Notes = append(report.Notes, "the transaction limit was reached, older transactions may be missing")
+	}
+
+	result := s.im.syncTransactions(psAcc.TransactionAccountID, account, config.Since, config.Until, transactions, complete)
+	report.Result = &result
+	if config.LinkTransfers {
+		s.legs = append(s.legs, s.im.transferLegs(psAcc.TransactionAccountID, account, transactions)...)
+	}
+	fmt.Printf("Account %s: %d fetched, %d created, %d updated, %d skipped, %d failed, %d reversals\n", account.AccountNumber, result.Fetched, result.Created, result.Updated, result.Skipped, result.Failed, result.Reversed)
+
+	if known == nil {
+		known = &state.Account{}
+		st.Accounts[account.AccountNumber] = known
+	}
+	known.TransactionAccountID = psAcc.TransactionAccountID
+	known.Status = account.AccountStatus
+	known.LastSyncAt = time.Now()
+
+	if config.CheckBalance {
+		check, err := s.im.checkBalance(psAcc.TransactionAccountID, account, transactions, config.OpeningBalance)
+		if err != nil {
+			fmt.Printf("Error checking balance: %v\n", err)
+			report.Notes = append(report.Notes, fmt.Sprintf("balance check failed: %v", err))
+		} else {
+			check.print(config.BalanceThreshold)
+			report.Balance = check
+		}
+	}
+
+	// the final sync of a closed account is done, archive it in Pocketsmith
+	if account.IsClosed() && result.Failed == 0 {
+		if err := archiveAccount(s.api, s.userID, psAcc); err != nil {
+			fmt.Printf("Error archiving Pocketsmith account: %v\n", err)
+			report.Notes = append(report.Notes, fmt.Sprintf("failed to archive the closed account: %v", err))
+		} else {
+			known.ArchivedAt = time.Now()
+			report.Notes = append(report.Notes, "account is closed, archived the Pocketsmith account after the final sync")
+		}
+	}
+
+	if err := st.Save(); err != nil {
+		fmt.Printf("Error saving state: %v\n", err)
+	}
+
+	return report
+}
+
+// syncIdentity syncs all accounts of the Ininal login of config. Failures,
+// even panics, end up in the report so the other identities still get synced.
+func syncIdentity(config *Config, st *state.State) (report *identityReport) {
+	report = &identityReport{Identity: config.Identity}
+	defer func() {
+		if r := recover(); r != nil {
+			report.Error = fmt.Sprintf("unexpected error: %v", r)
+		}
+	}()
+
+	if config.Identity != "" {
+		fmt.Println("Syncing identity", config.Identity)
+	}
+
+	mappings, err := config.accountMappings()
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	txRules, err := rules.Load(config.RulesFile)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	templates, err := config.Templates.parse()
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+
+	ps := pocketsmith.NewClient(config.PocketsmithToken)
+	api := psapi.NewClient(config.PocketsmithToken)
+	im := &importer{
+		api:             api,
+		state:           st,
+		stopAfterKnown:  config.StopAfterKnown,
+		updatePolicy:    config.UpdatePolicy,
+		reversalAction:  config.ReversalAction,
+		reversalTypes:   config.ReversalTypes,
+		fxTypes:         config.FXTypes,
+		foreignCurrency: config.ForeignCurrency,
+		labels:          config.Labels,
+		templates:       templates,
+		rules:           txRules,
+	}
+
+	start := time.Now()
+	res, err := ps.GetCurrentUser()
+	recordPocketsmith("GET /me", start, err)
+	if err != nil {
+		report.Error = fmt.Sprintf("failed to get the Pocketsmith user: %v", err)
+		return report
+	}
+
+	fmt.Println("Pocketsmith user ID:", res.ID)
+	report.PocketsmithUserID = res.ID
+
+	if err := resolveCategories(api, res.ID, txRules); err != nil {
+		report.Error = err.Error()
+		return report
+	}
+
+	sess, err := login(config)
+	if err != nil {
+		report.Error = fmt.Sprintf("failed to log into Ininal: %v", err)
+		return report
+	}
+
+	s := &syncer{config: config, ps: ps, api: api, im: im, mappings: mappings, userID: res.ID}
+
+	accounts := sess.cardAccount.AccountListResponse
+	if config.onlyAccount != "" {
+		accounts = nil
+		if account, ok := sess.findAccount(config.onlyAccount); ok {
+			accounts = append(accounts, account)
+		}
+	}
+
+	// Get transactions for each account
+	for _, account := range accounts {
+		report.Accounts = append(report.Accounts, s.syncAccount(sess, account))
+	}
+
+	if config.LinkTransfers {
+		report.Transfers, report.Notes = s.linkTransfers()
+	}
+
+	return report
+}
+
+// syncAll syncs every identity of config and summarizes the run
+func syncAll(config *Config) *runReport {
+	report := &runReport{StartedAt: time.Now()}
+
+	defer func() {
+		recordRun(report)
+		if config.MetricsFile != "" {
+			if err := writeMetricsFile(config.MetricsFile); err != nil {
+				fmt.Printf("Error writing metrics: %v\n", err)
+			}
+		}
+	}()
+
+	st, err := state.Load(config.StateFile)
+	if err != nil {
+		report.Error = err.Error()
+		report.FinishedAt = time.Now()
+		return report
+	}
+
+	for _, identityConfig := range config.identities() {
+		identityReport := syncIdentity(identityConfig, st)
+		for _, accountReport := range identityReport.Accounts {
+			if accountReport.Balance != nil && accountReport.Balance.exceeds(config.BalanceThreshold) {
+				report.BalanceMismatch = true
+			}
+		}
+		report.Identities = append(report.Identities, identityReport)
+	}
+
+	report.FinishedAt = time.Now()
+	return report
+}
+
+func runSync(args []string) {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	config := registerConfigFlags(fs)
+	registerPocketsmithFlags(fs, config, true)
+	registerSyncFlags(fs, config)
+	config.parse(fs, args)
+
+	report := syncAll(config)
+	if report.Error != "" {
+		fail(EXIT_ERROR, fmt.Errorf("%s", report.Error))
+	}
+	report.print()
+
+	if report.BalanceMismatch && config.FailOnBalanceMismatch {
+		fmt.Println("Error: the balance of at least one account does not match Ininal")
+		os.Exit(EXIT_BALANCE_MISMATCH)
+	}
+	if report.failed() {
+		fmt.Println("Error: at least one identity or account could not be synced completely")
+		os.Exit(EXIT_PARTIAL)
+	}
+}
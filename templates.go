@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/dvcrn/pocketsmith-ininal/ininal"
+)
+
+// The default transaction templates, they reproduce what the importer always
+// wrote
+const (
+	DEFAULT_PAYEE_TEMPLATE  = "{{.Payee}}"
+	DEFAULT_NOTE_TEMPLATE   = "{{.TransactionType}}"
+	DEFAULT_MEMO_TEMPLATE   = "{{.ReferenceNo}}"
+	DEFAULT_CHEQUE_TEMPLATE = "{{.ReferenceNo}}"
+)
+
+// TemplateConfig holds the text/templates for the fields of imported
+// transactions, they are executed with templateData
+type TemplateConfig struct {
+	Payee        string `yaml:"payee"`
+	Note         string `yaml:"note"`
+	Memo         string `yaml:"memo"`
+	ChequeNumber string `yaml:"cheque_number"`
+}
+
+// templateData is what the transaction templates are executed with. The fields
+// of the Ininal transaction are available directly, like {{.Description}}, the
+// account and card as {{.Account.AccountName}} and {{.Card.CardNumber}}.
+type templateData struct {
+	ininal.Transaction
+	Account ininal.AccountInfo
+	Card    ininal.CardInfo
+	// Payee is the payee given by the payee rules
+	Payee string
+}
+
+// sampleCard and sampleTemplateData are a typical card purchase the templates
+// are tried with at startup, so unknown fields are reported before syncing.
+// Templates that only fail for some transactions, like slicing a short
+// description, fail that transaction when it is imported.
+var sampleCard = ininal.CardInfo{
+	CardId:        1234567,
+	ProductCode:   "ININAL_VIRTUAL",
+	CardStatus:    "ACTIVE",
+	CardType:      "VIRTUAL",
+	BarcodeNumber: "1234567890123",
+	CardNumber:    "5351123412341234",
+	CardToken:     "0123456789abcdef",
+}
+
+var sampleTemplateData = templateData{
+	Transaction: ininal.Transaction{
+		TransactionDate: time.Date(2024, 3, 1, 14, 30, 0, 0, time.FixedZone("TRT", 3*60*60)),
+		Description:     "MIGROS 1234 ISTANBUL TR",
+		ReferenceNo:     "240301143000123456",
+		Amount:          -152.4,
+		Currency:        "TRY",
+		Icon:            "market",
+		TransactionType: "Alışveriş",
+	},
+	Account: ininal.AccountInfo{
+		AccountNumber:    "1234567890",
+		AccountName:      "TL Hesabım",
+		AccountStatus:    "ACTIVE",
+		AccountBalance:   1250.75,
+		Currency:         "TRY",
+		Iban:             "TR120006400000112345678901",
+		IbanValid:        true,
+		CardListResponse: []ininal.CardInfo{sampleCard},
+		AvailableBalance: 1250.75,
+	},
+	Card:  sampleCard,
+	Payee: "Migros",
+}
+
+// transactionTemplates are the parsed TemplateConfig
+type transactionTemplates struct {
+	payee, note, memo, chequeNumber *template.Template
+}
+
+// parse parses the templates, empty templates are replaced by the defaults
+func (c TemplateConfig) parse() (*transactionTemplates, error) {
+	templates := &transactionTemplates{}
+	for _, t := range []struct {
+		name string
+		text string
+		def  string
+		dest **template.Template
+	}{
+		{"payee", c.Payee, DEFAULT_PAYEE_TEMPLATE, &templates.payee},
+		{"note", c.Note, DEFAULT_NOTE_TEMPLATE, &templates.note},
+		{"memo", c.Memo, DEFAULT_MEMO_TEMPLATE, &templates.memo},
+		{"cheque_number", c.ChequeNumber, DEFAULT_CHEQUE_TEMPLATE, &templates.chequeNumber},
+	} {
+		text := t.text
+		if text == "" {
+			text = t.def
+		}
+		parsed, err := template.New(t.name).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s template %q: %v", t.name, text, err)
+		}
+		// fields that don't exist only fail when the template is executed
+		if err := parsed.Execute(&bytes.Buffer{}, sampleTemplateData); err != nil {
+			return nil, fmt.Errorf("invalid %s template %q: %v", t.name, text, err)
+		}
+		*t.dest = parsed
+	}
+	return templates, nil
+}
+
+func executeTemplate(t *template.Template, data templateData) (string, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to execute the %s template: %v", t.Name(), err)
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// accountCard returns the card of account shown to the templates, the first
+// usable card or else the first card
+func accountCard(account ininal.AccountInfo) ininal.CardInfo {
+	for _, card := range account.CardListResponse {
+		if !card.IsBlocked() {
+			return card
+		}
+	}
+	if len(account.CardListResponse) > 0 {
+		return account.CardListResponse[0]
+	}
+	return ininal.CardInfo{}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseTemplates(t *testing.T) {
+	tests := []struct {
+		name   string
+		config TemplateConfig
+		err    string
+	}{
+		{"defaults", TemplateConfig{}, ""},
+		{"fields", TemplateConfig{Payee: "{{.Payee}} ({{.Card.LastDigits}})", Note: "{{.Account.AccountName}} {{.Icon}}"}, ""},
+		{"slice", TemplateConfig{Payee: "{{slice .Description 0 6}}"}, ""},
+		{"index", TemplateConfig{Note: "{{(index .Account.CardListResponse 0).CardType}}"}, ""},
+		{"printf", TemplateConfig{Memo: `{{printf "%.2f %s" .Amount .Currency}}`}, ""},
+		{"conditional", TemplateConfig{Note: `{{if lt .Amount 0.0}}debit{{else}}credit{{end}}`}, ""},
+		{"syntax error", TemplateConfig{Payee: "{{.Payee"}, "invalid payee template"},
+		{"unknown field", TemplateConfig{Memo: "{{.Reference}}"}, "invalid memo template"},
+		{"unknown nested field", TemplateConfig{ChequeNumber: "{{.Card.Number}}"}, "invalid cheque_number template"},
+		{"unknown function", TemplateConfig{Note: "{{upper .Payee}}"}, "invalid note template"},
+	}
+
+	for _, test := range tests {
+		_, err := test.config.parse()
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: expected an error containing %q, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestExecuteTemplates(t *testing.T) {
+	templates, err := TemplateConfig{Payee: "{{slice .Description 0 6}}"}.parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := sampleTemplateData
+	if got, err := executeTemplate(templates.payee, data); err != nil || got != "MIGROS" {
+		t.Errorf("expected MIGROS, got %q (%v)", got, err)
+	}
+	if got, err := executeTemplate(templates.note, data); err != nil || got != "Alışveriş" {
+		t.Errorf("expected the default note Alışveriş, got %q (%v)", got, err)
+	}
+
+	// fails for this transaction only
+	data.Description = "BIM"
+	if _, err := executeTemplate(templates.payee, data); err == nil || !strings.Contains(err.Error(), "payee template") {
+		t.Errorf("expected an error executing the payee template, got %v", err)
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dvcrn/pocketsmith-ininal/ininal"
+	"github.com/dvcrn/pocketsmith-ininal/psapi"
+	"github.com/dvcrn/pocketsmith-ininal/state"
+)
+
+// FX_TRANSFER_WINDOW is how far apart the legs of a transfer between accounts
+// in different currencies may be. Ininal books currency exchanges on both
+// accounts at once, their amounts can't be compared, so both legs also need
+// one of the FX types.
+const FX_TRANSFER_WINDOW = 10 * time.Minute
+
+// PS_TRANSFER_PREFIX marks transfer references to transactions in other
+// Pocketsmith accounts
+const PS_TRANSFER_PREFIX = "pocketsmith:"
+
+// transferLeg is an imported Ininal transaction that may be one side of a
+// transfer
+type transferLeg struct {
+	account     ininal.AccountInfo
+	transaction ininal.Transaction
+	// classified is set when the transfer rules consider the transaction a
+	// transfer. At least one leg of a pair must be classified.
+	classified bool
+	// fx is set when the transaction has one of the FX types
+	fx bool
+}
+
+// currency is the currency of the amount of the leg, the one of its account.
+// The transaction currency of a foreign card payment is not.
+func (leg transferLeg) currency() string {
+	return strings.ToUpper(leg.account.Currency)
+}
+
+func (leg transferLeg) String() string {
+	return fmt.Sprintf("%s %.2f %s (%s)", leg.account.AccountNumber, leg.transaction.Amount, leg.currency(), leg.transaction.ReferenceNo)
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// transferLegs returns the transactions imported into the transaction account
+// that are not linked as transfers yet
+func (im *importer) transferLegs(transactionAccountID int, account ininal.AccountInfo, transactions []ininal.Transaction) []transferLeg {
+	var legs []transferLeg
+	for _, transaction := range transactions {
+		record := im.state.Imports[transaction.ReferenceNo]
+		if record == nil || record.TransactionAccountID != transactionAccountID || record.TransferRef != "" || transaction.Amount == 0 {
+			continue
+		}
+		if im.state.Reversals[transaction.ReferenceNo] != nil {
+			continue
+		}
+		payee, _ := im.rules.Payee(transaction)
+		legs = append(legs, transferLeg{
+			account:     account,
+			transaction: transaction,
+			classified:  isTransfer(im.rules, im.fxTypes, transaction, payee),
+			fx:          isFXType(transaction, im.fxTypes),
+		})
+	}
+	return legs
+}
+
+// pairTransfers pairs debits with credits of other Ininal accounts. Legs in
+// the same currency need the same amount and at most window days between
+// them. Legs in different currencies must both have an FX type and be at most
+// FX_TRANSFER_WINDOW apart. The closest credit wins. The legs that were not paired are returned as remaining.
+func pairTransfers(legs []transferLeg, window int) (pairs [][2]transferLeg, remaining []transferLeg) {
+	paired := map[int]bool{}
+
+	for i, debit := range legs {
+		if debit.transaction.Amount >= 0 {
+			continue
+		}
+
+		match := -1
+		var best time.Duration
+		for j, credit := range legs {
+			if paired[j] || credit.transaction.Amount <= 0 || credit.account.AccountNumber == debit.account.AccountNumber {
+				continue
+			}
+			if !debit.classified && !credit.classified {
+				continue
+			}
+
+			distance := absDuration(credit.transaction.TransactionDate.Sub(debit.transaction.TransactionDate))
+			if debit.currency() == credit.currency() {
+				if !amountsEqual(-debit.transaction.Amount, credit.transaction.Amount) || distance > time.Duration(window)*24*time.Hour {
+					continue
+				}
+			} else if !debit.fx || !credit.fx || distance > FX_TRANSFER_WINDOW {
+				continue
+			}
+
+			if match == -1 || distance < best {
+				match, best = j, distance
+			}
+		}
+
+		if match == -1 {
+			continue
+		}
+		paired[i] = true
+		paired[match] = true
+		pairs = append(pairs, [2]transferLeg{debit, legs[match]})
+	}
+
+	for i, leg := range legs {
+		if !paired[i] {
+			remaining = append(remaining, leg)
+		}
+	}
+	return pairs, remaining
+}
+
+// markTransfer flags tx as a transfer and appends note
+func markTransfer(api *psapi.Client, tx psapi.Transaction, note string) error {
+	update := &psapi.UpdateTransaction{}
+	changed := false
+	if newNote := appendNote(tx.Note, note); newNote != tx.Note {
+		update.Note = &newNote
+		changed = true
+	}
+	if !tx.IsTransfer {
+		isTransfer := true
+		update.IsTransfer = &isTransfer
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+
+	_, err := api.UpdateTransaction(tx.ID, update)
+	return err
+}
+
+// markLeg marks the Pocketsmith transaction imported for ref as a transfer.
+// Marking it again is harmless, the note is only appended once.
+func (im *importer) markLeg(ref, note string) error {
+	record := im.state.Imports[ref]
+	tx, err := im.api.GetTransaction(record.TransactionID)
+	if err != nil {
+		return err
+	}
+	if err := markTransfer(im.api, *tx, note); err != nil {
+		return err
+	}
+
+	// keep preserve-edits from treating our own changes as user edits
+	record.IsTransfer = true
+	record.Note = appendNote(tx.Note, note)
+	return nil
+}
+
+// recordLink records the marked leg ref as linked to otherRef, linked legs are
+// not paired again
+func (im *importer) recordLink(ref, otherRef, note string) {
+	record := im.state.Imports[ref]
+	record.TransferRef = otherRef
+	record.TransferNote = note
+}
+
+// linkLeg marks the Pocketsmith transaction imported for ref as a transfer to
+// or from otherRef and records the link
+func (im *importer) linkLeg(ref, otherRef, note string) error {
+	if err := im.markLeg(ref, note); err != nil {
+		return err
+	}
+	im.recordLink(ref, otherRef, note)
+	return nil
+}
+
+// linkTransfers links the transfer legs collected while syncing the accounts
+// of the identity. It returns the links made and the problems linking them.
+func (s *syncer) linkTransfers() (links []string, problems []string) {
+	pairs, remaining := pairTransfers(s.legs, s.config.TransferWindow)
+
+	for _, pair := range pairs {
+		debit, credit := pair[0], pair[1]
+		debitRef, creditRef := debit.transaction.ReferenceNo, credit.transaction.ReferenceNo
+
+		debitNote := fmt.Sprintf("Transfer to %s, ref %s", credit.account.AccountName, creditRef)
+		creditNote := fmt.Sprintf("Transfer from %s, ref %s", debit.account.AccountName, debitRef)
+		var exchange *state.Exchange
+		if debit.currency() != credit.currency() {
+			exchange = &state.Exchange{
+				Date:           debit.transaction.TransactionDate,
+				SoldCurrency:   debit.currency(),
+				SoldAmount:     -debit.transaction.Amount,
+				BoughtRef:      creditRef,
+				BoughtCurrency: credit.currency(),
+				BoughtAmount:   credit.transaction.Amount,
+			}
+			rate := exchangeRate(exchange, BASE_CURRENCY)
+			debitNote = fmt.Sprintf("Exchange to %s, ref %s, %s", credit.account.AccountName, creditRef, rate)
+			creditNote = fmt.Sprintf("Exchange from %s, ref %s, %s", debit.account.AccountName, debitRef, rate)
+		}
+
+		// the link is only recorded once both legs are marked, so a pair
+		// with a failed leg is paired and marked again by the next sync
+		if err := s.im.markLeg(debitRef, debitNote); err != nil {
+			problems = append(problems, fmt.Sprintf("failed to link transfer %s: %v", debit, err))
+			continue
+		}
+		if err := s.im.markLeg(creditRef, creditNote); err != nil {
+			problems = append(problems, fmt.Sprintf("failed to link transfer %s: %v", credit, err))
+			continue
+		}
+		s.im.recordLink(debitRef, creditRef, debitNote)
+		s.im.recordLink(creditRef, debitRef, creditNote)
+		if exchange != nil {
+			s.im.state.Exchanges[debitRef] = exchange
+			links = append(links, fmt.Sprintf("%s -> %s, %s", debit, credit, exchangeRate(exchange, BASE_CURRENCY)))
+			continue
+		}
+		links = append(links, fmt.Sprintf("%s -> %s", debit, credit))
+	}
+
+	externalLinks, externalProblems := s.linkExternalTransfers(remaining)
+	links = append(links, externalLinks...)
+	problems = append(problems, externalProblems...)
+
+	if err := s.im.state.Save(); err != nil {
+		fmt.Printf("Error saving state: %v\n", err)
+	}
+	return links, problems
+}
+
+// linkExternalTransfers looks for the other leg of the classified transfers
+// in legs in the configured Pocketsmith transfer accounts. A leg matches a
+// Pocketsmith transaction with the opposite amount at most TransferWindow days
+// apart, the closest one wins.
+func (s *syncer) linkExternalTransfers(legs []transferLeg) (links []string, problems []string) {
+	var candidates []transferLeg
+	for _, leg := range legs {
+		if leg.classified {
+			candidates = append(candidates, leg)
+		}
+	}
+	if len(s.config.TransferAccounts) == 0 || len(candidates) == 0 {
+		return nil, nil
+	}
+
+	window := time.Duration(s.config.TransferWindow) * 24 * time.Hour
+	from, to := candidates[0].transaction.TransactionDate, candidates[0].transaction.TransactionDate
+	for _, leg := range candidates {
+		if leg.transaction.TransactionDate.Before(from) {
+			from = leg.transaction.TransactionDate
+		}
+		if leg.transaction.TransactionDate.After(to) {
+			to = leg.transaction.TransactionDate
+		}
+	}
+	from, to = from.Add(-window-24*time.Hour), to.Add(window+24*time.Hour)
+
+	// Pocketsmith transactions already linked by earlier runs
+	used := map[string]bool{}
+	for _, record := range s.im.state.Imports {
+		if strings.HasPrefix(record.TransferRef, PS_TRANSFER_PREFIX) {
+			used[record.TransferRef] = true
+		}
+	}
+	linked := map[string]bool{}
+
+	for _, id := range s.config.TransferAccounts {
+		account, err := s.api.GetTransactionAccount(id)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("failed to get Pocketsmith transfer account %d: %v", id, err))
+			continue
+		}
+		transactions, err := s.api.ListTransactions(id, from, to)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("failed to list transactions of Pocketsmith transfer account %d: %v", id, err))
+			continue
+		}
+
+		for _, leg := range candidates {
+			ref := leg.transaction.ReferenceNo
+			if linked[ref] || (account.CurrencyCode != "" && !strings.EqualFold(account.CurrencyCode, leg.currency())) {
+				continue
+			}
+
+			legDate := leg.transaction.TransactionDate
+			legDay := time.Date(legDate.Year(), legDate.Month(), legDate.Day(), 0, 0, 0, 0, time.UTC)
+			match := -1
+			var best time.Duration
+			for i, tx := range transactions {
+				if used[fmt.Sprint(PS_TRANSFER_PREFIX, tx.ID)] || !amountsEqual(tx.Amount, -leg.transaction.Amount) {
+					continue
+				}
+				date, err := time.Parse(DATE_FORMAT, tx.Date)
+				if err != nil {
+					continue
+				}
+				distance := absDuration(date.Sub(legDay))
+				if distance > window {
+					continue
+				}
+				if match == -1 || distance < best {
+					match, best = i, distance
+				}
+			}
+			if match == -1 {
+				continue
+			}
+
+			tx := transactions[match]
+			otherRef := fmt.Sprint(PS_TRANSFER_PREFIX, tx.ID)
+			legNote, txNote := fmt.Sprintf("Transfer to %s", account.Name), fmt.Sprintf("Transfer from Ininal %s, ref %s", leg.account.AccountName, ref)
+			if leg.transaction.Amount > 0 {
+				legNote, txNote = fmt.Sprintf("Transfer from %s", account.Name), fmt.Sprintf("Transfer to Ininal %s, ref %s", leg.account.AccountName, ref)
+			}
+
+			if err := markTransfer(s.api, tx, txNote); err != nil {
+				problems = append(problems, fmt.Sprintf("failed to link transfer %s: %v", leg, err))
+				continue
+			}
+			if err := s.im.linkLeg(ref, otherRef, legNote); err != nil {
+				problems = append(problems, fmt.Sprintf("failed to link transfer %s: %v", leg, err))
+				continue
+			}
+			used[otherRef] = true
+			linked[ref] = true
+			links = append(links, fmt.Sprintf("%s <-> %s transaction %d", leg, account.Name, tx.ID))
+		}
+	}
+
+	return links, problems
+}
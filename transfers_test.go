@@ -0,0 +1,166 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/dvcrn/pocketsmith-ininal/ininal"
+)
+
+var (
+	tryAccount  = ininal.AccountInfo{AccountNumber: "1", AccountName: "TL", Currency: "TRY"}
+	usdAccount  = ininal.AccountInfo{AccountNumber: "2", AccountName: "USD", Currency: "USD"}
+	eurAccount  = ininal.AccountInfo{AccountNumber: "3", AccountName: "EUR", Currency: "EUR"}
+	tryAccount2 = ininal.AccountInfo{AccountNumber: "4", AccountName: "TL 2", Currency: "TRY"}
+)
+
+func leg(account ininal.AccountInfo, ref string, amount float64, date string, classified, fx bool) transferLeg {
+	return transferLeg{
+		account:     account,
+		transaction: ininal.Transaction{ReferenceNo: ref, Amount: amount, TransactionDate: at(date)},
+		classified:  classified,
+		fx:          fx,
+	}
+}
+
+func TestPairTransfers(t *testing.T) {
+	tests := []struct {
+		name string
+		legs []transferLeg
+		// expected lists the pairs as debit:credit reference numbers
+		expected []string
+	}{
+		{
+			name: "same currency",
+			legs: []transferLeg{
+				leg(tryAccount, "d", -100, "2024-03-01 10:00", true, false),
+				leg(tryAccount2, "c", 100, "2024-03-03 09:00", false, false),
+			},
+			expected: []string{"d:c"},
+		},
+		{
+			name: "same currency with another amount",
+			legs: []transferLeg{
+				leg(tryAccount, "d", -100, "2024-03-01 10:00", true, false),
+				leg(tryAccount2, "c", 99.5, "2024-03-01 10:00", true, false),
+			},
+		},
+		{
+			name: "same currency outside the window",
+			legs: []transferLeg{
+				leg(tryAccount, "d", -100, "2024-03-01 10:00", true, false),
+				leg(tryAccount2, "c", 100, "2024-03-04 10:01", true, false),
+			},
+		},
+		{
+			name: "neither leg classified",
+			legs: []transferLeg{
+				leg(tryAccount, "d", -100, "2024-03-01 10:00", false, false),
+				leg(tryAccount2, "c", 100, "2024-03-01 10:00", false, false),
+			},
+		},
+		{
+			name: "same account",
+			legs: []transferLeg{
+				leg(tryAccount, "d", -100, "2024-03-01 10:00", true, false),
+				leg(tryAccount, "c", 100, "2024-03-01 10:00", true, false),
+			},
+		},
+		{
+			// the USD of a foreign card payment is not the currency of its amount
+			name: "foreign card payment",
+			legs: []transferLeg{
+				func() transferLeg {
+					debit := leg(tryAccount, "d", -450.12, "2024-03-01 10:00", true, false)
+					debit.transaction.Currency = "USD"
+					return debit
+				}(),
+				leg(tryAccount2, "c", 450.12, "2024-03-01 11:00", false, false),
+			},
+			expected: []string{"d:c"},
+		},
+		{
+			name: "exchange",
+			legs: []transferLeg{
+				leg(tryAccount, "d", -3412.34, "2024-03-01 10:00", true, true),
+				leg(usdAccount, "c", 100, "2024-03-01 10:02", true, true),
+			},
+			expected: []string{"d:c"},
+		},
+		{
+			name: "different currencies without FX types",
+			legs: []transferLeg{
+				leg(tryAccount, "d", -250, "2024-03-01 10:00", true, false),
+				leg(usdAccount, "c", 20, "2024-03-01 10:03", true, false),
+			},
+		},
+		{
+			name: "different currencies with one FX leg",
+			legs: []transferLeg{
+				leg(tryAccount, "d", -3412.34, "2024-03-01 10:00", true, true),
+				leg(usdAccount, "c", 100, "2024-03-01 10:01", true, false),
+			},
+		},
+		{
+			name: "exchange outside the FX window",
+			legs: []transferLeg{
+				leg(tryAccount, "d", -3412.34, "2024-03-01 10:00", true, true),
+				leg(usdAccount, "c", 100, "2024-03-01 10:11", true, true),
+			},
+		},
+		{
+			name: "closest same currency credit wins",
+			legs: []transferLeg{
+				leg(tryAccount, "d", -100, "2024-03-02 10:00", true, false),
+				leg(tryAccount2, "far", 100, "2024-03-04 10:00", true, false),
+				leg(tryAccount2, "near", 100, "2024-03-01 12:00", true, false),
+			},
+			expected: []string{"d:near"},
+		},
+		{
+			name: "closest exchange credit wins",
+			legs: []transferLeg{
+				leg(tryAccount, "d", -3412.34, "2024-03-01 10:00", true, true),
+				leg(eurAccount, "far", 92.5, "2024-03-01 10:08", true, true),
+				leg(usdAccount, "near", 100, "2024-03-01 10:00", true, true),
+			},
+			expected: []string{"d:near"},
+		},
+		{
+			name: "each credit is paired once",
+			legs: []transferLeg{
+				leg(tryAccount, "d1", -100, "2024-03-01 10:00", true, false),
+				leg(tryAccount, "d2", -100, "2024-03-01 11:00", true, false),
+				leg(tryAccount2, "c", 100, "2024-03-01 10:30", true, false),
+			},
+			expected: []string{"d1:c"},
+		},
+		{
+			name: "two debits and two credits",
+			legs: []transferLeg{
+				leg(tryAccount, "d1", -100, "2024-03-01 10:00", true, false),
+				leg(tryAccount, "d2", -100, "2024-03-02 10:00", true, false),
+				leg(tryAccount2, "c2", 100, "2024-03-02 10:05", true, false),
+				leg(tryAccount2, "c1", 100, "2024-03-01 10:05", true, false),
+			},
+			expected: []string{"d1:c1", "d2:c2"},
+		},
+	}
+
+	for _, test := range tests {
+		pairs, remaining := pairTransfers(test.legs, 3)
+
+		var got []string
+		for _, pair := range pairs {
+			got = append(got, pair[0].transaction.ReferenceNo+":"+pair[1].transaction.ReferenceNo)
+		}
+		sort.Strings(got)
+		if strings.Join(got, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("%s: expected pairs %v, got %v", test.name, test.expected, got)
+		}
+		if len(remaining)+2*len(pairs) != len(test.legs) {
+			t.Errorf("%s: expected %d remaining legs, got %d", test.name, len(test.legs)-2*len(pairs), len(remaining))
+		}
+	}
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/term"
+)
+
+const (
+	VAULT_VERSION = 1
+	VAULT_KDF     = "argon2id"
+
+	// argon2id parameters of new vaults, the parameters of existing vaults
+	// are read from the vault file
+	VAULT_TIME    = 3
+	VAULT_MEMORY  = 64 * 1024
+	VAULT_THREADS = 4
+	VAULT_KEY_LEN = 32
+)
+
+// vaultFile is the on-disk format of the vault. Everything but the KDF
+// parameters is encrypted with AES-256-GCM using a key derived from the
+// passphrase.
+type vaultFile struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	Salt       []byte `json:"salt"`
+	Time       uint32 `json:"time"`
+	Memory     uint32 `json:"memory"`
+	Threads    uint8  `json:"threads"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// vaultLogin holds the credentials and the cached session of an Ininal login
+type vaultLogin struct {
+	Ininal           IninalConfig   `json:"ininal"`
+	PocketsmithToken string         `json:"pocketsmithToken,omitempty"`
+	Session          *cachedSession `json:"session,omitempty"`
+}
+
+// vaultData is the decrypted content of the vault
+type vaultData struct {
+	// Logins are keyed by identity name, the top-level login has the empty name
+	Logins map[string]*vaultLogin `json:"logins"`
+}
+
+// vault is an open vault
+type vault struct {
+	path string
+	file vaultFile
+	key  []byte
+	data vaultData
+}
+
+func deriveKey(passphrase string, f *vaultFile) []byte {
+	return argon2.IDKey([]byte(passphrase), f.Salt, f.Time, f.Memory, f.Threads, VAULT_KEY_LEN)
+}
+
+// newVault returns an empty vault at path encrypted with passphrase
+func newVault(path, passphrase string) (*vault, error) {
+	v := &vault{
+		path: path,
+		file: vaultFile{
+			Version: VAULT_VERSION,
+			KDF:     VAULT_KDF,
+			Salt:    make([]byte, 16),
+			Time:    VAULT_TIME,
+			Memory:  VAULT_MEMORY,
+			Threads: VAULT_THREADS,
+		},
+		data: vaultData{Logins: map[string]*vaultLogin{}},
+	}
+	if _, err := rand.Read(v.file.Salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %v", err)
+	}
+	v.key = deriveKey(passphrase, &v.file)
+	return v, nil
+}
+
+// openVault reads and decrypts the vault at path
+func openVault(path, passphrase string) (*vault, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("vault file %s does not exist, create it with the vault init command", path)
+		}
+		return nil, fmt.Errorf("failed to read vault file: %v", err)
+	}
+
+	v := &vault{path: path}
+	if err := json.Unmarshal(raw, &v.file); err != nil {
+		return nil, fmt.Errorf("failed to decode vault file %s: %v", path, err)
+	}
+	if v.file.Version != VAULT_VERSION || v.file.KDF != VAULT_KDF {
+		return nil, fmt.Errorf("unsupported vault file %s: version %d, kdf %q", path, v.file.Version, v.file.KDF)
+	}
+
+	v.key = deriveKey(passphrase, &v.file)
+	gcm, err := v.cipher()
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := gcm.Open(nil, v.file.Nonce, v.file.Ciphertext, nil)
+	if err != nil {
+		// GCM can't tell a wrong key from a modified file
+		return nil, fmt.Errorf("failed to open vault %s: wrong passphrase or the vault file was modified", path)
+	}
+
+	if err := json.Unmarshal(plaintext, &v.data); err != nil {
+		return nil, fmt.Errorf("failed to decode vault content: %v", err)
+	}
+	if v.data.Logins == nil {
+		v.data.Logins = map[string]*vaultLogin{}
+	}
+
+	return v, nil
+}
+
+func (v *vault) cipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(v.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+	return gcm, nil
+}
+
+// login returns the entry of the identity with the given name, creating it
+func (v *vault) login(identity string) *vaultLogin {
+	login := v.data.Logins[identity]
+	if login == nil {
+		login = &vaultLogin{}
+		v.data.Logins[identity] = login
+	}
+	return login
+}
+
+// save encrypts the vault with a fresh nonce and replaces the vault file
+func (v *vault) save() error {
+	plaintext, err := json.Marshal(v.data)
+	if err != nil {
+		return fmt.Errorf("failed to encode vault content: %v", err)
+	}
+
+	gcm, err := v.cipher()
+	if err != nil {
+		return err
+	}
+	v.file.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(v.file.Nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	v.file.Ciphertext = gcm.Seal(nil, v.file.Nonce, plaintext, nil)
+
+	data, err := json.MarshalIndent(v.file, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode vault file: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(v.path), filepath.Base(v.path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary vault file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write vault file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write vault file: %v", err)
+	}
+
+	if err := os.Rename(tmp.Name(), v.path); err != nil {
+		return fmt.Errorf("failed to replace vault file: %v", err)
+	}
+
+	return nil
+}
+
+// rekey re-encrypts the vault with a key derived from passphrase and a new salt
+func (v *vault) rekey(passphrase string) error {
+	v.file.Salt = make([]byte, 16)
+	if _, err := rand.Read(v.file.Salt); err != nil {
+		return fmt.Errorf("failed to generate salt: %v", err)
+	}
+	v.file.Time, v.file.Memory, v.file.Threads = VAULT_TIME, VAULT_MEMORY, VAULT_THREADS
+	v.key = deriveKey(passphrase, &v.file)
+	return v.save()
+}
+
+// apply fills the credentials of config and its identities from the vault.
+// Only values stored in the vault are applied.
+func (v *vault) apply(config *Config) {
+	fill := func(target *string, value string) {
+		if value != "" {
+			*target = value
+		}
+	}
+	credentials := func(login *vaultLogin, ininal *IninalConfig, pocketsmith *PocketsmithConfig) {
+		if login == nil {
+			return
+		}
+		fill(&ininal.DeviceID, login.Ininal.DeviceID)
+		fill(&ininal.LoginToken, login.Ininal.LoginToken)
+		fill(&ininal.UserToken, login.Ininal.UserToken)
+		fill(&ininal.LoginBearerToken, login.Ininal.LoginBearerToken)
+		fill(&ininal.Password, login.Ininal.Password)
+		fill(&ininal.LoginCredential, login.Ininal.LoginCredential)
+		fill(&ininal.DeviceSignature, login.Ininal.DeviceSignature)
+		fill(&pocketsmith.PocketsmithToken, login.PocketsmithToken)
+	}
+
+	credentials(v.data.Logins[""], &config.IninalConfig, &config.PocketsmithConfig)
+	for i := range config.Identities {
+		identity := &config.Identities[i]
+		credentials(v.data.Logins[identity.Name], &identity.IninalConfig, &identity.PocketsmithConfig)
+	}
+}
+
+// vaultPassphrase returns the vault passphrase from ININAL_VAULT_PASSPHRASE
+// (or its _FILE variant and secret references), or asks for it on the
+// terminal. confirm asks twice, for new passphrases.
+func vaultPassphrase(env, prompt string, confirm bool) (string, error) {
+	value := os.Getenv(env)
+	if path := os.Getenv(env + "_FILE"); path != "" && value == "" {
+		value = SECRET_FILE + path
+	}
+	if value != "" {
+		passphrase, err := resolveSecret(value)
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", env, err)
+		}
+		if passphrase == "" {
+			return "", fmt.Errorf("%s is empty", env)
+		}
+		return passphrase, nil
+	}
+
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return "", fmt.Errorf("no vault passphrase, set %s", env)
+	}
+
+	read := func(prompt string) (string, error) {
+		fmt.Fprint(os.Stderr, prompt)
+		passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", fmt.Errorf("failed to read passphrase: %v", err)
+		}
+		return string(passphrase), nil
+	}
+
+	passphrase, err := read(prompt)
+	if err != nil {
+		return "", err
+	}
+	if passphrase == "" {
+		return "", fmt.Errorf("the vault passphrase must not be empty")
+	}
+	if confirm {
+		again, err := read("Repeat the passphrase: ")
+		if err != nil {
+			return "", err
+		}
+		if again != passphrase {
+			return "", fmt.Errorf("the passphrases do not match")
+		}
+	}
+	return passphrase, nil
+}
+
+// loadVault opens the vault of config and applies its credentials
+func (config *Config) loadVault() error {
+	passphrase, err := vaultPassphrase("ININAL_VAULT_PASSPHRASE", "Vault passphrase: ", false)
+	if err != nil {
+		return err
+	}
+
+	v, err := openVault(config.VaultFile, passphrase)
+	if err != nil {
+		return err
+	}
+
+	v.apply(config)
+	config.vault = v
+	return nil
+}
+
+// confirmWipe asks on the terminal whether the vault at path should be wiped
+func confirmWipe(path string) (bool, error) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return false, fmt.Errorf("not wiping %s without confirmation, use -yes", path)
+	}
+
+	fmt.Fprintf(os.Stderr, "Wipe %s? The credentials and sessions in it can't be recovered [y/N]: ", path)
+	input, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(input)) {
+	case "y", "yes":
+		return true, nil
+	}
+	return false, nil
+}
+
+// wipeVault overwrites the vault file with random data before removing it
+func wipeVault(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to find vault file: %v", err)
+	}
+
+	noise := make([]byte, info.Size())
+	if _, err := rand.Read(noise); err != nil {
+		return fmt.Errorf("failed to generate random data: %v", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open vault file: %v", err)
+	}
+	if _, err := f.Write(noise); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to overwrite vault file: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to overwrite vault file: %v", err)
+	}
+	f.Close()
+
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove vault file: %v", err)
+	}
+	return nil
+}
+
+// runVault manages the vault: init stores the current credentials in a new
+// vault, show lists its content, rekey changes the passphrase and wipe
+// destroys it
+func runVault(args []string) {
+	if len(args) == 0 {
+		fail(EXIT_USAGE, fmt.Errorf("usage: vault init|show|rekey|wipe [flags]"))
+	}
+
+	action := args[0]
+	fs := flag.NewFlagSet("vault "+action, flag.ExitOnError)
+	config := registerConfigFlags(fs)
+	registerPocketsmithFlags(fs, config, false)
+
+	switch action {
+	case "init":
+		// the credentials to store come from the usual sources
+		config.noVault = true
+		config.parse(fs, args[1:])
+		if config.VaultFile == "" {
+			fail(EXIT_USAGE, fmt.Errorf("set the vault file with -vault-file, ININAL_VAULT_FILE or vault_file in the config file"))
+		}
+		if _, err := os.Stat(config.VaultFile); err == nil {
+			fail(EXIT_USAGE, fmt.Errorf("vault file %s already exists, use vault rekey to change the passphrase or vault wipe to remove it", config.VaultFile))
+		}
+
+		passphrase, err := vaultPassphrase("ININAL_VAULT_PASSPHRASE", "New vault passphrase: ", true)
+		if err != nil {
+			fail(EXIT_USAGE, err)
+		}
+		v, err := newVault(config.VaultFile, passphrase)
+		if err != nil {
+			fail(EXIT_ERROR, err)
+		}
+
+		for _, identityConfig := range config.identities() {
+			login := v.login(identityConfig.Identity)
+			login.Ininal = identityConfig.IninalConfig
+			login.PocketsmithToken = identityConfig.PocketsmithToken
+			// move a cached session into the vault
+			if cached := loadSession(identityConfig); cached != nil {
+				login.Session = cached
+				removeSession(identityConfig)
+			}
+		}
+
+		if err := v.save(); err != nil {
+			fail(EXIT_ERROR, err)
+		}
+		fmt.Printf("Stored the credentials of %d logins in %s\n", len(v.data.Logins), config.VaultFile)
+		fmt.Println("They can now be removed from the config file, environment and flags")
+
+	case "show", "rekey", "wipe":
+		var yes *bool
+		if action == "wipe" {
+			yes = fs.Bool("yes", false, "Wipe the vault without asking for confirmation")
+		}
+		// the credentials don't need to be complete to manage the vault
+		config.noVault, config.noLogin = true, true
+		config.parse(fs, args[1:])
+		if config.VaultFile == "" {
+			fail(EXIT_USAGE, fmt.Errorf("set the vault file with -vault-file, ININAL_VAULT_FILE or vault_file in the config file"))
+		}
+
+		if action == "wipe" {
+			if _, err := os.Stat(config.VaultFile); err != nil {
+				fail(EXIT_ERROR, err)
+			}
+			if !*yes {
+				confirmed, err := confirmWipe(config.VaultFile)
+				if err != nil {
+					fail(EXIT_USAGE, err)
+				}
+				if !confirmed {
+					fmt.Println("Kept", config.VaultFile)
+					return
+				}
+			}
+			if err := wipeVault(config.VaultFile); err != nil {
+				fail(EXIT_ERROR, err)
+			}
+			fmt.Println("Wiped", config.VaultFile)
+			return
+		}
+
+		passphrase, err := vaultPassphrase("ININAL_VAULT_PASSPHRASE", "Vault passphrase: ", false)
+		if err != nil {
+			fail(EXIT_USAGE, err)
+		}
+		v, err := openVault(config.VaultFile, passphrase)
+		if err != nil {
+			fail(EXIT_ERROR, err)
+		}
+
+		if action == "show" {
+			var names []string
+			for name := range v.data.Logins {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				login := v.data.Logins[name]
+				label := name
+				if label == "" {
+					label = "(top level)"
+				}
+				session := "no session"
+				if login.Session != nil {
+					session = "session from " + login.Session.CreatedAt.Format(DATE_FORMAT)
+				}
+				fmt.Printf("%s: login credential %s, device ID %s, Pocketsmith token %t, %s\n", label, login.Ininal.LoginCredential, login.Ininal.DeviceID, login.PocketsmithToken != "", session)
+			}
+			return
+		}
+
+		newPassphrase, err := vaultPassphrase("ININAL_VAULT_NEW_PASSPHRASE", "New vault passphrase: ", true)
+		if err != nil {
+			fail(EXIT_USAGE, err)
+		}
+		if err := v.rekey(newPassphrase); err != nil {
+			fail(EXIT_ERROR, err)
+		}
+		fmt.Println("Changed the passphrase of", config.VaultFile)
+
+	default:
+		fail(EXIT_USAGE, fmt.Errorf("unknown vault command %q, expected init, show, rekey or wipe", action))
+	}
+}